@@ -0,0 +1,322 @@
+// multiupload 大文件分片上传命令行工具
+//
+//	multiupload upload  -server http://127.0.0.1:8080 -type 13 game.zip
+//	multiupload resume  game.zip.multiupload.json
+//	multiupload status  game.zip.multiupload.json
+//	multiupload abort   game.zip.multiupload.json
+//	multiupload publish -unzip game.zip.multiupload.json
+//	multiupload queue   stats
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"api_mgr/upload/client"
+)
+
+const usage = `usage: multiupload <command> [flags] <file|state>
+
+commands:
+  upload   上传文件, 在文件旁生成续传状态文件
+  resume   根据状态文件继续上传
+  status   查看上传状态
+  abort    取消上传并删除状态文件
+  publish  发布已上传完成的文件
+  queue    查看和管理延迟任务队列
+
+run 'multiupload <command> -h' for command flags
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch os.Args[1] {
+	case "upload":
+		err = runUpload(ctx, os.Args[2:])
+	case "resume":
+		err = runResume(ctx, os.Args[2:])
+	case "status":
+		err = runStatus(ctx, os.Args[2:])
+	case "abort":
+		err = runAbort(ctx, os.Args[2:])
+	case "publish":
+		err = runPublish(ctx, os.Args[2:])
+	case "queue":
+		err = runQueue(ctx, os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multiupload %s: %s\n", os.Args[1], err.Error())
+		os.Exit(1)
+	}
+}
+
+// 公共参数
+type options struct {
+	server    string
+	token     string
+	workers   int
+	retries   int
+	quiet     bool
+	unzip     bool
+	unzipPath string
+}
+
+func (o *options) bind(fs *flag.FlagSet) {
+	fs.StringVar(&o.server, "server", os.Getenv("MULTIUPLOAD_SERVER"), "server address, default $MULTIUPLOAD_SERVER")
+	fs.StringVar(&o.token, "token", os.Getenv("MULTIUPLOAD_TOKEN"), "authorization token, default $MULTIUPLOAD_TOKEN")
+	fs.IntVar(&o.workers, "workers", 4, "concurrent chunk uploads")
+	fs.IntVar(&o.retries, "retries", 3, "retries per request")
+	fs.BoolVar(&o.quiet, "quiet", false, "hide progress bar")
+}
+
+func (o *options) bindPublish(fs *flag.FlagSet) {
+	fs.BoolVar(&o.unzip, "unzip", false, "unzip and publish")
+	fs.StringVar(&o.unzipPath, "unzip-path", "", "sub directory to unzip into")
+}
+
+func (o *options) service(server string) (*client.HTTPService, error) {
+	if o.server != "" {
+		server = o.server
+	}
+	if server == "" {
+		return nil, fmt.Errorf("server address required, use -server or $MULTIUPLOAD_SERVER")
+	}
+	service := client.NewHTTPService(server)
+	if o.token != "" {
+		service.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	return service, nil
+}
+
+func (o *options) uploader(service client.Service) *client.Uploader {
+	uploader := client.NewUploader(service)
+	uploader.Workers = o.workers
+	uploader.Retries = o.retries
+	if !o.quiet {
+		bar := newProgressBar(os.Stderr)
+		uploader.OnProgress = bar.update
+	}
+	return uploader
+}
+
+func parse(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", fmt.Errorf("expect exactly one argument")
+	}
+	return fs.Arg(0), nil
+}
+
+func runUpload(ctx context.Context, args []string) error {
+	var (
+		o            options
+		resourceType int
+		publish      bool
+		statePath    string
+	)
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	o.bind(fs)
+	o.bindPublish(fs)
+	fs.IntVar(&resourceType, "type", 0, "resource type")
+	fs.BoolVar(&publish, "publish", false, "publish after upload done")
+	fs.StringVar(&statePath, "state", "", "resume state file, default <file>"+stateSuffix)
+	path, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if resourceType <= 0 {
+		return fmt.Errorf("-type required")
+	}
+	if statePath == "" {
+		statePath = path + stateSuffix
+	}
+	service, err := o.service("")
+	if err != nil {
+		return err
+	}
+	state := &resumeState{Server: service.BaseURL}
+	uploader := o.uploader(service)
+	uploader.OnStart = func(session *client.Session) {
+		state.Session = session
+		if err := state.save(statePath); err != nil {
+			fmt.Fprintf(os.Stderr, "save state '%s' fail[%s]\n", statePath, err.Error())
+		}
+	}
+	doneResp, err := uploader.Upload(ctx, path, int32(resourceType))
+	if err != nil {
+		if state.Session != nil {
+			fmt.Fprintf(os.Stderr, "\nrun 'multiupload resume %s' to continue\n", statePath)
+		}
+		return err
+	}
+	return done(ctx, &o, service, state, statePath, doneResp, publish || o.unzip)
+}
+
+func runResume(ctx context.Context, args []string) error {
+	var (
+		o       options
+		publish bool
+	)
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	o.bind(fs)
+	o.bindPublish(fs)
+	fs.BoolVar(&publish, "publish", false, "publish after upload done")
+	statePath, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+	if state.DownloadPath != "" {
+		fmt.Printf("upload '%s' already done: %s\n", state.Session.UploadId, state.DownloadPath)
+		return nil
+	}
+	service, err := o.service(state.Server)
+	if err != nil {
+		return err
+	}
+	doneResp, err := o.uploader(service).Resume(ctx, state.Session)
+	if err != nil {
+		return err
+	}
+	return done(ctx, &o, service, state, statePath, doneResp, publish || o.unzip)
+}
+
+func runStatus(ctx context.Context, args []string) error {
+	var o options
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	o.bind(fs)
+	statePath, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+	session := state.Session
+	fmt.Printf("upload_id:     %s\n", session.UploadId)
+	fmt.Printf("file:          %s\n", session.Path)
+	fmt.Printf("size:          %s\n", humanSize(session.Size))
+	fmt.Printf("chunk_size:    %s\n", humanSize(session.ChunkSize))
+	fmt.Printf("started_at:    %s\n", state.StartedAt.Format(time.RFC3339))
+	if state.DownloadPath != "" {
+		fmt.Printf("download_path: %s\n", state.DownloadPath)
+		if state.PublishedPath != "" {
+			fmt.Printf("published:     %s\n", state.PublishedPath)
+		}
+		return nil
+	}
+	service, err := o.service(state.Server)
+	if err != nil {
+		return err
+	}
+	chunks, err := service.Chunks(ctx, session.UploadId)
+	if err != nil {
+		// 一个分片都没有上传时服务端同样返回错误
+		fmt.Printf("chunks:        0/%d (%s)\n", session.Chunks, err.Error())
+		return nil
+	}
+	fmt.Printf("chunks:        %d/%d\n", len(chunks), session.Chunks)
+	return nil
+}
+
+func runAbort(ctx context.Context, args []string) error {
+	var o options
+	fs := flag.NewFlagSet("abort", flag.ExitOnError)
+	o.bind(fs)
+	statePath, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+	service, err := o.service(state.Server)
+	if err != nil {
+		return err
+	}
+	if err := service.Abort(ctx, state.Session.UploadId); err != nil {
+		return err
+	}
+	fmt.Printf("upload '%s' aborted\n", state.Session.UploadId)
+	return os.Remove(statePath)
+}
+
+func runPublish(ctx context.Context, args []string) error {
+	var o options
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	o.bind(fs)
+	o.bindPublish(fs)
+	statePath, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+	if state.DownloadPath == "" {
+		return fmt.Errorf("upload '%s' not done, run 'multiupload resume %s' first", state.Session.UploadId, statePath)
+	}
+	service, err := o.service(state.Server)
+	if err != nil {
+		return err
+	}
+	return publish(ctx, &o, service, state, statePath)
+}
+
+// done 上传完成后保存状态, 需要时发布
+func done(ctx context.Context, o *options, service *client.HTTPService, state *resumeState, statePath string, doneResp *client.DoneResponse, needPublish bool) error {
+	state.DownloadPath = doneResp.DownloadPath
+	if err := state.save(statePath); err != nil {
+		return err
+	}
+	fmt.Printf("upload '%s' done: %s (valid for %s)\n", doneResp.UploadId, doneResp.DownloadPath, doneResp.Validity)
+	if !needPublish {
+		return nil
+	}
+	return publish(ctx, o, service, state, statePath)
+}
+
+func publish(ctx context.Context, o *options, service *client.HTTPService, state *resumeState, statePath string) error {
+	resp, err := service.Publish(ctx, &client.PublishRequest{
+		Type:         state.Session.Type,
+		DownloadPath: state.DownloadPath,
+		Unzip:        o.unzip,
+		UnzipPath:    o.unzipPath,
+	})
+	if err != nil {
+		return err
+	}
+	state.PublishedPath = resp.Path
+	if o.unzip && resp.Path == "" {
+		state.PublishedPath = "unzipped"
+	}
+	fmt.Printf("published: %s\n", state.PublishedPath)
+	return state.save(statePath)
+}
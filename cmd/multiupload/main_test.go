@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"api_mgr/upload"
+	"api_mgr/upload/client"
+	"api_mgr/upload/uploadtest"
+)
+
+func TestResumeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.zip"+stateSuffix)
+	state := &resumeState{Server: "http://127.0.0.1:8080", Session: &client.Session{UploadId: "u1", Type: 13, Chunks: 2}}
+	if err := state.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Server != state.Server || loaded.Session.UploadId != "u1" || loaded.StartedAt.IsZero() {
+		t.Fatalf("unexpected state %+v", loaded)
+	}
+	if err := os.WriteFile(path, []byte(`{"session": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(path); err == nil || !strings.Contains(err.Error(), "upload_id not found") {
+		t.Fatalf("want invalid state, got %v", err)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	if at, err := parseTime(""); err != nil || !at.IsZero() {
+		t.Fatalf("empty time %s[%v]", at, err)
+	}
+	if at, err := parseTime("-1h"); err != nil || time.Since(at) < 59*time.Minute {
+		t.Fatalf("relative time %s[%v]", at, err)
+	}
+	if at, err := parseTime("2024-01-02T03:04:05Z"); err != nil || at.Unix() != 1704164645 {
+		t.Fatalf("rfc3339 time %s[%v]", at, err)
+	}
+	if _, err := parseTime("tomorrow"); err == nil {
+		t.Fatal("invalid time accepted")
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for size, want := range map[int64]string{100: "100B", 1536: "1.5KB", 5 << 20: "5.0MB", 3 << 30: "3.0GB"} {
+		if got := humanSize(size); got != want {
+			t.Fatalf("humanSize(%d) = %s, want %s", size, got, want)
+		}
+	}
+}
+
+func TestRunPublish(t *testing.T) {
+	h := uploadtest.New(t)
+	publisher, err := upload.NewPublishServerWithOptions(h.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(publisher)
+	defer server.Close()
+	downloadPath, err := h.Storage(upload.RT_ACTIVITY_EVENT).Upload(context.Background(),
+		uploadtest.ZipFileHeader(t, "a.zip", map[string][]byte{"index.json": []byte("{}")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statePath := filepath.Join(t.TempDir(), "a.zip"+stateSuffix)
+	state := &resumeState{
+		Server:  server.URL,
+		Session: &client.Session{UploadId: "u1", Type: int32(upload.RT_ACTIVITY_EVENT)},
+	}
+	if err := state.save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	// 没有完成的上传不能发布
+	if err := runPublish(context.Background(), []string{statePath}); err == nil || !strings.Contains(err.Error(), "not done") {
+		t.Fatalf("want not done, got %v", err)
+	}
+
+	state.DownloadPath = downloadPath
+	if err := state.save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPublish(context.Background(), []string{"-unzip", "-unzip-path", "v1", statePath}); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = loadState(statePath); err != nil || state.PublishedPath != "/activity/v1" {
+		t.Fatalf("unexpected published state %+v[%v]", state, err)
+	}
+	if _, err := os.Stat(h.CdnPath("activity", "v1", "index.json")); err != nil {
+		t.Fatalf("unzipped file not found[%v]", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"api_mgr/upload/client"
+)
+
+const barWidth = 30
+
+// progressBar 单行进度条
+type progressBar struct {
+	out     io.Writer
+	started time.Time
+	last    time.Time
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{out: out, started: time.Now()}
+}
+
+func (b *progressBar) update(p client.Progress) {
+	now := time.Now()
+	finished := p.UploadedChunks >= p.Chunks
+	// 限制刷新频率
+	if !finished && now.Sub(b.last) < 200*time.Millisecond {
+		return
+	}
+	b.last = now
+	percent := 1.0
+	if p.Size > 0 {
+		percent = float64(p.Uploaded) / float64(p.Size)
+	}
+	filled := int(percent * barWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	speed := float64(p.Uploaded) / now.Sub(b.started).Seconds()
+	fmt.Fprintf(b.out, "\r[%s] %5.1f%% %d/%d chunks %s/%s %s/s ",
+		bar, percent*100, p.UploadedChunks, p.Chunks, humanSize(p.Uploaded), humanSize(p.Size), humanSize(int64(speed)))
+	if finished {
+		fmt.Fprintln(b.out)
+	}
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
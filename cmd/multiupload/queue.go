@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"api_mgr/upload/client"
+)
+
+const queueUsage = `usage: multiupload queue <command> [flags] [job_id]
+
+commands:
+  stats       队列长度, 最早执行时间和延迟
+  list        按路径前缀和执行时间查询任务
+  cancel      取消任务
+  reschedule  修改任务执行时间
+  run         立即执行任务
+  orphans     查找暂存目录中没有引用的文件, -delete 时删除
+`
+
+func runQueue(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, queueUsage)
+		return fmt.Errorf("queue command required")
+	}
+	var o options
+	fs := flag.NewFlagSet("queue "+args[0], flag.ExitOnError)
+	o.bind(fs)
+	switch args[0] {
+	case "stats":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		service, err := o.service("")
+		if err != nil {
+			return err
+		}
+		return queueStats(ctx, service)
+	case "list":
+		var (
+			filter   client.DelayJobFilter
+			from, to string
+		)
+		fs.StringVar(&filter.Host, "host", "", "only list jobs on host")
+		fs.StringVar(&filter.Prefix, "prefix", "", "job id or path prefix")
+		fs.StringVar(&from, "from", "", "due time from, RFC3339 or duration relative to now such as -1h")
+		fs.StringVar(&to, "to", "", "due time to, RFC3339 or duration relative to now such as 10m")
+		fs.Int64Var(&filter.Limit, "limit", 100, "max jobs")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		var err error
+		if filter.From, err = parseTime(from); err != nil {
+			return err
+		}
+		if filter.To, err = parseTime(to); err != nil {
+			return err
+		}
+		service, err := o.service("")
+		if err != nil {
+			return err
+		}
+		return queueList(ctx, service, &filter)
+	case "cancel", "run":
+		id, err := parse(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		service, err := o.service("")
+		if err != nil {
+			return err
+		}
+		if args[0] == "cancel" {
+			err = service.CancelDelayJob(ctx, id)
+		} else {
+			err = service.RunDelayJob(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("job '%s' %s\n", id, map[string]string{"cancel": "canceled", "run": "scheduled to run now"}[args[0]])
+		return nil
+	case "reschedule":
+		var at string
+		fs.StringVar(&at, "at", "", "new due time, RFC3339 or duration relative to now such as 30m")
+		id, err := parse(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		dueAt, err := parseTime(at)
+		if err != nil {
+			return err
+		}
+		if dueAt.IsZero() {
+			return fmt.Errorf("-at required")
+		}
+		service, err := o.service("")
+		if err != nil {
+			return err
+		}
+		if err := service.RescheduleDelayJob(ctx, id, dueAt); err != nil {
+			return err
+		}
+		fmt.Printf("job '%s' rescheduled to %s\n", id, dueAt.Format(time.RFC3339))
+		return nil
+	case "orphans":
+		var remove bool
+		fs.BoolVar(&remove, "delete", false, "delete orphaned files, default only report")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		service, err := o.service("")
+		if err != nil {
+			return err
+		}
+		return queueOrphans(ctx, service, !remove)
+	default:
+		fmt.Fprint(os.Stderr, queueUsage)
+		return fmt.Errorf("unknown queue command '%s'", args[0])
+	}
+}
+
+func queueStats(ctx context.Context, service *client.HTTPService) error {
+	stats, err := service.DelayJobStats(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tQUEUED\tPROCESSING\tOLDEST_DUE\tLAG")
+	for _, queue := range stats.Queues {
+		oldest := "-"
+		if queue.OldestDue > 0 {
+			oldest = time.Unix(queue.OldestDue, 0).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", queue.Host, queue.Queued, queue.Processing, oldest,
+			time.Duration(queue.LagSeconds)*time.Second)
+	}
+	w.Flush()
+	fmt.Printf("dead letters: %d\n", stats.DeadLetters)
+	return nil
+}
+
+func queueList(ctx context.Context, service *client.HTTPService, filter *client.DelayJobFilter) error {
+	entries, err := service.DelayJobs(ctx, filter)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tDUE_AT\tSTATE\tTYPE\tID")
+	for _, entry := range entries {
+		state := "queued"
+		if entry.Processing {
+			state = "processing"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.Host, time.Unix(entry.DueAt, 0).Format(time.RFC3339),
+			state, entry.Job.Type, entry.Job.ID)
+	}
+	return w.Flush()
+}
+
+func queueOrphans(ctx context.Context, service *client.HTTPService, dryRun bool) error {
+	report, err := service.SweepOrphans(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+	for _, file := range report.Files {
+		fmt.Println(file)
+	}
+	if int64(len(report.Files)) < report.Orphaned {
+		fmt.Printf("... %d more\n", report.Orphaned-int64(len(report.Files)))
+	}
+	fmt.Printf("scanned %d, recent %d, referenced %d, orphaned %d (%s), deleted %d, errors %d in %s\n",
+		report.Scanned, report.Recent, report.Referenced, report.Orphaned, humanSize(report.OrphanedBytes),
+		report.Deleted, report.Errors, report.Duration)
+	if report.DryRun && report.Orphaned > 0 {
+		fmt.Println("dry run, run with -delete to delete orphaned files")
+	}
+	return nil
+}
+
+// parseTime 支持RFC3339和相对当前时间的duration
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(duration), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', want RFC3339 or duration", value)
+	}
+	return t, nil
+}
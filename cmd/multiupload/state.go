@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"api_mgr/upload/client"
+)
+
+const stateSuffix = ".multiupload.json"
+
+// resumeState 本地续传状态
+type resumeState struct {
+	Server    string          `json:"server"`
+	Session   *client.Session `json:"session"`
+	StartedAt time.Time       `json:"started_at"`
+	// Done返回的下载路径, 不为空表示上传完成
+	DownloadPath  string `json:"download_path,omitempty"`
+	PublishedPath string `json:"published_path,omitempty"`
+}
+
+func loadState(path string) (*resumeState, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s resumeState
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, fmt.Errorf("invalid state file '%s' [%s]", path, err.Error())
+	}
+	if s.Session == nil || s.Session.UploadId == "" {
+		return nil, fmt.Errorf("invalid state file '%s', upload_id not found", path)
+	}
+	return &s, nil
+}
+
+// save 先写临时文件再重命名, 避免中断时留下不完整的状态文件
+func (s *resumeState) save(path string) error {
+	if s.StartedAt.IsZero() {
+		s.StartedAt = time.Now()
+	}
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
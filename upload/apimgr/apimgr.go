@@ -0,0 +1,219 @@
+// Package apimgr api_mgr使用的upload包入口, 从api_mgr的全局配置创建 upload.Options
+// upload包不依赖api_mgr, 只有这里使用configs, configmanager和log
+package apimgr
+
+import (
+	"api_mgr/configs"
+	"api_mgr/upload"
+	"context"
+	"sync"
+	"time"
+
+	"git.yj.live/Golang/source/configmanager"
+	"git.yj.live/Golang/source/log"
+)
+
+type globalConfig struct{}
+
+func (globalConfig) GetString(key string, defaultValue string) string {
+	return configmanager.GetString(key, defaultValue)
+}
+
+func (globalConfig) GetInt64(key string, defaultValue int64) int64 {
+	return configmanager.GetInt64(key, defaultValue)
+}
+
+func (globalConfig) GetBool(key string, defaultValue bool) bool {
+	return configmanager.GetBool(key, defaultValue)
+}
+
+// keyedConfig 可以列出所有配置项, LoadSettings 检查拼写错误的配置项
+type keyedConfig struct {
+	globalConfig
+	keys func() []string
+}
+
+func (c keyedConfig) Keys() []string {
+	return c.keys()
+}
+
+var (
+	configKeysMu sync.RWMutex
+	configKeys   func() []string
+)
+
+// SetConfigKeys 设置列出全局配置项的方法, 在 InitSettings 前调用
+// configmanager没有列出配置项的接口, 需要由加载配置的地方提供
+func SetConfigKeys(keys func() []string) {
+	configKeysMu.Lock()
+	defer configKeysMu.Unlock()
+	configKeys = keys
+}
+
+// settingsConfig 设置了 SetConfigKeys 时可以检查拼写错误的配置项
+func settingsConfig() upload.Config {
+	configKeysMu.RLock()
+	defer configKeysMu.RUnlock()
+	if configKeys == nil {
+		return globalConfig{}
+	}
+	return keyedConfig{keys: configKeys}
+}
+
+var (
+	registerConfigTypes    sync.Once
+	registerConfigTypesErr error
+	sharedSettingsOnce     sync.Once
+	sharedSettings         *upload.SettingsStore
+	sharedSettingsErr      error
+	watchSettings          sync.Once
+	sharedDelayJobMu       sync.Mutex
+	sharedDelayJob         *upload.StorageDelayJob
+)
+
+// InitSettings 启动时调用, 校验全局配置并在ctx取消前定期重新读取
+// upload.config.reload_interval 为重新读取间隔, 默认1m
+// 配置不合法时返回错误, 运行中修改的配置不合法时继续使用之前的配置
+// 配置只在第一次使用时读取, SetConfigKeys 需要在 InitSettings 和 DefaultOptions 之前调用
+// 没有调用 SetConfigKeys 时无法检查拼写错误的配置项, 启动时记录错误日志
+func InitSettings(ctx context.Context) error {
+	if _, ok := settingsConfig().(upload.ConfigKeys); !ok {
+		log.L().Errorf("upload config keys not available, unknown config keys are not checked, call apimgr.SetConfigKeys before InitSettings")
+	}
+	store, err := settingsStore()
+	if err != nil {
+		return err
+	}
+	interval, err := time.ParseDuration(configmanager.GetString("upload.config.reload_interval", "1m"))
+	if err != nil || interval <= 0 {
+		interval = time.Minute
+	}
+	watchSettings.Do(func() {
+		go store.Watch(ctx, interval, log.L())
+	})
+	return nil
+}
+
+// settingsStore 所有Options共用的配置, 只读取一次, 之后由 InitSettings 启动的Watch重新读取
+func settingsStore() (*upload.SettingsStore, error) {
+	sharedSettingsOnce.Do(func() {
+		if sharedSettingsErr = registerResourceTypesFromConfig(); sharedSettingsErr != nil {
+			return
+		}
+		sharedSettings, sharedSettingsErr = upload.NewSettingsStore(settingsConfig(), upload.DefaultResourceTypes)
+	})
+	return sharedSettings, sharedSettingsErr
+}
+
+// registerResourceTypesFromConfig upload.resource_types 中的资源类型只注册一次
+func registerResourceTypesFromConfig() error {
+	registerConfigTypes.Do(func() {
+		if data := configmanager.GetString("upload.resource_types", ""); data != "" {
+			if err := upload.DefaultResourceTypes.RegisterJSON([]byte(data)); err != nil {
+				log.L().Errorf("register resource types from config fail[%s]", err.Error())
+				registerConfigTypesErr = err
+			}
+		}
+	})
+	return registerConfigTypesErr
+}
+
+// storageDelayJob 所有Storage共用一个延迟任务
+// redis未初始化等原因创建失败时不保存, 下次调用重新创建
+func storageDelayJob(opts *upload.Options) (*upload.StorageDelayJob, error) {
+	sharedDelayJobMu.Lock()
+	defer sharedDelayJobMu.Unlock()
+	if sharedDelayJob == nil {
+		delayJob, err := upload.NewStorageDelayJobWithOptions(opts)
+		if err != nil {
+			return nil, err
+		}
+		sharedDelayJob = delayJob
+	}
+	return sharedDelayJob, nil
+}
+
+// baseOptions 从全局配置创建, 不包含共用的配置和延迟任务
+func baseOptions() *upload.Options {
+	opts := &upload.Options{
+		UploadPath:   configs.Config.Upload.UploadPath,
+		RootPath:     configs.Config.Upload.RootPath,
+		DownloadPath: configs.Config.Upload.DownloadPath,
+		Hostname:     configmanager.GetString("hostname", "1"),
+		Config:       settingsConfig(),
+		Logger:       log.L(),
+	}
+	// 多个租户共用redis和磁盘时开启, 开启前的数据不会迁移
+	if configmanager.GetBool("storage.namespace.enabled", false) {
+		opts.Namespace = upload.Namespace{
+			Tenant: configmanager.GetString("service.metadata.tenant_name", "platform"),
+			Env:    configmanager.GetString("storage.namespace.env", ""),
+		}
+	}
+	// 避免nil指针转为非nil接口
+	if configs.RedisCli != nil {
+		opts.Redis = configs.RedisCli
+	}
+	return opts
+}
+
+// DefaultOptions 使用api_mgr的全局配置, 所有Options共用配置和延迟任务
+// 配置不合法或者延迟任务创建失败时对应字段为空, 由 upload 包的构造函数返回错误
+func DefaultOptions() *upload.Options {
+	opts := baseOptions()
+	store, err := settingsStore()
+	if err != nil {
+		return opts
+	}
+	opts.Settings = store
+	if delayJob, err := storageDelayJob(opts); err == nil {
+		opts.DelayJob = delayJob
+	}
+	return opts
+}
+
+// NewStorage 普通上传
+func NewStorage(resourceType upload.ResourceType, resourceId string) (*upload.Storage, error) {
+	return upload.NewStorageWithOptions(resourceType, resourceId, DefaultOptions())
+}
+
+// NewMultipartStorage 分片上传
+func NewMultipartStorage(resourceType upload.ResourceType, resourceId string) (*upload.MultipartStorage, error) {
+	return upload.NewMultipartStorageWithOptions(resourceType, resourceId, DefaultOptions())
+}
+
+// NewStorageDelayJob 存储延迟任务, 与 NewStorage 等共用同一个
+func NewStorageDelayJob() (*upload.StorageDelayJob, error) {
+	opts := baseOptions()
+	store, err := settingsStore()
+	if err != nil {
+		return nil, err
+	}
+	opts.Settings = store
+	return storageDelayJob(opts)
+}
+
+// NewPeerServer 暂存文件服务
+func NewPeerServer() *upload.PeerServer {
+	return upload.NewPeerServerWithOptions(DefaultOptions())
+}
+
+// NewPeerClient 从其他节点拉取暂存文件
+func NewPeerClient() *upload.PeerClient {
+	return upload.NewPeerClientWithOptions(DefaultOptions())
+}
+
+// NewPublishServer 发布已上传文件的http接口, 挂载到 upload.PUBLISH_PATH
+func NewPublishServer() (*upload.PublishServer, error) {
+	return upload.NewPublishServerWithOptions(DefaultOptions())
+}
+
+// GetUsage 当前租户的用量
+func GetUsage(ctx context.Context) (*upload.UsageReport, error) {
+	return upload.GetUsageWithOptions(ctx, DefaultOptions())
+}
+
+// CdnFilePath 返回不同业务cdn存放的目录
+func CdnFilePath(resourceType upload.ResourceType) (string, error) {
+	return upload.CdnFilePathWithOptions(resourceType, DefaultOptions())
+}
@@ -0,0 +1,307 @@
+// Package client 分片上传客户端
+// 将大文件按服务端返回的分片计划拆分, 并发上传, 支持失败重试和断点续传
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Session 分片上传会话, 保存下来可用于断点续传
+type Session struct {
+	UploadId  string `json:"upload_id"`
+	Path      string `json:"path"`
+	Type      int32  `json:"type"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Chunks    int32  `json:"chunks"`
+}
+
+// Progress 上传进度
+type Progress struct {
+	UploadId string
+	// 文件总大小
+	Size int64
+	// 已上传大小
+	Uploaded int64
+	Chunks   int32
+	// 已上传分片数量
+	UploadedChunks int32
+}
+
+// Uploader 分片上传
+type Uploader struct {
+	Service Service
+	// 并发上传的分片数量
+	Workers int
+	// 单个请求失败后的重试次数
+	Retries int
+	// 首次重试间隔, 之后每次翻倍, 不超过MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// OnStart 准备完成后回调, 可以在此保存会话
+	OnStart func(*Session)
+	// OnProgress 每个分片上传完成后回调, 不会并发调用
+	OnProgress func(Progress)
+}
+
+// NewUploader .
+func NewUploader(service Service) *Uploader {
+	return &Uploader{
+		Service:    service,
+		Workers:    4,
+		Retries:    3,
+		Backoff:    500 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+	}
+}
+
+// Upload 上传文件
+func (u *Uploader) Upload(ctx context.Context, path string, resourceType int32) (*DoneResponse, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var startResp *StartResponse
+	if err := u.retry(ctx, func() error {
+		var err error
+		startResp, err = u.Service.Start(ctx, &StartRequest{
+			Type:     resourceType,
+			Filename: filepath.Base(path),
+			Size:     stat.Size(),
+		})
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("start upload '%s' fail[%s]", path, err.Error())
+	}
+	session := &Session{
+		UploadId:  startResp.UploadId,
+		Path:      path,
+		Type:      resourceType,
+		Size:      stat.Size(),
+		ChunkSize: startResp.ChunkSize,
+		Chunks:    startResp.Chunks,
+	}
+	if u.OnStart != nil {
+		u.OnStart(session)
+	}
+	return u.upload(ctx, session, nil)
+}
+
+// Resume 断点续传
+// 从服务端获取已上传的分片, 只上传缺失或内容不一致的分片, 然后合并
+func (u *Uploader) Resume(ctx context.Context, session *Session) (*DoneResponse, error) {
+	stat, err := os.Stat(session.Path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() != session.Size {
+		return nil, fmt.Errorf("file '%s' size changed, current %d, want %d", session.Path, stat.Size(), session.Size)
+	}
+	// 一个分片都没有上传时服务端会返回错误, 此时全部重新上传
+	// 如果上传已过期, 上传分片时会返回错误
+	var chunks []*ChunkInfo
+	u.retry(ctx, func() error {
+		var err error
+		chunks, err = u.Service.Chunks(ctx, session.UploadId)
+		return err
+	})
+	return u.upload(ctx, session, chunks)
+}
+
+func (u *Uploader) upload(ctx context.Context, session *Session, uploaded []*ChunkInfo) (*DoneResponse, error) {
+	if session.ChunkSize <= 0 || session.Chunks <= 0 {
+		return nil, fmt.Errorf("invalid chunk plan, chunk size %d, chunks %d", session.ChunkSize, session.Chunks)
+	}
+	file, err := os.Open(session.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	progress := &progressReporter{
+		callback: u.OnProgress,
+		progress: Progress{UploadId: session.UploadId, Size: session.Size, Chunks: session.Chunks},
+	}
+	skip := make(map[int32]bool, len(uploaded))
+	for _, chunk := range uploaded {
+		if chunk.Chunk < 1 || chunk.Chunk > session.Chunks {
+			continue
+		}
+		section := chunkReader(file, session, chunk.Chunk)
+		contentMD5, err := md5sum(section)
+		if err != nil {
+			return nil, err
+		}
+		if contentMD5 == chunk.ContentMd5 {
+			skip[chunk.Chunk] = true
+			progress.add(section.Size())
+		}
+	}
+	progress.report()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		jobs     = make(chan int32)
+	)
+	workers := u.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range jobs {
+				if err := u.uploadChunk(ctx, file, session, chunk, progress); err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("upload chunk %d fail[%s]", chunk, err.Error())
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for chunk := int32(1); chunk <= session.Chunks; chunk++ {
+		if skip[chunk] {
+			continue
+		}
+		select {
+		case jobs <- chunk:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var doneResp *DoneResponse
+	if err := u.retry(ctx, func() error {
+		var err error
+		doneResp, err = u.Service.Done(ctx, session.UploadId)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("done upload '%s' fail[%s]", session.UploadId, err.Error())
+	}
+	return doneResp, nil
+}
+
+func (u *Uploader) uploadChunk(ctx context.Context, file *os.File, session *Session, chunk int32, progress *progressReporter) error {
+	section := chunkReader(file, session, chunk)
+	contentMD5, err := md5sum(section)
+	if err != nil {
+		return err
+	}
+	if err := u.retry(ctx, func() error {
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := u.Service.UploadChunk(ctx, session.UploadId, chunk, contentMD5, section.Size(), section)
+		return err
+	}); err != nil {
+		return err
+	}
+	progress.add(section.Size())
+	progress.report()
+	return nil
+}
+
+// retry 失败后按指数退避重试
+func (u *Uploader) retry(ctx context.Context, fn func() error) error {
+	backoff := u.Backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= u.Retries || !retryable(ctx, err) {
+			return err
+		}
+		// 加入随机抖动, 避免并发请求同时重试
+		wait := backoff
+		if wait > 0 {
+			wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if u.MaxBackoff > 0 && backoff > u.MaxBackoff {
+			backoff = u.MaxBackoff
+		}
+	}
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	return true
+}
+
+func chunkReader(file *os.File, session *Session, chunk int32) *io.SectionReader {
+	offset := session.ChunkSize * int64(chunk-1)
+	size := session.ChunkSize
+	if offset+size > session.Size {
+		size = session.Size - offset
+	}
+	return io.NewSectionReader(file, offset, size)
+}
+
+func md5sum(section *io.SectionReader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(section, 0, section.Size())); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type progressReporter struct {
+	mu       sync.Mutex
+	callback func(Progress)
+	progress Progress
+}
+
+func (p *progressReporter) add(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.progress.Uploaded += size
+	p.progress.UploadedChunks++
+}
+
+func (p *progressReporter) report() {
+	if p.callback == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.callback(p.progress)
+}
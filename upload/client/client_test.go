@@ -0,0 +1,106 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeService 内存中的服务端, 每个分片第一次上传失败
+type fakeService struct {
+	mu        sync.Mutex
+	chunkSize int64
+	chunks    map[int32][]byte
+	failed    map[int32]bool
+	uploads   int
+}
+
+func (f *fakeService) Start(ctx context.Context, req *StartRequest) (*StartResponse, error) {
+	return &StartResponse{
+		UploadId:  "upload",
+		Size:      req.Size,
+		ChunkSize: f.chunkSize,
+		Chunks:    int32((req.Size + f.chunkSize - 1) / f.chunkSize),
+	}, nil
+}
+
+func (f *fakeService) UploadChunk(ctx context.Context, uploadId string, chunk int32, contentMD5 string, size int64, data io.Reader) (*ChunkInfo, error) {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploads++
+	if !f.failed[chunk] {
+		f.failed[chunk] = true
+		return nil, errors.New("connection reset")
+	}
+	f.chunks[chunk] = content
+	return &ChunkInfo{UploadId: uploadId, Chunk: chunk, ContentMd5: contentMD5}, nil
+}
+
+func (f *fakeService) Chunks(ctx context.Context, uploadId string) ([]*ChunkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var chunks []*ChunkInfo
+	for chunk, content := range f.chunks {
+		sum := md5.Sum(content)
+		chunks = append(chunks, &ChunkInfo{UploadId: uploadId, Chunk: chunk, ContentMd5: hex.EncodeToString(sum[:])})
+	}
+	return chunks, nil
+}
+
+func (f *fakeService) Done(ctx context.Context, uploadId string) (*DoneResponse, error) {
+	return &DoneResponse{UploadId: uploadId}, nil
+}
+
+func (f *fakeService) merged() []byte {
+	var merged []byte
+	for chunk := int32(1); f.chunks[chunk] != nil; chunk++ {
+		merged = append(merged, f.chunks[chunk]...)
+	}
+	return merged
+}
+
+func TestUploaderResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 105)
+	path := filepath.Join(t.TempDir(), "package.zip")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	service := &fakeService{chunkSize: 100, chunks: map[int32][]byte{}, failed: map[int32]bool{}}
+	uploader := NewUploader(service)
+	uploader.Backoff = 0
+
+	var session *Session
+	uploader.OnStart = func(s *Session) { session = s }
+	var last Progress
+	uploader.OnProgress = func(p Progress) { last = p }
+	if _, err := uploader.Upload(context.Background(), path, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(service.merged(), content) {
+		t.Fatal("merged content not equal")
+	}
+	if last.Uploaded != int64(len(content)) || last.UploadedChunks != 11 {
+		t.Fatalf("unexpected progress %+v", last)
+	}
+
+	// 续传时已上传的分片不再上传
+	delete(service.chunks, 3)
+	service.uploads = 0
+	if _, err := uploader.Resume(context.Background(), session); err != nil {
+		t.Fatal(err)
+	}
+	if service.uploads != 1 || !bytes.Equal(service.merged(), content) {
+		t.Fatalf("resume uploaded %d chunks", service.uploads)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DelayJobQueueStats 单个节点的延迟任务队列统计
+type DelayJobQueueStats struct {
+	Host       string `json:"host"`
+	Queued     int64  `json:"queued"`
+	Processing int64  `json:"processing"`
+	OldestDue  int64  `json:"oldest_due"`
+	LagSeconds int64  `json:"lag_seconds"`
+}
+
+// DelayJobStats 延迟任务队列统计
+type DelayJobStats struct {
+	Queues      []*DelayJobQueueStats `json:"queues"`
+	DeadLetters int64                 `json:"dead_letters"`
+}
+
+// DelayJob 延迟任务
+type DelayJob struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// DelayJobEntry 队列中的延迟任务
+type DelayJobEntry struct {
+	Host       string    `json:"host"`
+	Job        *DelayJob `json:"job"`
+	DueAt      int64     `json:"due_at"`
+	Processing bool      `json:"processing"`
+}
+
+// DelayJobFilter 延迟任务查询条件
+type DelayJobFilter struct {
+	Host   string
+	Prefix string
+	From   time.Time
+	To     time.Time
+	Limit  int64
+}
+
+// DelayJobStats 延迟任务队列统计
+func (h *HTTPService) DelayJobStats(ctx context.Context) (*DelayJobStats, error) {
+	var stats DelayJobStats
+	if err := h.get(ctx, h.Paths.DelayJob+"/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// DelayJobs 查询延迟任务
+func (h *HTTPService) DelayJobs(ctx context.Context, filter *DelayJobFilter) ([]*DelayJobEntry, error) {
+	query := url.Values{}
+	if filter.Host != "" {
+		query.Set("host", filter.Host)
+	}
+	if filter.Prefix != "" {
+		query.Set("prefix", filter.Prefix)
+	}
+	if !filter.From.IsZero() {
+		query.Set("from", strconv.FormatInt(filter.From.Unix(), 10))
+	}
+	if !filter.To.IsZero() {
+		query.Set("to", strconv.FormatInt(filter.To.Unix(), 10))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.FormatInt(filter.Limit, 10))
+	}
+	var resp struct {
+		Data []*DelayJobEntry `json:"data"`
+	}
+	if err := h.get(ctx, h.Paths.DelayJob+"/jobs", query, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// CancelDelayJob 取消延迟任务
+func (h *HTTPService) CancelDelayJob(ctx context.Context, id string) error {
+	var resp struct{}
+	return h.doJSON(ctx, h.Paths.DelayJob+"/jobs/cancel", map[string]interface{}{"id": id}, &resp)
+}
+
+// RescheduleDelayJob 修改延迟任务执行时间
+func (h *HTTPService) RescheduleDelayJob(ctx context.Context, id string, at time.Time) error {
+	var resp struct{}
+	return h.doJSON(ctx, h.Paths.DelayJob+"/jobs/reschedule", map[string]interface{}{"id": id, "at": at.Unix()}, &resp)
+}
+
+// RunDelayJob 立即执行延迟任务
+func (h *HTTPService) RunDelayJob(ctx context.Context, id string) error {
+	var resp struct{}
+	return h.doJSON(ctx, h.Paths.DelayJob+"/jobs/run", map[string]interface{}{"id": id}, &resp)
+}
+
+// OrphanSweepReport 暂存目录孤儿文件清理结果
+type OrphanSweepReport struct {
+	DryRun        bool     `json:"dry_run"`
+	Dirs          []string `json:"dirs"`
+	Scanned       int64    `json:"scanned"`
+	Recent        int64    `json:"recent"`
+	Referenced    int64    `json:"referenced"`
+	Orphaned      int64    `json:"orphaned"`
+	OrphanedBytes int64    `json:"orphaned_bytes"`
+	Deleted       int64    `json:"deleted"`
+	Errors        int64    `json:"errors"`
+	Files         []string `json:"files"`
+	StartedAt     int64    `json:"started_at"`
+	Duration      string   `json:"duration"`
+}
+
+// SweepOrphans 清理暂存目录中没有引用的文件, dryRun为true时只报告
+func (h *HTTPService) SweepOrphans(ctx context.Context, dryRun bool) (*OrphanSweepReport, error) {
+	var report OrphanSweepReport
+	if err := h.doJSON(ctx, h.Paths.DelayJob+"/orphans/sweep", map[string]interface{}{"dry_run": dryRun}, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
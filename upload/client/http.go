@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Paths 服务端接口路径
+type Paths struct {
+	Start   string
+	Upload  string
+	Chunks  string
+	Done    string
+	Abort   string
+	Publish string
+	// 延迟任务管理接口前缀
+	DelayJob string
+}
+
+// DefaultPaths 分片上传接口由服务的网关提供, Publish 对应 upload.PublishServer, DelayJob 对应 upload.DelayJobAdminServer
+var DefaultPaths = Paths{
+	Start:    "/multipart_upload/start",
+	Upload:   "/multipart_upload/upload",
+	Chunks:   "/multipart_upload/chunks",
+	Done:     "/multipart_upload/done",
+	Abort:    "/multipart_upload/abort",
+	Publish:  "/upload/publish",
+	DelayJob: "/storage/delay_job",
+}
+
+// HTTPService 通过http调用服务端
+type HTTPService struct {
+	// 服务端地址, 例如 http://127.0.0.1:8080
+	BaseURL string
+	Paths   Paths
+	Client  *http.Client
+	// Header 每个请求都会携带, 一般用于鉴权
+	Header http.Header
+	// Decode 解析响应, 为空时直接按json解析
+	Decode func(body []byte, v interface{}) error
+}
+
+// NewHTTPService .
+func NewHTTPService(baseURL string) *HTTPService {
+	return &HTTPService{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Paths:   DefaultPaths,
+		Client:  http.DefaultClient,
+		Header:  http.Header{},
+	}
+}
+
+// Start .
+func (h *HTTPService) Start(ctx context.Context, req *StartRequest) (*StartResponse, error) {
+	var resp StartResponse
+	if err := h.doJSON(ctx, h.Paths.Start, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UploadChunk .
+func (h *HTTPService) UploadChunk(ctx context.Context, uploadId string, chunk int32, contentMD5 string, size int64, data io.Reader) (*ChunkInfo, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	fields := map[string]string{
+		"upload_id":   uploadId,
+		"chunk":       strconv.Itoa(int(chunk)),
+		"content_md5": contentMD5,
+		"size":        strconv.FormatInt(size, 10),
+	}
+	for k, v := range fields {
+		if err := writer.WriteField(k, v); err != nil {
+			return nil, err
+		}
+	}
+	part, err := writer.CreateFormFile("file", fmt.Sprintf("%s_%d.chunk", uploadId, chunk))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.BaseURL+h.Paths.Upload, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	var info ChunkInfo
+	if err := h.do(req, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Chunks .
+func (h *HTTPService) Chunks(ctx context.Context, uploadId string) ([]*ChunkInfo, error) {
+	var resp struct {
+		Data []*ChunkInfo `json:"data"`
+	}
+	if err := h.doJSON(ctx, h.Paths.Chunks, map[string]string{"upload_id": uploadId}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Done .
+func (h *HTTPService) Done(ctx context.Context, uploadId string) (*DoneResponse, error) {
+	var resp DoneResponse
+	if err := h.doJSON(ctx, h.Paths.Done, map[string]string{"upload_id": uploadId}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Abort 取消分片上传
+func (h *HTTPService) Abort(ctx context.Context, uploadId string) error {
+	var resp struct{}
+	return h.doJSON(ctx, h.Paths.Abort, map[string]string{"upload_id": uploadId}, &resp)
+}
+
+// Publish 发布已上传的文件, 解压时调用服务端的解压发布
+func (h *HTTPService) Publish(ctx context.Context, req *PublishRequest) (*PublishResponse, error) {
+	var resp PublishResponse
+	if err := h.doJSON(ctx, h.Paths.Publish, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *HTTPService) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	return h.do(req, out)
+}
+
+func (h *HTTPService) doJSON(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return h.do(req, out)
+}
+
+func (h *HTTPService) do(req *http.Request, out interface{}) error {
+	for k, v := range h.Header {
+		req.Header[k] = v
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	if h.Decode != nil {
+		return h.Decode(body, out)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// StatusError 服务端返回非200
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("http status %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary 5xx和429可以重试
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
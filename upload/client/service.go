@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"io"
+)
+
+// StartRequest 分片上传准备请求
+type StartRequest struct {
+	// 资源类型
+	Type     int32  `json:"type"`
+	Filename string `json:"filename"`
+	// 文件总大小
+	Size int64 `json:"size"`
+}
+
+// StartResponse 分片上传准备结果, 分片大小和分片数量由服务端决定
+type StartResponse struct {
+	UploadId  string `json:"upload_id"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Chunks    int32  `json:"chunks"`
+}
+
+// ChunkInfo 已上传分片
+type ChunkInfo struct {
+	UploadId     string `json:"upload_id"`
+	Chunk        int32  `json:"chunk"`
+	ContentMd5   string `json:"content_md5"`
+	Validity     string `json:"validity"`
+	DownloadPath string `json:"download_path"`
+}
+
+// DoneResponse 分片合并结果
+type DoneResponse struct {
+	UploadId     string `json:"upload_id"`
+	DownloadPath string `json:"download_path"`
+	Validity     string `json:"validity"`
+}
+
+// Service 分片上传服务端接口
+type Service interface {
+	// Start 分片上传准备
+	Start(ctx context.Context, req *StartRequest) (*StartResponse, error)
+	// UploadChunk 上传一个分片, 分片序号从1开始
+	UploadChunk(ctx context.Context, uploadId string, chunk int32, contentMD5 string, size int64, data io.Reader) (*ChunkInfo, error)
+	// Chunks 获取已上传的分片
+	Chunks(ctx context.Context, uploadId string) ([]*ChunkInfo, error)
+	// Done 合并分片
+	Done(ctx context.Context, uploadId string) (*DoneResponse, error)
+}
+
+// PublishRequest 发布已上传的文件
+type PublishRequest struct {
+	// 资源类型
+	Type int32 `json:"type"`
+	// 资源ID, 为空时由服务端生成
+	ResourceId string `json:"resource_id"`
+	// Done返回的下载路径
+	DownloadPath string `json:"download_path"`
+	// 是否解压后发布
+	Unzip bool `json:"unzip"`
+	// 解压到资源目录下的子目录
+	UnzipPath string `json:"unzip_path"`
+}
+
+// PublishResponse 发布结果
+type PublishResponse struct {
+	Path string `json:"path"`
+}
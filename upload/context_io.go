@@ -0,0 +1,50 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// contextReader 每次读取前检查ctx, 拷贝大文件时可以及时停止
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// copyContext ctx取消时停止拷贝并返回ctx.Err()
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, &contextReader{ctx: ctx, r: src})
+}
+
+// writeFileContext 先写入同目录下的临时文件, 完成后重命名为path
+// 失败或ctx取消时只删除临时文件, path已存在时保持不变, 覆盖已发布的cdn文件时不会删除线上文件
+func writeFileContext(ctx context.Context, path string, perm os.FileMode, src io.Reader) (int64, error) {
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+uuid.NewString()+".tmp")
+	dst, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := copyContext(ctx, dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return n, err
+	}
+	return n, nil
+}
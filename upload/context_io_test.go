@@ -0,0 +1,53 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileContextKeepsExisting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.png")
+	if err := os.WriteFile(path, []byte("published"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := writeFileContext(ctx, path, 0666, bytes.NewReader([]byte("new"))); err == nil {
+		t.Fatal("expect canceled error")
+	}
+	// 取消覆盖时保留原文件, 不留下临时文件
+	content, err := os.ReadFile(path)
+	if err != nil || string(content) != "published" {
+		t.Fatalf("published file changed '%s'[%v]", content, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temp file left %v", entries)
+	}
+	if _, err := writeFileContext(context.Background(), path, 0666, bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "new" {
+		t.Fatalf("unexpected content '%s'", content)
+	}
+}
+
+func TestCopyDirError(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a", "b", "c.png"), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 目标中同名的文件导致子目录无法创建
+	if err := os.WriteFile(filepath.Join(dest, "a"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir(context.Background(), src, dest); err == nil {
+		t.Fatal("expect nested copy error")
+	}
+}
@@ -1,78 +1,226 @@
 package upload
 
 import (
-	"api_mgr/configs"
 	"context"
 	"fmt"
-	"os"
+	"sync"
 	"time"
-
-	"git.yj.live/Golang/source/configmanager"
-	"git.yj.live/Golang/source/log"
-	"github.com/go-redis/redis/v8"
 )
 
 // StorageDelayJob 存储延迟任务
+// 暂存文件保存在各节点的本地磁盘, 每个节点只领取自己队列中的任务
 type StorageDelayJob struct {
-	queue string
+	queue DelayQueue
+	opts  *Options
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	// 立即执行一次扫描的请求
+	sweepReq chan chan struct{}
+	// 上次清理孤儿文件的时间, 只在后台任务中使用
+	orphanSweptAt time.Time
 }
 
-// NewStorageDelayJob .
-func NewStorageDelayJob() *StorageDelayJob {
+// NewStorageDelayJobWithOptions opts.DelayQueue为空时按配置选择队列存储, 见 newDelayQueue
+func NewStorageDelayJobWithOptions(opts *Options) (*StorageDelayJob, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Namespace.Validate(); err != nil {
+		return nil, err
+	}
+	queue := opts.DelayQueue
+	if queue == nil {
+		var err error
+		if queue, err = newDelayQueue(opts); err != nil {
+			return nil, err
+		}
+	}
 	return &StorageDelayJob{
-		queue: fmt.Sprintf("%s:%s:%s:storage:delay_job_queue",
-			configmanager.GetString("app", "platform"),
-			configmanager.GetString("api_mgr.service.name", "api_mgr"),
-			configmanager.GetString("service.metadata.tenant_name", "platform")),
-	}
-}
-
-// Start .
-func (s *StorageDelayJob) Start() {
-	go func() {
-		for {
-			now := fmt.Sprintf("%d", time.Now().Unix())
-			pipe := configs.RedisCli.TxPipeline()
-			result := pipe.ZRangeByScore(context.Background(), s.queue, &redis.ZRangeBy{Min: "-1", Max: now})
-			pipe.ZRemRangeByScore(context.Background(), s.queue, "-1", now)
-			if _, err := pipe.Exec(context.Background()); err != nil {
-				log.L().Errorf("fetch delay job '%s' fail[%s]", s.queue, err.Error())
-			} else {
-				for _, filePath := range result.Val() {
-					// 删除文件
-					log.L().Debugf("remove file '%s' by delay job '%s'", filePath, s.queue)
-					if err := os.RemoveAll(filePath); err != nil {
-						log.L().Errorf("remove file '%s' by delay job '%s' fail[%s]", filePath, s.queue, err.Error())
-					}
-				}
-			}
+		queue:    queue,
+		opts:     opts,
+		sweepReq: make(chan chan struct{}),
+	}, nil
+}
 
-			// time.Sleep(100 * time.Millisecond)
-			time.Sleep(30 * time.Second)
+// Start 启动后台扫描, ctx取消或调用Stop后退出
+// 返回的channel在后台任务退出后关闭, 运行中重复调用返回同一个channel
+func (s *StorageDelayJob) Start(ctx context.Context) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done != nil {
+		select {
+		case <-s.done:
+			// 已退出, 重新启动
+		default:
+			return s.done
 		}
-	}()
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go s.run(ctx, s.done)
+	return s.done
 }
 
-func (s *StorageDelayJob) delayDuration() time.Duration {
-	duration, err := time.ParseDuration(configmanager.GetString("storage.delay_delete.duration", "10m"))
-	if err != nil {
-		duration = 10 * time.Minute
+// Stop 停止后台扫描, 等待正在进行的删除完成后返回
+func (s *StorageDelayJob) Stop() {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Sweep 立即执行一次扫描, 扫描完成或ctx取消后返回
+// 后台任务未启动时在当前goroutine执行
+func (s *StorageDelayJob) Sweep(ctx context.Context) error {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done == nil {
+		s.sweep(ctx)
+		return nil
+	}
+	reply := make(chan struct{})
+	select {
+	case s.sweepReq <- reply:
+	case <-done:
+		return fmt.Errorf("delay job '%s' stopped", s.queue.Name())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-reply:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return duration
 }
 
-// Add .
-func (s *StorageDelayJob) Add(filePath string) {
-	log.L().Debugf("add file path '%s' into delay job '%s'", filePath, s.queue)
-	if err := configs.RedisCli.ZAdd(context.Background(), s.queue, &redis.Z{Score: float64(time.Now().Add(s.delayDuration()).Unix()), Member: filePath}).Err(); err != nil {
-		log.L().Errorf("add file path '%s' into delay job '%s' fail[%s]", filePath, s.queue, err.Error())
+func (s *StorageDelayJob) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	wakeup := s.queue.Wakeup(ctx)
+	for {
+		s.queue.Maintain(ctx, s.sweepInterval(), s.batchSize())
+		s.sweep(ctx)
+		s.sweepOrphans(ctx)
+		if reply := s.sleep(ctx, wakeup); reply != nil {
+			s.sweep(ctx)
+			close(reply)
+		}
+		if ctx.Err() != nil {
+			s.opts.Logger.Infof("delay job '%s' stopped", s.queue.Name())
+			return
+		}
+	}
+}
+
+// sweep 分批领取到期任务并发执行, 直到没有到期任务
+// ctx取消后不再领取新的任务, 已领取的任务执行完才返回
+func (s *StorageDelayJob) sweep(ctx context.Context) {
+	batchSize := s.batchSize()
+	for ctx.Err() == nil {
+		jobs, err := s.claim(ctx, batchSize)
+		if err != nil {
+			// 租约到期后会重新领取
+			s.opts.Logger.Errorf("fetch delay job '%s' fail[%s]", s.queue.Name(), err.Error())
+			return
+		}
+		s.runJobs(jobs)
+		if int64(len(jobs)) < batchSize {
+			return
+		}
+	}
+}
+
+// runJobs 并发执行任务
+func (s *StorageDelayJob) runJobs(jobs []*DelayJob) {
+	jobCh := make(chan *DelayJob)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				s.runJob(job)
+			}
+		}()
+	}
+	for _, job := range jobs {
+		jobCh <- job
+	}
+	close(jobCh)
+	wg.Wait()
+}
+
+// runJob 已领取的任务不随Stop取消, 超过租约时间后按失败处理
+func (s *StorageDelayJob) runJob(job *DelayJob) {
+	s.opts.Logger.Debugf("run %s job '%s' by delay job '%s'", job.Type, job.ID, s.queue.Name())
+	handler, ok := delayJobHandler(job.Type)
+	if !ok {
+		s.fail(job, fmt.Errorf("unknown job type '%s'", job.Type))
+		return
+	}
+	ctx, cancel := context.WithTimeout(withOptions(context.Background(), s.opts), s.leaseDuration())
+	defer cancel()
+	if err := handler(ctx, job); err != nil {
+		s.opts.Logger.Errorf("run %s job '%s' by delay job '%s' fail[%s]", job.Type, job.ID, s.queue.Name(), err.Error())
+		s.fail(job, err)
+		return
+	}
+	s.ack(job)
+}
+
+func (s *StorageDelayJob) sweepInterval() time.Duration {
+	return s.opts.settings().DelayJob.Interval
+}
+
+// batchSize 每次最多领取的任务数量
+func (s *StorageDelayJob) batchSize() int64 {
+	return s.opts.settings().DelayJob.BatchSize
+}
+
+// workers 并发删除数量
+func (s *StorageDelayJob) workers() int {
+	return int(s.opts.settings().DelayJob.Workers)
+}
+
+func (s *StorageDelayJob) delayDuration() time.Duration {
+	return s.opts.settings().DelayDeleteDuration
+}
+
+// Add 文件保存在当前节点, 添加到当前节点的队列
+func (s *StorageDelayJob) Add(ctx context.Context, filePath string) {
+	s.AddWithDelay(ctx, filePath, s.delayDuration())
+}
+
+// AddWithDelay delay后删除文件, 资源类型单独设置了保留时间时使用
+func (s *StorageDelayJob) AddWithDelay(ctx context.Context, filePath string, delay time.Duration) {
+	s.opts.Logger.Debugf("add file path '%s' into delay job '%s'", filePath, s.queue.Name())
+	if err := s.AddJob(ctx, NewDeleteFileJob(filePath), s.opts.now().Add(delay)); err != nil {
+		s.opts.Logger.Errorf("add file path '%s' into delay job '%s' fail[%s]", filePath, s.queue.Name(), err.Error())
 	}
 }
 
 // Remove .
-func (s *StorageDelayJob) Remove(filePath string) {
-	log.L().Debugf("remove file '%s' from delay job '%s'", filePath, s.queue)
-	if err := configs.RedisCli.ZRem(context.Background(), s.queue, filePath).Err(); err != nil {
-		log.L().Errorf("remove file '%s' from delay job '%s' fail[%s]", filePath, s.queue, err.Error())
+func (s *StorageDelayJob) Remove(ctx context.Context, filePath string) {
+	s.opts.Logger.Debugf("remove file '%s' from delay job '%s'", filePath, s.queue.Name())
+	if err := s.RemoveJob(ctx, filePath); err != nil {
+		s.opts.Logger.Errorf("remove file '%s' from delay job '%s' fail[%s]", filePath, s.queue.Name(), err.Error())
 	}
 }
+
+// AddJob 添加任务到当前节点的队列, 在at之后执行
+func (s *StorageDelayJob) AddJob(ctx context.Context, job *DelayJob, at time.Time) error {
+	return s.queue.Add(ctx, job, at)
+}
+
+// RemoveJob 从所有节点的队列中删除任务
+func (s *StorageDelayJob) RemoveJob(ctx context.Context, id string) error {
+	return s.queue.Remove(ctx, id)
+}
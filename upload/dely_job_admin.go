@@ -0,0 +1,248 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DelayJobQueueStats 单个节点队列统计
+type DelayJobQueueStats struct {
+	Host       string `json:"host"`
+	Queued     int64  `json:"queued"`
+	Processing int64  `json:"processing"`
+	// 最早的执行时间, 队列为空时为0
+	OldestDue int64 `json:"oldest_due"`
+	// 最早到期任务已延迟的秒数
+	LagSeconds int64 `json:"lag_seconds"`
+}
+
+// DelayJobStats 队列统计
+type DelayJobStats struct {
+	Queues      []*DelayJobQueueStats `json:"queues"`
+	DeadLetters int64                 `json:"dead_letters"`
+}
+
+// DelayJobEntry 队列中的任务
+type DelayJobEntry struct {
+	Host string    `json:"host"`
+	Job  *DelayJob `json:"job"`
+	// 执行时间
+	DueAt int64 `json:"due_at"`
+	// 是否正在执行, 正在执行时DueAt为租约到期时间
+	Processing bool `json:"processing"`
+}
+
+// DelayJobFilter 任务查询条件
+type DelayJobFilter struct {
+	// 为空时查询所有节点
+	Host string
+	// 任务ID或者任务路径前缀
+	Prefix string
+	// 执行时间范围, 为0时不限制
+	From, To time.Time
+	Limit    int64
+}
+
+// Stats 队列长度, 最早执行时间和延迟
+func (s *StorageDelayJob) Stats(ctx context.Context) (*DelayJobStats, error) {
+	return s.queue.Stats(ctx)
+}
+
+// List 按路径前缀和执行时间查询任务
+func (s *StorageDelayJob) List(ctx context.Context, filter *DelayJobFilter) ([]*DelayJobEntry, error) {
+	return s.queue.List(ctx, filter)
+}
+
+// Cancel 取消任务
+func (s *StorageDelayJob) Cancel(ctx context.Context, id string) error {
+	return s.queue.Remove(ctx, id)
+}
+
+// Reschedule 修改任务执行时间, 正在执行的任务不能修改, 返回任务所属节点
+func (s *StorageDelayJob) Reschedule(ctx context.Context, id string, at time.Time) (string, error) {
+	host, err := s.queue.Reschedule(ctx, id, at)
+	if err != nil {
+		return "", err
+	}
+	s.opts.Logger.Infof("reschedule job '%s' on host '%s' to %s", id, host, at.Format(time.RFC3339))
+	return host, nil
+}
+
+// RunNow 立即执行任务, 任务属于当前节点时立即扫描, 否则唤醒所属节点执行
+func (s *StorageDelayJob) RunNow(ctx context.Context, id string) error {
+	host, err := s.Reschedule(ctx, id, s.opts.now())
+	if err != nil {
+		return err
+	}
+	if host == s.queue.Host() {
+		return s.Sweep(ctx)
+	}
+	return nil
+}
+
+// matchDelayJob 任务是否满足前缀条件
+func matchDelayJob(job *DelayJob, prefix string) bool {
+	return prefix == "" || strings.HasPrefix(job.ID, prefix) || strings.HasPrefix(job.path(), prefix)
+}
+
+// path 任务操作的路径, 没有路径时返回空
+func (j *DelayJob) path() string {
+	var payload struct {
+		Path string `json:"path"`
+	}
+	json.Unmarshal(j.Payload, &payload)
+	return payload.Path
+}
+
+// DELAY_JOB_ADMIN_PATH 延迟任务管理接口路径前缀
+const DELAY_JOB_ADMIN_PATH = "/storage/delay_job"
+
+// DelayJobAdminServer 延迟任务管理接口, 鉴权由挂载的服务负责
+//
+//	GET  /storage/delay_job/stats
+//	GET  /storage/delay_job/jobs?host=&prefix=&from=&to=&limit=
+//	POST /storage/delay_job/jobs/cancel     {"id": ""}
+//	POST /storage/delay_job/jobs/reschedule {"id": "", "at": 0}
+//	POST /storage/delay_job/jobs/run        {"id": ""}
+//	POST /storage/delay_job/orphans/sweep   {"dry_run": true}
+//	GET  /storage/delay_job/usage
+//	POST /storage/delay_job/usage/recalculate
+type DelayJobAdminServer struct {
+	job *StorageDelayJob
+}
+
+// NewDelayJobAdminServer .
+func NewDelayJobAdminServer(job *StorageDelayJob) *DelayJobAdminServer {
+	return &DelayJobAdminServer{job: job}
+}
+
+type delayJobAdminReq struct {
+	ID string `json:"id"`
+	// unix时间戳
+	At int64 `json:"at"`
+}
+
+// delayJobAdminMethods 每个接口允许的请求方法
+var delayJobAdminMethods = map[string]string{
+	"/stats":             http.MethodGet,
+	"/jobs":              http.MethodGet,
+	"/jobs/cancel":       http.MethodPost,
+	"/jobs/reschedule":   http.MethodPost,
+	"/jobs/run":          http.MethodPost,
+	"/orphans/sweep":     http.MethodPost,
+	"/usage":             http.MethodGet,
+	"/usage/recalculate": http.MethodPost,
+}
+
+// ServeHTTP .
+func (a *DelayJobAdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, DELAY_JOB_ADMIN_PATH)
+	method, ok := delayJobAdminMethods[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		result interface{}
+		err    error
+	)
+	switch path {
+	case "/stats":
+		result, err = a.job.Stats(r.Context())
+	case "/jobs":
+		result, err = a.list(r)
+	case "/jobs/cancel", "/jobs/reschedule", "/jobs/run":
+		result, err = a.update(r)
+	case "/orphans/sweep":
+		result, err = a.sweepOrphans(r)
+	case "/usage":
+		result, err = GetUsageWithOptions(r.Context(), a.job.opts)
+	case "/usage/recalculate":
+		result, err = RecalculateUsageWithOptions(r.Context(), a.job.opts)
+	}
+	if err != nil {
+		a.job.opts.Logger.Errorf("delay job admin '%s' fail[%s]", r.URL.Path, err.Error())
+		http.Error(w, PublicMessage(err), HTTPStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *DelayJobAdminServer) list(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	filter := &DelayJobFilter{Host: query.Get("host"), Prefix: query.Get("prefix"), Limit: 100}
+	for name, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if query.Get(name) == "" {
+			continue
+		}
+		unix, err := strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil {
+			return nil, newError(ErrInvalidArgument, "delay_job.admin", "invalid %s '%s'", name, query.Get(name))
+		}
+		*value = time.Unix(unix, 0)
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.ParseInt(query.Get("limit"), 10, 64)
+		if err != nil {
+			return nil, newError(ErrInvalidArgument, "delay_job.admin", "invalid limit '%s'", query.Get("limit"))
+		}
+		filter.Limit = limit
+	}
+	entries, err := a.job.List(r.Context(), filter)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"data": entries}, nil
+}
+
+func (a *DelayJobAdminServer) update(r *http.Request) (interface{}, error) {
+	var req delayJobAdminReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, newError(ErrInvalidArgument, "delay_job.admin", "invalid request body[%s]", err.Error())
+	}
+	if req.ID == "" {
+		return nil, newError(ErrInvalidArgument, "delay_job.admin", "id required")
+	}
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, DELAY_JOB_ADMIN_PATH) {
+	case "/jobs/cancel":
+		err = a.job.Cancel(r.Context(), req.ID)
+	case "/jobs/reschedule":
+		if req.At <= 0 {
+			return nil, newError(ErrInvalidArgument, "delay_job.admin", "at required")
+		}
+		_, err = a.job.Reschedule(r.Context(), req.ID, time.Unix(req.At, 0))
+	case "/jobs/run":
+		err = a.job.RunNow(r.Context(), req.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"id": req.ID}, nil
+}
+
+// sweepOrphans 立即清理孤儿文件, 没有指定dry_run时按配置
+func (a *DelayJobAdminServer) sweepOrphans(r *http.Request) (interface{}, error) {
+	var req struct {
+		DryRun *bool `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return nil, newError(ErrInvalidArgument, "delay_job.admin", "invalid request body[%s]", err.Error())
+	}
+	sweeper := NewOrphanSweeper(a.job)
+	if req.DryRun != nil {
+		sweeper.DryRun = *req.DryRun
+	}
+	return sweeper.Sweep(r.Context())
+}
@@ -0,0 +1,162 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestDelayJobAdminStatus(t *testing.T) {
+	queue := openTestBoltDelayQueue(t, filepath.Join(t.TempDir(), "delay_job.db"))
+	defer queue.Close()
+	job, err := NewStorageDelayJobWithOptions(&Options{UploadPath: t.TempDir(), DelayQueue: queue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewDelayJobAdminServer(job))
+	defer server.Close()
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, "/jobs?limit=abc", "", http.StatusBadRequest},
+		{http.MethodGet, "/jobs/cancel", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/stats", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/unknown", "", http.StatusNotFound},
+		{http.MethodPost, "/jobs/reschedule", `{"id": "a"}`, http.StatusBadRequest},
+		{http.MethodPost, "/jobs/reschedule", `{"id": "a", "at": 1}`, http.StatusNotFound},
+		// 没有用量存储属于服务端错误
+		{http.MethodGet, "/usage", "", http.StatusInternalServerError},
+	} {
+		req, _ := http.NewRequest(c.method, server.URL+DELAY_JOB_ADMIN_PATH+c.path, strings.NewReader(c.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("%s %s got %s, want %d", c.method, c.path, resp.Status, c.status)
+		}
+	}
+}
+
+func TestDelayJobAdmin(t *testing.T) {
+	t.Run("bolt", func(t *testing.T) {
+		clock := &testClock{now: time.Unix(time.Now().Unix(), 0)}
+		queue, err := openBoltDelayQueue(filepath.Join(t.TempDir(), "delay_job.db"), "1", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer queue.Close()
+		job, err := NewStorageDelayJobWithOptions(&Options{UploadPath: t.TempDir(), DelayQueue: queue, Clock: clock})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDelayJobAdmin(t, job, clock)
+	})
+	t.Run("redis", func(t *testing.T) {
+		clock := &testClock{now: time.Unix(time.Now().Unix(), 0)}
+		job, _ := newTestRedisDelayJob(t, miniredis.RunT(t), "node1", clock, nil)
+		testDelayJobAdmin(t, job, clock)
+	})
+}
+
+func testDelayJobAdmin(t *testing.T, job *StorageDelayJob, clock *testClock) {
+	ctx := context.Background()
+	uploadPath := job.opts.uploadRoot()
+	server := httptest.NewServer(NewDelayJobAdminServer(job))
+	defer server.Close()
+	call := func(method, path, body string, result interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+DELAY_JOB_ADMIN_PATH+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s got %s", method, path, resp.Status)
+		}
+		if result != nil {
+			if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	list := func(query string) []string {
+		t.Helper()
+		var result struct {
+			Data []*DelayJobEntry `json:"data"`
+		}
+		call(http.MethodGet, "/jobs?"+query, "", &result)
+		ids := []string{}
+		for _, entry := range result.Data {
+			ids = append(ids, entry.Job.ID)
+		}
+		return ids
+	}
+
+	aPath := filepath.Join(uploadPath, "a/1.png")
+	bPath := filepath.Join(uploadPath, "a/2.png")
+	cPath := filepath.Join(uploadPath, "b/1.png")
+	for path, at := range map[string]time.Time{
+		aPath: clock.now.Add(-time.Minute),
+		bPath: clock.now.Add(time.Hour),
+		cPath: clock.now.Add(2 * time.Hour),
+	} {
+		if err := job.AddJob(ctx, NewDeleteFileJob(path), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats DelayJobStats
+	call(http.MethodGet, "/stats", "", &stats)
+	if len(stats.Queues) != 1 || stats.Queues[0].Queued != 3 || stats.Queues[0].OldestDue != clock.now.Add(-time.Minute).Unix() ||
+		stats.Queues[0].LagSeconds != 60 {
+		t.Fatalf("unexpected stats %+v", stats.Queues[0])
+	}
+
+	if ids := list("prefix=" + url.QueryEscape(filepath.Join(uploadPath, "a"))); strings.Join(ids, ",") != aPath+","+bPath {
+		t.Fatalf("unexpected prefix filter %v", ids)
+	}
+	window := fmt.Sprintf("from=%d&to=%d", clock.now.Unix(), clock.now.Add(time.Hour).Unix())
+	if ids := list(window); strings.Join(ids, ",") != bPath {
+		t.Fatalf("unexpected time filter %v", ids)
+	}
+
+	call(http.MethodPost, "/jobs/cancel", fmt.Sprintf(`{"id": %q}`, cPath), nil)
+	if ids := list(""); strings.Join(ids, ",") != aPath+","+bPath {
+		t.Fatalf("job not canceled %v", ids)
+	}
+
+	at := clock.now.Add(3 * time.Hour)
+	call(http.MethodPost, "/jobs/reschedule", fmt.Sprintf(`{"id": %q, "at": %d}`, aPath, at.Unix()), nil)
+	entries, err := job.List(ctx, &DelayJobFilter{Prefix: aPath})
+	if err != nil || len(entries) != 1 || entries[0].DueAt != at.Unix() {
+		t.Fatalf("job not rescheduled %+v[%v]", entries, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(bPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bPath, pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	call(http.MethodPost, "/jobs/run", fmt.Sprintf(`{"id": %q}`, bPath), nil)
+	if _, err := os.Stat(bPath); !os.IsNotExist(err) {
+		t.Fatalf("file '%s' not deleted[%v]", bPath, err)
+	}
+	if ids := list(""); strings.Join(ids, ",") != aPath {
+		t.Fatalf("job not run %v", ids)
+	}
+}
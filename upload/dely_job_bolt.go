@@ -0,0 +1,468 @@
+package upload
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltDelayQueue 保存在本地bbolt文件中的延迟任务队列, 用于没有redis的单节点部署
+// 进程重启后任务仍然保留, 只有当前一个节点, 没有心跳和下线节点处理
+//
+//	jobs         任务ID -> boltDelayRecord
+//	schedule     执行时间(8字节大端) + 任务ID, 按时间顺序扫描到期任务
+//	dead_letter  任务ID -> boltDelayRecord, DueAt为放入死信的时间
+type boltDelayQueue struct {
+	db    *bolt.DB
+	path  string
+	host  string
+	clock Clock
+
+	mu sync.Mutex
+	// 休眠截止时间
+	deadline time.Time
+	waiters  map[chan struct{}]struct{}
+}
+
+var (
+	boltJobsBucket       = []byte("jobs")
+	boltScheduleBucket   = []byte("schedule")
+	boltDeadLetterBucket = []byte("dead_letter")
+)
+
+type boltDelayRecord struct {
+	Job *DelayJob `json:"job"`
+	// 执行时间, 处理中时为租约到期时间
+	DueAt      int64 `json:"due_at"`
+	Processing bool  `json:"processing"`
+	Attempts   int64 `json:"attempts"`
+}
+
+// openBoltDelayQueue clock为空时使用系统时间
+func openBoltDelayQueue(path, host string, clock Clock) (*boltDelayQueue, error) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), DIR_FILE_MODE); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open delay queue '%s' fail[%s]", path, err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltJobsBucket, boltScheduleBucket, boltDeadLetterBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDelayQueue{
+		db:      db,
+		path:    path,
+		host:    host,
+		clock:   clock,
+		waiters: make(map[chan struct{}]struct{}),
+	}, nil
+}
+
+// Close 关闭bbolt文件
+func (q *boltDelayQueue) Close() error {
+	return q.db.Close()
+}
+
+func boltScheduleKey(due int64, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(due))
+	return append(key, id...)
+}
+
+func boltScheduleDue(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:8]))
+}
+
+func (q *boltDelayQueue) get(tx *bolt.Tx, bucket []byte, id string) (*boltDelayRecord, error) {
+	data := tx.Bucket(bucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	var record boltDelayRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	// bbolt存储没有升级前只保存文件路径的任务, 没有内容时执行失败后放入死信
+	if record.Job == nil {
+		record.Job = &DelayJob{ID: id}
+	}
+	return &record, nil
+}
+
+// put 保存任务并更新执行时间索引, old为修改前的任务
+func (q *boltDelayQueue) put(tx *bolt.Tx, record, old *boltDelayRecord) error {
+	if old != nil {
+		if err := tx.Bucket(boltScheduleBucket).Delete(boltScheduleKey(old.DueAt, old.Job.ID)); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltJobsBucket).Put([]byte(record.Job.ID), data); err != nil {
+		return err
+	}
+	return tx.Bucket(boltScheduleBucket).Put(boltScheduleKey(record.DueAt, record.Job.ID), nil)
+}
+
+func (q *boltDelayQueue) delete(tx *bolt.Tx, record *boltDelayRecord) error {
+	if err := tx.Bucket(boltScheduleBucket).Delete(boltScheduleKey(record.DueAt, record.Job.ID)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltJobsBucket).Delete([]byte(record.Job.ID))
+}
+
+// Name .
+func (q *boltDelayQueue) Name() string {
+	return q.path
+}
+
+// Host .
+func (q *boltDelayQueue) Host() string {
+	return q.host
+}
+
+// Add 已存在的任务保留失败次数
+func (q *boltDelayQueue) Add(ctx context.Context, job *DelayJob, at time.Time) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		old, err := q.get(tx, boltJobsBucket, job.ID)
+		if err != nil {
+			return err
+		}
+		record := &boltDelayRecord{Job: job, DueAt: at.Unix()}
+		if old != nil {
+			record.Attempts = old.Attempts
+		}
+		return q.put(tx, record, old)
+	})
+	if err != nil {
+		return err
+	}
+	q.notify(at)
+	return nil
+}
+
+// Remove .
+func (q *boltDelayQueue) Remove(ctx context.Context, id string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		record, err := q.get(tx, boltJobsBucket, id)
+		if err != nil || record == nil {
+			return err
+		}
+		return q.delete(tx, record)
+	})
+}
+
+// Claim 到期的任务和租约到期的任务按时间顺序领取
+func (q *boltDelayQueue) Claim(ctx context.Context, now, leaseUntil time.Time, limit int64) ([]*DelayJob, error) {
+	var jobs []*DelayJob
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		// 遍历时不能修改, 先取出到期的索引
+		var keys [][]byte
+		cursor := tx.Bucket(boltScheduleBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && int64(len(keys)) < limit; key, _ = cursor.Next() {
+			if boltScheduleDue(key) > now.Unix() {
+				break
+			}
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		for _, key := range keys {
+			old, err := q.get(tx, boltJobsBucket, string(key[8:]))
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				if err := tx.Bucket(boltScheduleBucket).Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			record := *old
+			record.Processing = true
+			record.DueAt = leaseUntil.Unix()
+			if err := q.put(tx, &record, old); err != nil {
+				return err
+			}
+			// bolt按领取时的内容比较, 处理期间重新添加的任务Processing为false
+			claimed, err := json.Marshal(record.Job)
+			if err != nil {
+				return err
+			}
+			job := *record.Job
+			job.claimed = string(claimed)
+			jobs = append(jobs, &job)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Ack 任务内容与领取时相同才删除, 处理期间重新添加的任务保留
+func (q *boltDelayQueue) Ack(ctx context.Context, job *DelayJob) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		record, err := q.claimedRecord(tx, job)
+		if err != nil || record == nil {
+			return err
+		}
+		return q.delete(tx, record)
+	})
+}
+
+// claimedRecord 任务仍是领取时的任务, 处理期间重新添加或已删除时返回nil
+func (q *boltDelayQueue) claimedRecord(tx *bolt.Tx, job *DelayJob) (*boltDelayRecord, error) {
+	record, err := q.get(tx, boltJobsBucket, job.ID)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	current, err := json.Marshal(record.Job)
+	if err != nil {
+		return nil, err
+	}
+	if !record.Processing || string(current) != job.claimed {
+		return nil, nil
+	}
+	return record, nil
+}
+
+// Fail .
+func (q *boltDelayQueue) Fail(ctx context.Context, id string) (int64, error) {
+	var attempts int64
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		old, err := q.get(tx, boltJobsBucket, id)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return fmt.Errorf("job '%s' not found", id)
+		}
+		record := *old
+		record.Attempts++
+		attempts = record.Attempts
+		return q.put(tx, &record, old)
+	})
+	return attempts, err
+}
+
+// Retry .
+func (q *boltDelayQueue) Retry(ctx context.Context, job *DelayJob, at time.Time) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		old, err := q.claimedRecord(tx, job)
+		if err != nil || old == nil {
+			return err
+		}
+		record := *old
+		record.Processing = false
+		record.DueAt = at.Unix()
+		return q.put(tx, &record, old)
+	})
+}
+
+// Bury .
+func (q *boltDelayQueue) Bury(ctx context.Context, job *DelayJob) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		old, err := q.claimedRecord(tx, job)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if err := q.delete(tx, old); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(&boltDelayRecord{Job: job, DueAt: q.clock.Now().Unix()})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltDeadLetterBucket).Put([]byte(job.ID), data)
+	})
+}
+
+// DeadLetters .
+func (q *boltDelayQueue) DeadLetters(ctx context.Context) ([]*DelayJobEntry, error) {
+	var entries []*DelayJobEntry
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeadLetterBucket).ForEach(func(key, _ []byte) error {
+			record, err := q.get(tx, boltDeadLetterBucket, string(key))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &DelayJobEntry{Host: q.host, Job: record.Job, DueAt: record.DueAt})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// NextDue .
+func (q *boltDelayQueue) NextDue(ctx context.Context) (time.Time, error) {
+	var next time.Time
+	err := q.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(boltScheduleBucket).Cursor().First(); key != nil {
+			next = time.Unix(boltScheduleDue(key), 0)
+		}
+		return nil
+	})
+	return next, err
+}
+
+// SetDeadline 只有当前进程会添加任务, 截止时间保存在内存中
+func (q *boltDelayQueue) SetDeadline(ctx context.Context, deadline time.Time, ttl time.Duration) error {
+	q.mu.Lock()
+	q.deadline = deadline
+	q.mu.Unlock()
+	return nil
+}
+
+// Wakeup .
+func (q *boltDelayQueue) Wakeup(ctx context.Context) <-chan struct{} {
+	wakeup := make(chan struct{}, 1)
+	q.mu.Lock()
+	q.waiters[wakeup] = struct{}{}
+	q.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		delete(q.waiters, wakeup)
+		q.mu.Unlock()
+	}()
+	return wakeup
+}
+
+// notify 任务执行时间早于休眠截止时间时唤醒
+func (q *boltDelayQueue) notify(at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.deadline.IsZero() || at.Unix() >= q.deadline.Unix() {
+		return
+	}
+	for wakeup := range q.waiters {
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Maintain 单节点没有需要维护的内容
+func (q *boltDelayQueue) Maintain(ctx context.Context, interval time.Duration, limit int64) {
+}
+
+// Stats .
+func (q *boltDelayQueue) Stats(ctx context.Context) (*DelayJobStats, error) {
+	queueStats := &DelayJobQueueStats{Host: q.host}
+	stats := &DelayJobStats{Queues: []*DelayJobQueueStats{queueStats}}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltJobsBucket).ForEach(func(key, _ []byte) error {
+			record, err := q.get(tx, boltJobsBucket, string(key))
+			if err != nil {
+				return err
+			}
+			if record.Processing {
+				queueStats.Processing++
+				return nil
+			}
+			queueStats.Queued++
+			if queueStats.OldestDue == 0 || record.DueAt < queueStats.OldestDue {
+				queueStats.OldestDue = record.DueAt
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stats.DeadLetters = int64(tx.Bucket(boltDeadLetterBucket).Stats().KeyN)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if queueStats.OldestDue > 0 {
+		if lag := q.clock.Now().Unix() - queueStats.OldestDue; lag > 0 {
+			queueStats.LagSeconds = lag
+		}
+	}
+	return stats, nil
+}
+
+// List 按执行时间顺序, 处理中的任务按租约到期时间
+func (q *boltDelayQueue) List(ctx context.Context, filter *DelayJobFilter) ([]*DelayJobEntry, error) {
+	if filter.Host != "" && filter.Host != q.host {
+		return nil, nil
+	}
+	var entries []*DelayJobEntry
+	err := q.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltScheduleBucket).Cursor()
+		key, _ := cursor.First()
+		if !filter.From.IsZero() {
+			key, _ = cursor.Seek(boltScheduleKey(filter.From.Unix(), ""))
+		}
+		for ; key != nil; key, _ = cursor.Next() {
+			if !filter.To.IsZero() && boltScheduleDue(key) > filter.To.Unix() {
+				break
+			}
+			record, err := q.get(tx, boltJobsBucket, string(key[8:]))
+			if err != nil {
+				return err
+			}
+			if record == nil || !matchDelayJob(record.Job, filter.Prefix) {
+				continue
+			}
+			entries = append(entries, &DelayJobEntry{
+				Host:       q.host,
+				Job:        record.Job,
+				DueAt:      record.DueAt,
+				Processing: record.Processing,
+			})
+			if filter.Limit > 0 && int64(len(entries)) >= filter.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Reschedule 正在执行的任务不能修改
+func (q *boltDelayQueue) Reschedule(ctx context.Context, id string, at time.Time) (string, error) {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		old, err := q.get(tx, boltJobsBucket, id)
+		if err != nil {
+			return err
+		}
+		if old == nil || old.Processing {
+			return newError(ErrNotFound, "delay_job.reschedule", "job '%s' not found", id)
+		}
+		record := *old
+		record.DueAt = at.Unix()
+		return q.put(tx, &record, old)
+	})
+	if err != nil {
+		return "", err
+	}
+	q.notify(at)
+	return q.host, nil
+}
@@ -0,0 +1,189 @@
+package upload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestBoltDelayQueue(t *testing.T, path string) *boltDelayQueue {
+	queue, err := openBoltDelayQueue(path, "1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+func TestBoltDelayQueue(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "delay_job.db")
+	queue := openTestBoltDelayQueue(t, path)
+	now := time.Now()
+
+	for id, at := range map[string]time.Time{"a": now.Add(-time.Minute), "b": now.Add(-2 * time.Minute), "c": now.Add(time.Hour)} {
+		if err := queue.Add(ctx, NewDeleteFileJob(id), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queue.Remove(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后任务仍然保留
+	queue.Close()
+	queue = openTestBoltDelayQueue(t, path)
+	defer queue.Close()
+
+	jobs, err := queue.Claim(ctx, now, now.Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != "b" || jobs[1].ID != "a" {
+		t.Fatalf("unexpected claimed jobs %+v", jobs)
+	}
+	if jobs, _ := queue.Claim(ctx, now, now.Add(time.Minute), 10); len(jobs) != 0 {
+		t.Fatalf("claimed jobs twice %+v", jobs)
+	}
+
+	if err := queue.Ack(ctx, jobs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, err := queue.Fail(ctx, "b"); err != nil || attempts != 1 {
+		t.Fatalf("unexpected attempts %d[%v]", attempts, err)
+	}
+	if err := queue.Retry(ctx, jobs[0], now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := queue.NextDue(ctx); next.Unix() != now.Add(time.Second).Unix() {
+		t.Fatalf("unexpected next due %s", next)
+	}
+
+	// 租约到期后可以重新领取
+	later := now.Add(time.Minute)
+	if jobs, _ := queue.Claim(ctx, later, later.Add(time.Second), 10); len(jobs) != 1 || jobs[0].ID != "b" {
+		t.Fatalf("unexpected claimed jobs %+v", jobs)
+	}
+	if jobs, _ := queue.Claim(ctx, later.Add(2*time.Second), later.Add(time.Minute), 10); len(jobs) != 1 {
+		t.Fatalf("expired lease not reclaimed %+v", jobs)
+	}
+	if attempts, _ := queue.Fail(ctx, "b"); attempts != 2 {
+		t.Fatalf("unexpected attempts %d", attempts)
+	}
+	if err := queue.Bury(ctx, jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := queue.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queues[0].Queued != 0 || stats.Queues[0].Processing != 0 || stats.DeadLetters != 1 {
+		t.Fatalf("unexpected stats %+v %+v", stats, stats.Queues[0])
+	}
+}
+
+func TestBoltDelayQueueAckReadded(t *testing.T) {
+	ctx := context.Background()
+	queue := openTestBoltDelayQueue(t, filepath.Join(t.TempDir(), "delay_job.db"))
+	defer queue.Close()
+	now := time.Now()
+	if err := queue.Add(ctx, NewDeleteFileJob("a"), now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := queue.Claim(ctx, now, now.Add(time.Minute), 10)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("unexpected claimed jobs %+v[%v]", jobs, err)
+	}
+	// 处理期间重新添加的任务不会被确认删除
+	readded := &DelayJob{ID: "a", Type: DJ_DELETE_DIR, Payload: []byte(`{"path":"a"}`)}
+	if err := queue.Add(ctx, readded, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Ack(ctx, jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := queue.List(ctx, &DelayJobFilter{})
+	if err != nil || len(entries) != 1 || entries[0].Job.Type != DJ_DELETE_DIR {
+		t.Fatalf("readded job lost %+v[%v]", entries, err)
+	}
+}
+
+func TestDelayJobClock(t *testing.T) {
+	ctx := context.Background()
+	// 与系统时间相差较大的时钟
+	clock := &testClock{now: time.Unix(time.Now().Add(-72*time.Hour).Unix(), 0)}
+	queue, err := openBoltDelayQueue(filepath.Join(t.TempDir(), "delay_job.db"), "1", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	job, err := NewStorageDelayJobWithOptions(&Options{
+		UploadPath: t.TempDir(),
+		Config:     mapConfig{"storage.delay_delete.jitter": "0s"},
+		Clock:      clock,
+		DelayQueue: queue,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Add(ctx, NewDeleteFileJob("a"), clock.now.Add(10*time.Second))
+	if wait := job.nextWait(ctx); wait != 10*time.Second {
+		t.Fatalf("unexpected wait %s", wait)
+	}
+
+	queue.Add(ctx, NewDeleteFileJob("b"), clock.now.Add(-time.Minute))
+	if stats, err := queue.Stats(ctx); err != nil || stats.Queues[0].LagSeconds != 60 {
+		t.Fatalf("unexpected stats %+v[%v]", stats, err)
+	}
+	jobs, _ := queue.Claim(ctx, clock.now, clock.now.Add(time.Minute), 1)
+	if err := queue.Bury(ctx, jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := queue.DeadLetters(ctx); err != nil || len(entries) != 1 || entries[0].DueAt != clock.now.Unix() {
+		t.Fatalf("unexpected dead letters %+v[%v]", entries, err)
+	}
+}
+
+func TestLegacyDeleteFileJob(t *testing.T) {
+	root := t.TempDir()
+	if job := legacyDeleteFileJob(filepath.Join(root, "1/a.png"), root); job.Type != DJ_DELETE_FILE {
+		t.Fatalf("unexpected legacy job %+v", job)
+	}
+	for _, id := range []string{root, filepath.Dir(root), "webhook:x", "/etc/passwd"} {
+		if job := legacyDeleteFileJob(id, root); job.Type != "" {
+			t.Fatalf("id '%s' decoded as %s job", id, job.Type)
+		}
+	}
+}
+
+func TestStorageDelayJobBolt(t *testing.T) {
+	uploadPath := t.TempDir()
+	queue := openTestBoltDelayQueue(t, filepath.Join(t.TempDir(), "delay_job.db"))
+	defer queue.Close()
+	job, err := NewStorageDelayJobWithOptions(&Options{UploadPath: uploadPath, DelayQueue: queue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := job.Start(context.Background())
+	defer job.Stop()
+
+	filePath := filepath.Join(uploadPath, "a.png")
+	if err := os.WriteFile(filePath, pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.AddJob(context.Background(), NewDeleteFileJob(filePath), time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := job.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatalf("file '%s' not deleted[%v]", filePath, err)
+	}
+	job.Stop()
+	<-done
+}
@@ -0,0 +1,72 @@
+package upload
+
+import (
+	"context"
+	"time"
+)
+
+// 延迟任务先领取再确认
+// 到期的任务领取时设置租约, 执行成功后才从队列中删除
+// 执行失败按指数退避重新放回队列, 超过最大次数后放入死信集合
+// 租约到期仍未确认的任务(进程退出等)可以重新领取
+
+// claim 领取到期任务, 最多limit个
+func (s *StorageDelayJob) claim(ctx context.Context, limit int64) ([]*DelayJob, error) {
+	now := s.opts.now()
+	return s.queue.Claim(ctx, now, now.Add(s.leaseDuration()), limit)
+}
+
+// ack 任务执行成功, 不使用后台任务的ctx, 停止时已完成的任务也能确认
+func (s *StorageDelayJob) ack(job *DelayJob) {
+	if err := s.queue.Ack(context.Background(), job); err != nil {
+		s.opts.Logger.Errorf("ack job '%s' in delay job '%s' fail[%s]", job.ID, s.queue.Name(), err.Error())
+	}
+}
+
+// fail 任务执行失败, 重试或放入死信集合
+func (s *StorageDelayJob) fail(job *DelayJob, cause error) {
+	attempts, err := s.queue.Fail(context.Background(), job.ID)
+	if err != nil {
+		// 租约到期后会重新领取
+		s.opts.Logger.Errorf("incr job '%s' attempts in delay job '%s' fail[%s]", job.ID, s.queue.Name(), err.Error())
+		return
+	}
+	if isPermanent(cause) || attempts >= s.maxAttempts() {
+		s.opts.Logger.Errorf("job '%s' in delay job '%s' failed %d times, move to dead letter[%s]",
+			job.ID, s.queue.Name(), attempts, cause.Error())
+		err = s.queue.Bury(context.Background(), job)
+	} else {
+		retryAt := s.opts.now().Add(s.retryBackoff(attempts))
+		s.opts.Logger.Warnf("job '%s' in delay job '%s' failed %d times, retry at %s[%s]",
+			job.ID, s.queue.Name(), attempts, retryAt.Format(time.RFC3339), cause.Error())
+		err = s.queue.Retry(context.Background(), job, retryAt)
+	}
+	if err != nil {
+		s.opts.Logger.Errorf("requeue job '%s' in delay job '%s' fail[%s]", job.ID, s.queue.Name(), err.Error())
+	}
+}
+
+// DeadLetters 获取死信任务, DueAt为放入死信的时间
+func (s *StorageDelayJob) DeadLetters(ctx context.Context) ([]*DelayJobEntry, error) {
+	return s.queue.DeadLetters(ctx)
+}
+
+func (s *StorageDelayJob) leaseDuration() time.Duration {
+	return s.opts.settings().DelayJob.Lease
+}
+
+func (s *StorageDelayJob) maxAttempts() int64 {
+	return s.opts.settings().DelayJob.MaxAttempts
+}
+
+// retryBackoff 第attempts次失败后的重试间隔
+func (s *StorageDelayJob) retryBackoff(attempts int64) time.Duration {
+	backoff := s.opts.settings().DelayJob.RetryBackoff
+	for i := int64(1); i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	return backoff
+}
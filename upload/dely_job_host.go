@@ -0,0 +1,192 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 每个节点一个队列, 节点定期在节点集合中更新心跳
+// 超过host_timeout没有心跳的节点视为已下线, 其队列中的任务按配置转移到其他节点或者只报告
+
+const (
+	// STALE_HOST_POLICY_REPORT 只记录日志
+	STALE_HOST_POLICY_REPORT = "report"
+	// STALE_HOST_POLICY_REASSIGN 转移到其他节点, 用于磁盘已迁移到其他节点的情况
+	STALE_HOST_POLICY_REASSIGN = "reassign"
+)
+
+// reassignScript 将下线节点的任务转移到目标节点
+// KEYS[1] 下线节点队列 KEYS[2] 下线节点处理中集合 KEYS[3] 下线节点重试次数
+// KEYS[4] 目标节点队列 KEYS[5] 节点集合 KEYS[6] 下线节点任务内容 KEYS[7] 目标节点任务内容
+// KEYS[8] 下线节点任务版本 KEYS[9] 目标节点任务版本
+// ARGV[1] 下线节点 ARGV[2] 当前时间
+var reassignScript = redis.NewScript(`
+local n = 0
+local jobs = redis.call('HGETALL', KEYS[6])
+for i = 1, #jobs, 2 do
+	redis.call('HSET', KEYS[7], jobs[i], jobs[i + 1])
+end
+local gens = redis.call('HGETALL', KEYS[8])
+for i = 1, #gens, 2 do
+	redis.call('HINCRBY', KEYS[9], gens[i], gens[i + 1])
+end
+local queued = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+for i = 1, #queued, 2 do
+	redis.call('ZADD', KEYS[4], queued[i + 1], queued[i])
+	n = n + 1
+end
+local processing = redis.call('ZRANGE', KEYS[2], 0, -1)
+for _, member in ipairs(processing) do
+	redis.call('ZADD', KEYS[4], ARGV[2], member)
+	n = n + 1
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3], KEYS[6], KEYS[8])
+redis.call('ZREM', KEYS[5], ARGV[1])
+return n
+`)
+
+func hostQueue(base, host string) string {
+	return delayQueueTag(base) + ":host:" + host
+}
+
+// delayQueueTag 延迟任务key的hash tag, 升级前共用的队列base不带hash tag
+func delayQueueTag(base string) string {
+	return "{" + base + "}"
+}
+
+// hostsKey 节点集合, score为最后心跳时间
+func (s *redisDelayQueue) hostsKey() string {
+	return delayQueueTag(s.base) + ":hosts"
+}
+
+func (s *redisDelayQueue) heartbeat(ctx context.Context) {
+	if err := s.opts.Redis.ZAdd(ctx, s.hostsKey(),
+		&redis.Z{Score: float64(s.opts.now().Unix()), Member: s.host}).Err(); err != nil {
+		s.opts.Logger.Errorf("delay job '%s' heartbeat fail[%s]", s.queue, err.Error())
+	}
+}
+
+// migrateLegacy 将升级前共用队列中的任务转移到文件所属节点的队列
+// 所属节点有多个可能时优先使用节点列表中的节点, 无法确定所属节点的任务转移到当前节点
+func (s *redisDelayQueue) migrateLegacy(ctx context.Context, limit int64) {
+	entries, err := s.opts.Redis.ZRangeWithScores(ctx, s.base, 0, limit-1).Result()
+	if err != nil {
+		s.opts.Logger.Errorf("fetch legacy delay job '%s' fail[%s]", s.base, err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	hosts, err := s.hosts(ctx)
+	if err != nil {
+		s.opts.Logger.Errorf("fetch delay job '%s' hosts fail[%s]", s.base, err.Error())
+		return
+	}
+	known := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		known[host] = true
+	}
+	for _, entry := range entries {
+		filePath, _ := entry.Member.(string)
+		host := s.host
+		if owners := ownerHostsByPath(filePath); len(owners) > 0 {
+			host = owners[0]
+			for _, owner := range owners {
+				if known[owner] {
+					host = owner
+					break
+				}
+			}
+		}
+		// 共用队列没有hash tag, 不能与节点队列放在同一个事务中
+		// 先添加再删除, 中断时任务留在共用队列, 下次重新转移
+		if err := s.opts.Redis.ZAdd(ctx, hostQueue(s.base, host), &redis.Z{Score: entry.Score, Member: filePath}).Err(); err != nil {
+			s.opts.Logger.Errorf("migrate legacy delay job '%s' to host '%s' fail[%s]", filePath, host, err.Error())
+			return
+		}
+		if err := s.opts.Redis.ZRem(ctx, s.base, filePath).Err(); err != nil {
+			s.opts.Logger.Errorf("remove legacy delay job '%s' fail[%s]", filePath, err.Error())
+			return
+		}
+	}
+}
+
+// StaleHosts 获取已下线的节点及其未完成的任务数量, 只有redis存储有多个节点
+func (s *StorageDelayJob) StaleHosts(ctx context.Context) (map[string]int64, error) {
+	queue, ok := s.queue.(*redisDelayQueue)
+	if !ok {
+		return map[string]int64{}, nil
+	}
+	return queue.staleHosts(ctx)
+}
+
+func (s *redisDelayQueue) staleHosts(ctx context.Context) (map[string]int64, error) {
+	deadline := s.opts.now().Add(-s.hostTimeout()).Unix()
+	hosts, err := s.opts.Redis.ZRangeByScore(ctx, s.hostsKey(),
+		&redis.ZRangeBy{Min: "-inf", Max: fmt.Sprintf("%d", deadline)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	staleHosts := make(map[string]int64, len(hosts))
+	for _, host := range hosts {
+		if host == s.host {
+			continue
+		}
+		pipe := s.opts.Redis.Pipeline()
+		queued := pipe.ZCard(ctx, hostQueue(s.base, host))
+		processing := pipe.ZCard(ctx, processingKey(hostQueue(s.base, host)))
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+		staleHosts[host] = queued.Val() + processing.Val()
+	}
+	return staleHosts, nil
+}
+
+// checkStaleHosts 处理已下线节点的任务, 同一时间只有一个节点处理
+func (s *redisDelayQueue) checkStaleHosts(ctx context.Context, interval time.Duration) {
+	ok, err := s.opts.Redis.SetNX(ctx, delayQueueTag(s.base)+":stale_hosts_lock", s.host, interval).Result()
+	if err != nil || !ok {
+		return
+	}
+	staleHosts, err := s.staleHosts(ctx)
+	if err != nil {
+		s.opts.Logger.Errorf("delay job '%s' fetch stale hosts fail[%s]", s.queue, err.Error())
+		return
+	}
+	settings := s.opts.settings().DelayJob
+	for host, pending := range staleHosts {
+		if pending == 0 {
+			s.opts.Redis.ZRem(ctx, s.hostsKey(), host)
+			continue
+		}
+		if settings.StaleHostPolicy != STALE_HOST_POLICY_REASSIGN {
+			s.opts.Logger.Errorf("delay job host '%s' offline, %d files not cleaned up", host, pending)
+			continue
+		}
+		target := settings.ReassignHost
+		if target == "" {
+			target = s.host
+		}
+		if target == host {
+			continue
+		}
+		queue := hostQueue(s.base, host)
+		n, err := reassignScript.Run(ctx, s.opts.Redis,
+			[]string{queue, processingKey(queue), attemptsKey(queue), hostQueue(s.base, target), s.hostsKey(),
+				jobsKey(queue), jobsKey(hostQueue(s.base, target)), genKey(queue), genKey(hostQueue(s.base, target))},
+			host, s.opts.now().Unix()).Int64()
+		if err != nil {
+			s.opts.Logger.Errorf("reassign delay job host '%s' to '%s' fail[%s]", host, target, err.Error())
+			continue
+		}
+		s.opts.Logger.Warnf("reassign %d delay jobs from offline host '%s' to '%s'", n, host, target)
+	}
+}
+
+func (s *redisDelayQueue) hostTimeout() time.Duration {
+	return s.opts.settings().DelayJob.HostTimeout
+}
@@ -0,0 +1,100 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPathNotAllowed 延迟任务删除的路径不在允许的根目录下
+var ErrPathNotAllowed = errors.New("path not allowed")
+
+// permanentError 不需要重试的错误, 任务直接放入死信集合
+type permanentError struct {
+	error
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.error
+}
+
+func permanent(err error) error {
+	return &permanentError{error: err}
+}
+
+func isPermanent(err error) bool {
+	var target *permanentError
+	return errors.As(err, &target)
+}
+
+// deleteRoots 延迟删除允许的根目录, 默认只允许上传目录
+func deleteRoots(opts *Options) []string {
+	roots := []string{opts.uploadRoot()}
+	if opts.settings().DelayJob.AllowCdnPath {
+		roots = append(roots, cdnRoots(opts)...)
+	}
+	return roots
+}
+
+// cdnRoots 默认的cdn根目录和各资源类型自定义的根目录
+func cdnRoots(opts *Options) []string {
+	roots := []string{opts.Namespace.Path(opts.RootPath), opts.Namespace.Path(opts.DownloadPath)}
+	seen := map[string]bool{roots[0]: true, roots[1]: true}
+	for _, def := range opts.ResourceTypes.All() {
+		if root := opts.cdnRoot(def); !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// confinePath 解析路径中的符号链接, 确认路径在roots下
+// 返回实际需要删除的路径, 路径不存在时返回空
+// 只解析上级目录, 路径本身是符号链接时删除的是链接而不是链接指向的文件
+func confinePath(path string, roots []string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(absPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	target := filepath.Join(parent, filepath.Base(absPath))
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return "", nil
+	}
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		resolvedRoot, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if resolvedRoot, err = filepath.EvalSymlinks(resolvedRoot); err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(resolvedRoot, target)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return target, nil
+	}
+	return "", permanent(fmt.Errorf("%w: '%s' resolved to '%s'", ErrPathNotAllowed, path, target))
+}
+
+// removeConfined 删除roots下的路径
+func removeConfined(path string, roots []string) error {
+	target, err := confinePath(path, roots)
+	if err != nil || target == "" {
+		return err
+	}
+	return os.RemoveAll(target)
+}
@@ -0,0 +1,109 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DELAY_QUEUE_BACKEND_REDIS 保存在redis中, 多节点共用
+	DELAY_QUEUE_BACKEND_REDIS = "redis"
+	// DELAY_QUEUE_BACKEND_BOLT 保存在本地bbolt文件中, 用于没有redis的单节点部署
+	DELAY_QUEUE_BACKEND_BOLT = "bolt"
+)
+
+// DelayQueue 延迟任务队列存储
+// 任务先领取再确认, 领取时设置租约, 租约到期仍未确认的任务可以重新领取
+type DelayQueue interface {
+	// Name 队列名称, 用于日志
+	Name() string
+	// Host 当前节点
+	Host() string
+	// Add 添加任务到当前节点, 任务已存在时覆盖内容和执行时间
+	Add(ctx context.Context, job *DelayJob, at time.Time) error
+	// Remove 从所有节点删除任务
+	Remove(ctx context.Context, id string) error
+	// Claim 领取到期任务和租约到期的任务, 最多limit个, 租约到leaseUntil
+	Claim(ctx context.Context, now, leaseUntil time.Time, limit int64) ([]*DelayJob, error)
+	// Ack 任务执行成功, 删除任务, 处理期间重新添加的任务保留
+	Ack(ctx context.Context, job *DelayJob) error
+	// Fail 记录一次失败, 返回已失败的次数
+	Fail(ctx context.Context, id string) (int64, error)
+	// Retry 失败的任务放回队列, 在at之后重新执行, 处理期间重新添加的任务保留新的执行时间
+	Retry(ctx context.Context, job *DelayJob, at time.Time) error
+	// Bury 失败的任务放入死信, 处理期间重新添加的任务保留
+	Bury(ctx context.Context, job *DelayJob) error
+	// DeadLetters 死信任务, DueAt为放入死信的时间
+	DeadLetters(ctx context.Context) ([]*DelayJobEntry, error)
+	// NextDue 当前节点最早的执行时间或租约到期时间, 没有任务时返回零值
+	NextDue(ctx context.Context) (time.Time, error)
+	// SetDeadline 设置休眠截止时间, 添加的任务早于截止时间时通过Wakeup唤醒
+	SetDeadline(ctx context.Context, deadline time.Time, ttl time.Duration) error
+	// Wakeup 唤醒通知, ctx取消后不再通知
+	Wakeup(ctx context.Context) <-chan struct{}
+	// Maintain 每轮扫描前执行, 处理心跳, 旧任务迁移和已下线的节点
+	Maintain(ctx context.Context, interval time.Duration, limit int64)
+	// Stats 各节点队列统计
+	Stats(ctx context.Context) (*DelayJobStats, error)
+	// List 按条件查询任务
+	List(ctx context.Context, filter *DelayJobFilter) ([]*DelayJobEntry, error)
+	// Reschedule 修改未执行任务的执行时间, 返回任务所属节点
+	Reschedule(ctx context.Context, id string, at time.Time) (string, error)
+}
+
+var (
+	delayQueueMu sync.Mutex
+	// 按文件路径缓存, bbolt文件同一时间只能打开一次
+	boltDelayQueues = map[string]*boltDelayQueue{}
+)
+
+// newDelayQueue 按配置获取延迟任务队列
+//
+//	storage.delay_delete.backend   redis|bolt, 默认redis
+//	storage.delay_delete.bolt_path bbolt文件路径, 默认delay_job.db
+//
+// 设置了Options.Namespace时队列名和bbolt文件按租户和环境隔离
+func newDelayQueue(opts *Options) (DelayQueue, error) {
+	switch backend := opts.settings().DelayJob.Backend; backend {
+	case DELAY_QUEUE_BACKEND_REDIS:
+		if opts.Redis == nil {
+			return nil, fmt.Errorf("delay queue backend '%s' need redis client", backend)
+		}
+		return newRedisDelayQueue(delayQueueName(opts), opts), nil
+	case DELAY_QUEUE_BACKEND_BOLT:
+		path := opts.settings().DelayJob.BoltPath
+		if !opts.Namespace.IsZero() {
+			path = filepath.Join(opts.Namespace.Path(filepath.Dir(path)), filepath.Base(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return nil, err
+			}
+		}
+		delayQueueMu.Lock()
+		defer delayQueueMu.Unlock()
+		if queue, ok := boltDelayQueues[path]; ok {
+			return queue, nil
+		}
+		queue, err := openBoltDelayQueue(path, opts.Hostname, opts.Clock)
+		if err != nil {
+			return nil, err
+		}
+		boltDelayQueues[path] = queue
+		return queue, nil
+	default:
+		return nil, fmt.Errorf("unknown delay queue backend '%s'", backend)
+	}
+}
+
+// delayQueueName redis队列名, 没有命名空间时与升级前相同
+func delayQueueName(opts *Options) string {
+	service := opts.Config.GetString("api_mgr.service.name", "api_mgr")
+	if opts.Namespace.IsZero() {
+		return opts.redisKey(fmt.Sprintf("%s:%s:storage:delay_job_queue",
+			service, opts.Config.GetString("service.metadata.tenant_name", "platform")))
+	}
+	return opts.redisKey(fmt.Sprintf("%s:storage:delay_job_queue", service))
+}
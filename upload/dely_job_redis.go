@@ -0,0 +1,480 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisDelayQueue 保存在redis中的延迟任务队列, 每个节点一个队列
+//
+//	{<base>}:host:<host>              队列, score为执行时间
+//	{<base>}:host:<host>:processing   处理中集合, score为租约到期时间
+//	{<base>}:host:<host>:attempts     失败次数
+//	{<base>}:host:<host>:jobs         任务内容
+//	{<base>}:host:<host>:gen          任务版本, 每次添加加一
+//	{<base>}:hosts                    节点集合
+//	{<base>}:dead_letter              所有节点共用的死信集合, score为放入死信的时间
+//
+// 脚本会同时访问多个节点的key, 使用base作为hash tag, redis cluster中所有key在同一个slot
+type redisDelayQueue struct {
+	// 所有节点共用的key前缀, 升级前的任务也保存在这里
+	base string
+	// 当前节点
+	host string
+	// 当前节点的队列
+	queue string
+	opts  *Options
+}
+
+func newRedisDelayQueue(base string, opts *Options) *redisDelayQueue {
+	return &redisDelayQueue{
+		base:  base,
+		host:  opts.Hostname,
+		queue: hostQueue(base, opts.Hostname),
+		opts:  opts,
+	}
+}
+
+// claimScript 领取到期任务, 每次最多领取ARGV[3]个, 返回 {任务ID, 任务内容, 任务版本, ...}
+// 任务版本和领取在同一个脚本中读取, Ack和Retry时与领取时的版本比较
+// KEYS[1] 队列 KEYS[2] 处理中集合 KEYS[3] 任务内容 KEYS[4] 任务版本
+// ARGV[1] 当前时间 ARGV[2] 租约到期时间 ARGV[3] 最多领取数量
+var claimScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, member in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], member)
+	redis.call('ZADD', KEYS[1], ARGV[1], member)
+end
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+local result = {}
+for _, member in ipairs(due) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('ZADD', KEYS[2], ARGV[2], member)
+	table.insert(result, member)
+	table.insert(result, redis.call('HGET', KEYS[3], member) or '')
+	table.insert(result, redis.call('HGET', KEYS[4], member) or '')
+end
+return result
+`)
+
+// releaseReadded 处理期间重新添加的任务版本与领取时不同, 保留新的任务和执行时间
+// 新的任务已在队列中时才删除处理中的记录, 已被重新领取时保留新的租约
+const releaseReadded = `
+if (redis.call('HGET', KEYS[5], ARGV[1]) or '') ~= ARGV[2] then
+	if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+		redis.call('ZREM', KEYS[2], ARGV[1])
+	end
+	return 0
+end
+`
+
+// ackScript 删除处理中的任务, 任务版本与领取时相同才删除
+// KEYS[1] 队列 KEYS[2] 处理中集合 KEYS[3] 失败次数 KEYS[4] 任务内容 KEYS[5] 任务版本
+// ARGV[1] 任务ID ARGV[2] 领取时的任务版本
+var ackScript = redis.NewScript(releaseReadded + `
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+return 1
+`)
+
+// retryScript 失败的任务放回队列, 任务版本与领取时相同才修改执行时间
+// KEYS与ackScript相同, ARGV[3] 重新执行的时间
+var retryScript = redis.NewScript(releaseReadded + `
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// wakeupScript 任务早于休眠截止时间时发送唤醒通知
+// KEYS[1] 休眠截止时间 ARGV[1] 任务执行时间 ARGV[2] 唤醒channel
+var wakeupScript = redis.NewScript(`
+local deadline = redis.call('GET', KEYS[1])
+if deadline and tonumber(ARGV[1]) < tonumber(deadline) then
+	return redis.call('PUBLISH', ARGV[2], ARGV[1])
+end
+return 0
+`)
+
+func processingKey(queue string) string {
+	return queue + ":processing"
+}
+
+func attemptsKey(queue string) string {
+	return queue + ":attempts"
+}
+
+func jobsKey(queue string) string {
+	return queue + ":jobs"
+}
+
+func genKey(queue string) string {
+	return queue + ":gen"
+}
+
+func wakeupAtKey(queue string) string {
+	return queue + ":wakeup_at"
+}
+
+func wakeupChannel(queue string) string {
+	return queue + ":wakeup"
+}
+
+// deadLetterQueue 所有节点共用死信集合
+func (s *redisDelayQueue) deadLetterQueue() string {
+	return delayQueueTag(s.base) + ":dead_letter"
+}
+
+// Name .
+func (s *redisDelayQueue) Name() string {
+	return s.queue
+}
+
+// Host .
+func (s *redisDelayQueue) Host() string {
+	return s.host
+}
+
+// Add .
+func (s *redisDelayQueue) Add(ctx context.Context, job *DelayJob, at time.Time) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	pipe := s.opts.Redis.TxPipeline()
+	pipe.HSet(ctx, jobsKey(s.queue), job.ID, string(data))
+	pipe.HIncrBy(ctx, genKey(s.queue), job.ID, 1)
+	pipe.ZAdd(ctx, s.queue, &redis.Z{Score: float64(at.Unix()), Member: job.ID})
+	pipe.ZAdd(ctx, s.hostsKey(), &redis.Z{Score: float64(s.opts.now().Unix()), Member: s.host})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	s.notifyWakeup(ctx, s.queue, at)
+	return nil
+}
+
+// Remove 包括升级前共用队列中的任务
+func (s *redisDelayQueue) Remove(ctx context.Context, id string) error {
+	hosts, err := s.hosts(ctx)
+	if err != nil {
+		return err
+	}
+	// 升级前的key没有hash tag, 与节点队列不在同一个slot, 不能放在同一个事务中
+	legacy := s.opts.Redis.Pipeline()
+	removeQueuedJob(ctx, legacy, s.base, id)
+	if _, err := legacy.Exec(ctx); err != nil {
+		return err
+	}
+	pipe := s.opts.Redis.TxPipeline()
+	for _, host := range hosts {
+		removeQueuedJob(ctx, pipe, hostQueue(s.base, host), id)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func removeQueuedJob(ctx context.Context, pipe redis.Pipeliner, queue, id string) {
+	pipe.ZRem(ctx, queue, id)
+	pipe.ZRem(ctx, processingKey(queue), id)
+	pipe.HDel(ctx, attemptsKey(queue), id)
+	pipe.HDel(ctx, jobsKey(queue), id)
+	pipe.HDel(ctx, genKey(queue), id)
+}
+
+// Claim .
+func (s *redisDelayQueue) Claim(ctx context.Context, now, leaseUntil time.Time, limit int64) ([]*DelayJob, error) {
+	result, err := claimScript.Run(ctx, s.opts.Redis,
+		[]string{s.queue, processingKey(s.queue), jobsKey(s.queue), genKey(s.queue)},
+		now.Unix(), leaseUntil.Unix(), limit).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*DelayJob, 0, len(result)/3)
+	for i := 0; i+2 < len(result); i += 3 {
+		job := s.decodeJob(result[i], result[i+1])
+		job.claimed = result[i+2]
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// loadJobs 一次获取多个任务内容, 返回的任务与ids顺序相同
+func (s *redisDelayQueue) loadJobs(ctx context.Context, queue string, ids []string) ([]*DelayJob, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	values, err := s.opts.Redis.HMGet(ctx, jobsKey(queue), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*DelayJob, 0, len(ids))
+	for i, id := range ids {
+		data, _ := values[i].(string)
+		jobs = append(jobs, s.decodeJob(id, data))
+	}
+	return jobs, nil
+}
+
+// decodeJob 没有内容的旧任务只有上传目录下的路径按删除文件处理
+func (s *redisDelayQueue) decodeJob(id, data string) *DelayJob {
+	if data == "" {
+		return legacyDeleteFileJob(id, s.opts.uploadRoot())
+	}
+	var job DelayJob
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		s.opts.Logger.Errorf("unmarshal delay job '%s' fail[%s]", data, err.Error())
+		return &DelayJob{ID: id}
+	}
+	return &job
+}
+
+// Ack .
+func (s *redisDelayQueue) Ack(ctx context.Context, job *DelayJob) error {
+	return ackScript.Run(ctx, s.opts.Redis, s.releaseKeys(), job.ID, job.claimed).Err()
+}
+
+func (s *redisDelayQueue) releaseKeys() []string {
+	return []string{s.queue, processingKey(s.queue), attemptsKey(s.queue), jobsKey(s.queue), genKey(s.queue)}
+}
+
+// Fail .
+func (s *redisDelayQueue) Fail(ctx context.Context, id string) (int64, error) {
+	return s.opts.Redis.HIncrBy(ctx, attemptsKey(s.queue), id, 1).Result()
+}
+
+// Retry .
+func (s *redisDelayQueue) Retry(ctx context.Context, job *DelayJob, at time.Time) error {
+	return retryScript.Run(ctx, s.opts.Redis, s.releaseKeys(), job.ID, job.claimed, at.Unix()).Err()
+}
+
+// Bury 任务内容保存在 <死信集合>:jobs, 处理期间重新添加的任务保留在队列中
+func (s *redisDelayQueue) Bury(ctx context.Context, job *DelayJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	pipe := s.opts.Redis.TxPipeline()
+	ackScript.Eval(ctx, pipe, s.releaseKeys(), job.ID, job.claimed)
+	pipe.HSet(ctx, jobsKey(s.deadLetterQueue()), job.ID, string(data))
+	pipe.ZAdd(ctx, s.deadLetterQueue(), &redis.Z{Score: float64(s.opts.now().Unix()), Member: job.ID})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeadLetters .
+func (s *redisDelayQueue) DeadLetters(ctx context.Context) ([]*DelayJobEntry, error) {
+	members, err := s.opts.Redis.ZRangeWithScores(ctx, s.deadLetterQueue(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		id, _ := member.Member.(string)
+		ids = append(ids, id)
+	}
+	jobs, err := s.loadJobs(ctx, s.deadLetterQueue(), ids)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*DelayJobEntry, 0, len(members))
+	for i, member := range members {
+		entries = append(entries, &DelayJobEntry{Job: jobs[i], DueAt: int64(member.Score)})
+	}
+	return entries, nil
+}
+
+// NextDue .
+func (s *redisDelayQueue) NextDue(ctx context.Context) (time.Time, error) {
+	pipe := s.opts.Redis.Pipeline()
+	queued := pipe.ZRangeWithScores(ctx, s.queue, 0, 0)
+	processing := pipe.ZRangeWithScores(ctx, processingKey(s.queue), 0, 0)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return time.Time{}, err
+	}
+	var next time.Time
+	for _, earliest := range [][]redis.Z{queued.Val(), processing.Val()} {
+		if len(earliest) == 0 {
+			continue
+		}
+		if due := time.Unix(int64(earliest[0].Score), 0); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next, nil
+}
+
+// SetDeadline 休眠截止时间保存在 <队列>:wakeup_at, 其他节点添加任务时也能唤醒当前节点
+func (s *redisDelayQueue) SetDeadline(ctx context.Context, deadline time.Time, ttl time.Duration) error {
+	return s.opts.Redis.Set(ctx, wakeupAtKey(s.queue), deadline.Unix(), ttl).Err()
+}
+
+// Wakeup 订阅 <队列>:wakeup
+func (s *redisDelayQueue) Wakeup(ctx context.Context) <-chan struct{} {
+	wakeup := make(chan struct{}, 1)
+	sub := s.opts.Redis.Subscribe(ctx, wakeupChannel(s.queue))
+	go func() {
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				s.opts.Logger.Debugf("delay job '%s' woken up by job due at %s", s.queue, msg.Payload)
+				select {
+				case wakeup <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return wakeup
+}
+
+// notifyWakeup 任务执行时间早于队列所属节点的休眠截止时间时唤醒该节点
+func (s *redisDelayQueue) notifyWakeup(ctx context.Context, queue string, at time.Time) {
+	if err := wakeupScript.Run(ctx, s.opts.Redis, []string{wakeupAtKey(queue)},
+		at.Unix(), wakeupChannel(queue)).Err(); err != nil {
+		s.opts.Logger.Warnf("notify delay job '%s' wakeup fail[%s]", queue, err.Error())
+	}
+}
+
+// Maintain 更新心跳, 迁移升级前的任务, 处理已下线节点的任务
+func (s *redisDelayQueue) Maintain(ctx context.Context, interval time.Duration, limit int64) {
+	s.heartbeat(ctx)
+	s.migrateLegacy(ctx, limit)
+	s.checkStaleHosts(ctx, interval)
+}
+
+// hosts 所有节点, 当前节点排在第一个
+func (s *redisDelayQueue) hosts(ctx context.Context) ([]string, error) {
+	hosts, err := s.opts.Redis.ZRange(ctx, s.hostsKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := []string{s.host}
+	for _, host := range hosts {
+		if host != s.host {
+			result = append(result, host)
+		}
+	}
+	return result, nil
+}
+
+// Stats .
+func (s *redisDelayQueue) Stats(ctx context.Context) (*DelayJobStats, error) {
+	hosts, err := s.hosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := s.opts.now().Unix()
+	stats := &DelayJobStats{}
+	for _, host := range hosts {
+		queue := hostQueue(s.base, host)
+		pipe := s.opts.Redis.Pipeline()
+		queued := pipe.ZCard(ctx, queue)
+		processing := pipe.ZCard(ctx, processingKey(queue))
+		oldest := pipe.ZRangeWithScores(ctx, queue, 0, 0)
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+		queueStats := &DelayJobQueueStats{Host: host, Queued: queued.Val(), Processing: processing.Val()}
+		if len(oldest.Val()) > 0 {
+			queueStats.OldestDue = int64(oldest.Val()[0].Score)
+			if lag := now - queueStats.OldestDue; lag > 0 {
+				queueStats.LagSeconds = lag
+			}
+		}
+		stats.Queues = append(stats.Queues, queueStats)
+	}
+	stats.DeadLetters, err = s.opts.Redis.ZCard(ctx, s.deadLetterQueue()).Result()
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// List .
+func (s *redisDelayQueue) List(ctx context.Context, filter *DelayJobFilter) ([]*DelayJobEntry, error) {
+	hosts := []string{filter.Host}
+	if filter.Host == "" {
+		var err error
+		if hosts, err = s.hosts(ctx); err != nil {
+			return nil, err
+		}
+	}
+	rangeBy := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !filter.From.IsZero() {
+		rangeBy.Min = strconv.FormatInt(filter.From.Unix(), 10)
+	}
+	if !filter.To.IsZero() {
+		rangeBy.Max = strconv.FormatInt(filter.To.Unix(), 10)
+	}
+	var entries []*DelayJobEntry
+	for _, host := range hosts {
+		queue := hostQueue(s.base, host)
+		for _, key := range []string{queue, processingKey(queue)} {
+			members, err := s.opts.Redis.ZRangeByScoreWithScores(ctx, key, rangeBy).Result()
+			if err != nil {
+				return nil, err
+			}
+			ids := make([]string, 0, len(members))
+			for _, member := range members {
+				id, _ := member.Member.(string)
+				ids = append(ids, id)
+			}
+			jobs, err := s.loadJobs(ctx, queue, ids)
+			if err != nil {
+				return nil, err
+			}
+			for i, member := range members {
+				job := jobs[i]
+				if !matchDelayJob(job, filter.Prefix) {
+					continue
+				}
+				entries = append(entries, &DelayJobEntry{
+					Host:       host,
+					Job:        job,
+					DueAt:      int64(member.Score),
+					Processing: key != queue,
+				})
+				if filter.Limit > 0 && int64(len(entries)) >= filter.Limit {
+					return entries, nil
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Reschedule 只修改队列中的任务, 修改后唤醒所属节点
+func (s *redisDelayQueue) Reschedule(ctx context.Context, id string, at time.Time) (string, error) {
+	hosts, err := s.hosts(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, host := range hosts {
+		updated, err := s.opts.Redis.ZAddXXCh(ctx, hostQueue(s.base, host),
+			&redis.Z{Score: float64(at.Unix()), Member: id}).Result()
+		if err != nil {
+			return "", err
+		}
+		if updated > 0 {
+			s.notifyWakeup(ctx, hostQueue(s.base, host), at)
+			return host, nil
+		}
+		// 执行时间没有变化时ZADD返回0, 需要确认任务是否存在
+		if _, err := s.opts.Redis.ZScore(ctx, hostQueue(s.base, host), id).Result(); err == nil {
+			return host, nil
+		}
+	}
+	return "", newError(ErrNotFound, "delay_job.reschedule", "job '%s' not found", id)
+}
@@ -0,0 +1,337 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedisDelayJob(t *testing.T, mr *miniredis.Miniredis, host string, clock Clock, config mapConfig) (*StorageDelayJob, *redisDelayQueue) {
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { cli.Close() })
+	job, err := NewStorageDelayJobWithOptions(&Options{
+		UploadPath: t.TempDir(),
+		Hostname:   host,
+		Redis:      cli,
+		Config:     config,
+		Clock:      clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job, job.queue.(*redisDelayQueue)
+}
+
+func TestRedisDelayQueueLease(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	_, queue := newTestRedisDelayJob(t, mr, "node1", nil, nil)
+	now := time.Now()
+	if err := queue.Add(ctx, NewDeleteFileJob("a"), now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, err := queue.Claim(ctx, now, now.Add(time.Minute), 10); err != nil || len(jobs) != 1 || jobs[0].Type != DJ_DELETE_FILE {
+		t.Fatalf("unexpected claim %v[%v]", jobs, err)
+	}
+	// 租约期间不能重复领取
+	if jobs, err := queue.Claim(ctx, now.Add(30*time.Second), now.Add(time.Minute), 10); err != nil || len(jobs) != 0 {
+		t.Fatalf("claimed during lease %v[%v]", jobs, err)
+	}
+	if next, err := queue.NextDue(ctx); err != nil || next.Unix() != now.Add(time.Minute).Unix() {
+		t.Fatalf("unexpected next due %s[%v]", next, err)
+	}
+	// 租约到期未确认的任务重新领取
+	later := now.Add(2 * time.Minute)
+	jobs, err := queue.Claim(ctx, later, later.Add(time.Minute), 10)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != "a" {
+		t.Fatalf("lease expired job not reclaimed %v[%v]", jobs, err)
+	}
+	if err := queue.Ack(ctx, jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := queue.NextDue(ctx); err != nil || !next.IsZero() {
+		t.Fatalf("acked job still queued %s[%v]", next, err)
+	}
+}
+
+func TestRedisDelayQueueAckReadded(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	_, queue := newTestRedisDelayJob(t, mr, "node1", nil, nil)
+	now := time.Now()
+	queue.Add(ctx, NewDeleteFileJob("a"), now.Add(-time.Second))
+	queue.Add(ctx, NewDeleteFileJob("b"), now.Add(-time.Second))
+	jobs, err := queue.Claim(ctx, now, now.Add(time.Minute), 10)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("unexpected claim %v[%v]", jobs, err)
+	}
+	// 处理期间重新添加, 确认后保留新的任务
+	readded := &DelayJob{ID: "a", Type: DJ_DELETE_DIR, Payload: []byte(`{"path":"a"}`)}
+	if err := queue.Add(ctx, readded, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		if err := queue.Ack(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := queue.List(ctx, &DelayJobFilter{})
+	if err != nil || len(entries) != 1 || entries[0].Job.ID != "a" || entries[0].Job.Type != DJ_DELETE_DIR ||
+		entries[0].DueAt != now.Add(time.Hour).Unix() {
+		t.Fatalf("unexpected jobs after ack %+v[%v]", entries, err)
+	}
+	if exists, _ := queue.opts.Redis.HExists(ctx, jobsKey(queue.queue), "b").Result(); exists {
+		t.Fatal("acked job content not deleted")
+	}
+}
+
+func TestRedisDelayQueueIdenticalReadded(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	_, queue := newTestRedisDelayJob(t, mr, "node1", nil, nil)
+	now := time.Now()
+	queue.Add(ctx, NewDeleteFileJob("a"), now.Add(-time.Second))
+	queue.Add(ctx, NewDeleteFileJob("b"), now.Add(-time.Second))
+	jobs, err := queue.Claim(ctx, now, now.Add(time.Minute), 10)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("unexpected claim %v[%v]", jobs, err)
+	}
+	// 处理期间添加内容相同的任务, 确认和重试后保留新的任务和执行时间
+	for _, job := range jobs {
+		if err := queue.Add(ctx, NewDeleteFileJob(job.ID), now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queue.Ack(ctx, jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Retry(ctx, jobs[1], now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := queue.List(ctx, &DelayJobFilter{})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("unexpected jobs after ack %+v[%v]", entries, err)
+	}
+	for _, entry := range entries {
+		if entry.Job.Type != DJ_DELETE_FILE || entry.DueAt != now.Add(time.Hour).Unix() {
+			t.Fatalf("readded job '%s' changed %+v", entry.Job.ID, entry)
+		}
+	}
+	if n, _ := queue.opts.Redis.ZCard(ctx, processingKey(queue.queue)).Result(); n != 0 {
+		t.Fatalf("%d jobs still processing", n)
+	}
+}
+
+func TestRedisDelayJobRetry(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	clock := &testClock{now: time.Now()}
+	job, queue := newTestRedisDelayJob(t, mr, "node1", clock, mapConfig{
+		"storage.delay_delete.max_attempts":  int64(3),
+		"storage.delay_delete.retry_backoff": "10s",
+	})
+	queue.Add(ctx, NewDeleteFileJob("a"), clock.now)
+	// 按指数退避重新放回队列
+	for attempts, backoff := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		jobs, err := job.claim(ctx, 10)
+		if err != nil || len(jobs) != 1 {
+			t.Fatalf("attempt %d unexpected claim %v[%v]", attempts+1, jobs, err)
+		}
+		job.fail(jobs[0], errors.New("fail"))
+		if score, err := queue.opts.Redis.ZScore(ctx, queue.queue, "a").Result(); err != nil || int64(score) != clock.now.Add(backoff).Unix() {
+			t.Fatalf("attempt %d retry at %v, want %s[%v]", attempts+1, score, backoff, err)
+		}
+		clock.now = clock.now.Add(backoff)
+	}
+	// 超过最大次数后放入死信
+	jobs, _ := job.claim(ctx, 10)
+	job.fail(jobs[0], errors.New("fail"))
+	deadLetters, err := job.DeadLetters(ctx)
+	if err != nil || len(deadLetters) != 1 || deadLetters[0].Job.ID != "a" || deadLetters[0].DueAt != clock.now.Unix() {
+		t.Fatalf("unexpected dead letters %+v[%v]", deadLetters, err)
+	}
+	if next, err := queue.NextDue(ctx); err != nil || !next.IsZero() {
+		t.Fatalf("buried job still queued %s[%v]", next, err)
+	}
+	if exists, _ := queue.opts.Redis.HExists(ctx, attemptsKey(queue.queue), "a").Result(); exists {
+		t.Fatal("attempts not cleared")
+	}
+
+	// 不能重试的错误直接放入死信
+	queue.Add(ctx, NewDeleteFileJob("b"), clock.now)
+	jobs, _ = job.claim(ctx, 10)
+	job.fail(jobs[0], permanent(errors.New("invalid")))
+	if deadLetters, _ := job.DeadLetters(ctx); len(deadLetters) != 2 {
+		t.Fatalf("permanent error not buried %+v", deadLetters)
+	}
+}
+
+func TestRedisDelayQueueStaleHosts(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	clock := &testClock{now: time.Now()}
+	_, offline := newTestRedisDelayJob(t, mr, "node2", clock, nil)
+	offline.Add(ctx, NewDeleteFileJob("a"), clock.now.Add(time.Hour))
+	offline.Add(ctx, NewDeleteFileJob("b"), clock.now.Add(-time.Second))
+	offline.Claim(ctx, clock.now, clock.now.Add(time.Minute), 1)
+
+	clock.now = clock.now.Add(25 * time.Hour)
+	job, queue := newTestRedisDelayJob(t, mr, "node1", clock, nil)
+	queue.heartbeat(ctx)
+	if stale, err := job.StaleHosts(ctx); err != nil || len(stale) != 1 || stale["node2"] != 2 {
+		t.Fatalf("unexpected stale hosts %v[%v]", stale, err)
+	}
+	// 默认只记录日志
+	queue.checkStaleHosts(ctx, time.Minute)
+	if entries, _ := queue.List(ctx, &DelayJobFilter{Host: "node2"}); len(entries) != 2 {
+		t.Fatalf("report policy moved jobs %+v", entries)
+	}
+
+	mr.Del(delayQueueTag(queue.base) + ":stale_hosts_lock")
+	job, queue = newTestRedisDelayJob(t, mr, "node1", clock, mapConfig{"storage.delay_delete.stale_host_policy": STALE_HOST_POLICY_REASSIGN})
+	queue.checkStaleHosts(ctx, time.Minute)
+	entries, err := queue.List(ctx, &DelayJobFilter{Host: "node1"})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("unexpected reassigned jobs %+v[%v]", entries, err)
+	}
+	for _, entry := range entries {
+		if entry.Job.Type != DJ_DELETE_FILE {
+			t.Fatalf("job content not moved %+v", entry.Job)
+		}
+	}
+	if stale, err := job.StaleHosts(ctx); err != nil || len(stale) != 0 {
+		t.Fatalf("reassigned host still stale %v[%v]", stale, err)
+	}
+	// 所有key使用同一个hash tag, redis cluster中脚本不会跨slot
+	for _, key := range mr.Keys() {
+		if !strings.HasPrefix(key, delayQueueTag(queue.base)+":") {
+			t.Fatalf("key '%s' without hash tag", key)
+		}
+	}
+}
+
+// txSlotHook 记录事务和多key命令中key的hash tag, redis cluster中这些key需要在同一个slot
+type txSlotHook struct {
+	crossSlot []string
+}
+
+// keyHashTag key的hash tag, 没有时为整个key
+func keyHashTag(key string) string {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start:], "}"); end > 1 {
+			return key[start : start+end+1]
+		}
+	}
+	return key
+}
+
+func (h *txSlotHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() != "del" || len(cmd.Args()) < 3 {
+		return ctx, nil
+	}
+	tags := map[string]bool{}
+	for _, arg := range cmd.Args()[1:] {
+		key, _ := arg.(string)
+		tags[keyHashTag(key)] = true
+	}
+	if len(tags) > 1 {
+		for tag := range tags {
+			h.crossSlot = append(h.crossSlot, tag)
+		}
+	}
+	return ctx, nil
+}
+
+func (h *txSlotHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *txSlotHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if len(cmds) == 0 || cmds[0].Name() != "multi" {
+		return ctx, nil
+	}
+	tags := map[string]bool{}
+	for _, cmd := range cmds {
+		if cmd.Name() == "multi" || cmd.Name() == "exec" || len(cmd.Args()) < 2 {
+			continue
+		}
+		key, _ := cmd.Args()[1].(string)
+		tags[keyHashTag(key)] = true
+	}
+	if len(tags) > 1 {
+		for tag := range tags {
+			h.crossSlot = append(h.crossSlot, tag)
+		}
+	}
+	return ctx, nil
+}
+
+func (h *txSlotHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestRedisDelayQueueRemove(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	_, other := newTestRedisDelayJob(t, mr, "node2", nil, nil)
+	_, queue := newTestRedisDelayJob(t, mr, "node1", nil, nil)
+	hook := &txSlotHook{}
+	queue.opts.Redis.AddHook(hook)
+	now := time.Now()
+	queue.Add(ctx, NewDeleteFileJob("a"), now.Add(time.Hour))
+	other.Add(ctx, NewDeleteFileJob("a"), now.Add(time.Hour))
+	// 升级前共用队列中的任务
+	mr.ZAdd(queue.base, float64(now.Unix()), "a")
+
+	if err := queue.Remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"node1", "node2"} {
+		if entries, err := queue.List(ctx, &DelayJobFilter{Host: host}); err != nil || len(entries) != 0 {
+			t.Fatalf("job not removed from '%s' %+v[%v]", host, entries, err)
+		}
+	}
+	if mr.Exists(queue.base) {
+		t.Fatal("job not removed from legacy queue")
+	}
+	if len(hook.crossSlot) > 0 {
+		t.Fatalf("transaction across hash tags %v", hook.crossSlot)
+	}
+}
+
+func TestRedisDelayJobStopWaitsForJob(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	job, queue := newTestRedisDelayJob(t, mr, "node1", nil, nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	var jobErr error
+	RegisterDelayJobHandler("test_stop", func(ctx context.Context, job *DelayJob) error {
+		close(started)
+		<-release
+		jobErr = ctx.Err()
+		return jobErr
+	})
+	queue.Add(ctx, &DelayJob{ID: "a", Type: "test_stop"}, time.Now().Add(-time.Second))
+	job.Start(ctx)
+	<-started
+	// Stop不取消已领取的任务
+	stopped := make(chan struct{})
+	go func() {
+		job.Stop()
+		close(stopped)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	<-stopped
+	if jobErr != nil {
+		t.Fatalf("job canceled by stop[%v]", jobErr)
+	}
+	if entries, err := queue.List(ctx, &DelayJobFilter{}); err != nil || len(entries) != 0 {
+		t.Fatalf("job not acked %+v[%v]", entries, err)
+	}
+}
@@ -0,0 +1,250 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// DelayJobType 延迟任务类型
+type DelayJobType string
+
+// const .
+const (
+	DJ_DELETE_FILE      DelayJobType = "delete_file"      // 删除文件
+	DJ_DELETE_DIR       DelayJobType = "delete_dir"       // 删除目录
+	DJ_EXPIRE_MULTIPART DelayJobType = "expire_multipart" // 删除分片上传元数据
+	DJ_UNPUBLISH        DelayJobType = "unpublish"        // 删除cdn资源
+	DJ_WEBHOOK          DelayJobType = "webhook"          // 回调
+)
+
+// DelayJob 延迟任务
+type DelayJob struct {
+	// 任务ID, 相同ID的任务只保留最后添加的一个
+	ID   string       `json:"id"`
+	Type DelayJobType `json:"type"`
+	// 任务参数, 由对应的Handler解析
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// 领取时的任务版本, Ack和Retry时只处理领取后没有重新添加的任务
+	claimed string
+}
+
+// DeleteFilePayload 删除文件
+type DeleteFilePayload struct {
+	Path string `json:"path"`
+}
+
+// DeleteDirPayload 删除目录
+type DeleteDirPayload struct {
+	Path string `json:"path"`
+}
+
+// ExpireMultipartPayload 删除分片上传元数据
+type ExpireMultipartPayload struct {
+	UploadId string `json:"upload_id"`
+}
+
+// UnpublishPayload 删除cdn资源
+type UnpublishPayload struct {
+	ResourceType ResourceType `json:"resource_type"`
+	// 相对资源类型目录的路径
+	Path string `json:"path"`
+}
+
+// WebhookPayload 回调
+type WebhookPayload struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// NewDelayJob 创建延迟任务
+// dedupKey不为空时任务ID由类型和dedupKey组成, 重复添加会覆盖之前的任务
+func NewDelayJob(jobType DelayJobType, dedupKey string, payload interface{}) (*DelayJob, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%s:%s", jobType, dedupKey)
+	if dedupKey == "" {
+		id = fmt.Sprintf("%s:%s", jobType, uuid.NewString())
+	}
+	return &DelayJob{ID: id, Type: jobType, Payload: data}, nil
+}
+
+// NewDeleteFileJob 删除文件任务, 任务ID即文件路径, 兼容只保存文件路径的旧任务
+func NewDeleteFileJob(filePath string) *DelayJob {
+	data, _ := json.Marshal(&DeleteFilePayload{Path: filePath})
+	return &DelayJob{ID: filePath, Type: DJ_DELETE_FILE, Payload: data}
+}
+
+// legacyDeleteFileJob 升级前的任务只保存了文件路径, 只有上传目录下的路径按删除文件处理
+// 其他没有内容的任务没有类型, 执行失败后放入死信
+func legacyDeleteFileJob(id, uploadRoot string) *DelayJob {
+	path, err := filepath.Abs(id)
+	if err != nil || uploadRoot == "" {
+		return &DelayJob{ID: id}
+	}
+	root, err := filepath.Abs(uploadRoot)
+	if err != nil || path == root || !isSubPath(path, root) {
+		return &DelayJob{ID: id}
+	}
+	return NewDeleteFileJob(id)
+}
+
+// DelayJobHandler 延迟任务处理, 返回错误时按退避策略重试
+// 删除路径不在允许的根目录下等无法通过重试解决的错误直接放入死信集合
+type DelayJobHandler func(ctx context.Context, job *DelayJob) error
+
+var (
+	delayJobHandlersMu sync.RWMutex
+	delayJobHandlers   = map[DelayJobType]DelayJobHandler{}
+)
+
+// RegisterDelayJobHandler 注册延迟任务处理, 重复注册会覆盖
+func RegisterDelayJobHandler(jobType DelayJobType, handler DelayJobHandler) {
+	delayJobHandlersMu.Lock()
+	defer delayJobHandlersMu.Unlock()
+	delayJobHandlers[jobType] = handler
+}
+
+func delayJobHandler(jobType DelayJobType) (DelayJobHandler, bool) {
+	delayJobHandlersMu.RLock()
+	defer delayJobHandlersMu.RUnlock()
+	handler, ok := delayJobHandlers[jobType]
+	return handler, ok
+}
+
+func init() {
+	RegisterDelayJobHandler(DJ_DELETE_FILE, deleteFileHandler)
+	RegisterDelayJobHandler(DJ_DELETE_DIR, deleteDirHandler)
+	RegisterDelayJobHandler(DJ_EXPIRE_MULTIPART, expireMultipartHandler)
+	RegisterDelayJobHandler(DJ_UNPUBLISH, unpublishHandler)
+	RegisterDelayJobHandler(DJ_WEBHOOK, webhookHandler)
+}
+
+func deleteFileHandler(ctx context.Context, job *DelayJob) error {
+	var payload DeleteFilePayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return permanent(err)
+	}
+	opts, err := optionsFromContext(ctx)
+	if err != nil {
+		return permanent(err)
+	}
+	return removePublished(ctx, opts, payload.Path, deleteRoots(opts))
+}
+
+func deleteDirHandler(ctx context.Context, job *DelayJob) error {
+	var payload DeleteDirPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return permanent(err)
+	}
+	if !isExist(payload.Path) {
+		return nil
+	}
+	if err := isDir(payload.Path); err != nil {
+		return permanent(err)
+	}
+	opts, err := optionsFromContext(ctx)
+	if err != nil {
+		return permanent(err)
+	}
+	return removePublished(ctx, opts, payload.Path, deleteRoots(opts))
+}
+
+func expireMultipartHandler(ctx context.Context, job *DelayJob) error {
+	var payload ExpireMultipartPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return permanent(err)
+	}
+	opts, err := optionsFromContext(ctx)
+	if err != nil {
+		return permanent(err)
+	}
+	if opts.Metadata == nil {
+		return permanent(fmt.Errorf("expire multipart '%s' fail[metadata store not set]", payload.UploadId))
+	}
+	if err := opts.Metadata.DeleteUpload(ctx, payload.UploadId); err != nil {
+		return err
+	}
+	opts.releaseMultipart(ctx, payload.UploadId)
+	return nil
+}
+
+func unpublishHandler(ctx context.Context, job *DelayJob) error {
+	var payload UnpublishPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return permanent(err)
+	}
+	opts, err := optionsFromContext(ctx)
+	if err != nil {
+		return permanent(err)
+	}
+	cdnDir, err := opts.cdnFilePath(payload.ResourceType)
+	if err != nil {
+		return permanent(err)
+	}
+	rel := filepath.Clean("/" + payload.Path)
+	if rel == string(filepath.Separator) {
+		// 路径为空时不能删除整个资源类型目录
+		return permanent(fmt.Errorf("unpublish '%s' fail[empty path]", payload.Path))
+	}
+	root := filepath.Clean(cdnDir)
+	path := filepath.Join(root, rel)
+	if path == root || !isSubPath(path, root) {
+		return permanent(fmt.Errorf("unpublish '%s' fail[path not under '%s']", payload.Path, cdnDir))
+	}
+	return removePublished(ctx, opts, path, cdnRoots(opts))
+}
+
+func webhookHandler(ctx context.Context, job *DelayJob) error {
+	var payload WebhookPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return permanent(err)
+	}
+	opts, err := optionsFromContext(ctx)
+	if err != nil {
+		return permanent(err)
+	}
+	u, err := url.Parse(payload.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return permanent(fmt.Errorf("invalid webhook url '%s'", payload.URL))
+	}
+	settings := opts.settings().Webhook
+	// 没有配置允许的host时不执行回调, 不允许跳转
+	fetcher := &urlFetcher{allowHosts: settings.AllowHosts, allowPrivate: settings.AllowPrivate, timeout: settings.Timeout}
+	if len(fetcher.allowHosts) == 0 || !fetcher.hostAllowed(u.Hostname(), u.Hostname()) {
+		return permanent(fmt.Errorf("webhook host '%s' not allowed", u.Hostname()))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, payload.URL, bytes.NewReader(payload.Body))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range payload.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := fetcher.client(u.Hostname()).Do(req)
+	if err != nil {
+		var e *Error
+		if errors.As(err, &e) && e.Kind == ErrInvalidArgument {
+			// 解析到内网地址或者跳转, 重试也不会成功
+			return permanent(err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook '%s' response %s", payload.URL, resp.Status)
+	}
+	return nil
+}
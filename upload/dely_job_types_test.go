@@ -0,0 +1,102 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnpublishHandlerPath(t *testing.T) {
+	opts, _ := (&Options{RootPath: t.TempDir()}).withDefaults()
+	cdnDir, err := opts.cdnFilePath(RT_GAME_ICON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(cdnDir, "a.png")
+	if err := os.MkdirAll(cdnDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := withOptions(context.Background(), opts)
+
+	// 路径为空时不能删除整个资源类型目录
+	for _, path := range []string{"", "/", ".", "../", "a/.."} {
+		job, _ := NewDelayJob(DJ_UNPUBLISH, "", &UnpublishPayload{ResourceType: RT_GAME_ICON, Path: path})
+		if err := unpublishHandler(ctx, job); !isPermanent(err) {
+			t.Fatalf("path '%s' want permanent error, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Fatalf("published file removed[%v]", err)
+	}
+
+	job, _ := NewDelayJob(DJ_UNPUBLISH, "", &UnpublishPayload{ResourceType: RT_GAME_ICON, Path: "../../a.png"})
+	if err := unpublishHandler(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatalf("file '%s' not deleted[%v]", filePath, err)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	called := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host := u.Hostname()
+	job, _ := NewDelayJob(DJ_WEBHOOK, "", &WebhookPayload{URL: server.URL + "/hook"})
+
+	for name, cfg := range map[string]mapConfig{
+		"no allow hosts":   {"storage.webhook.allow_private": true},
+		"host not allowed": {"storage.webhook.allow_hosts": "example.com", "storage.webhook.allow_private": true},
+		"private ip":       {"storage.webhook.allow_hosts": host},
+	} {
+		opts, _ := (&Options{Config: cfg}).withDefaults()
+		ctx := withOptions(context.Background(), opts)
+		if err := webhookHandler(ctx, job); !isPermanent(err) {
+			t.Fatalf("%s: want permanent error, got %v", name, err)
+		}
+	}
+	if called != 0 {
+		t.Fatalf("refused webhook called %d times", called)
+	}
+
+	cfg := mapConfig{"storage.webhook.allow_hosts": host, "storage.webhook.allow_private": true}
+	opts, _ := (&Options{Config: cfg}).withDefaults()
+	ctx := withOptions(context.Background(), opts)
+	if err := webhookHandler(ctx, job); err != nil || called != 1 {
+		t.Fatalf("webhook not called %d[%v]", called, err)
+	}
+}
+
+func TestUnpublishHandlerCustomCdnRoot(t *testing.T) {
+	cdnRoot := t.TempDir()
+	types := NewDefaultResourceTypeRegistry()
+	if err := types.Register(ResourceTypeDef{ID: 100, Name: "custom", Dir: "/custom", CdnRoot: cdnRoot}); err != nil {
+		t.Fatal(err)
+	}
+	opts, _ := (&Options{RootPath: t.TempDir(), ResourceTypes: types}).withDefaults()
+	filePath := filepath.Join(cdnRoot, "custom", "a.png")
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	job, _ := NewDelayJob(DJ_UNPUBLISH, "", &UnpublishPayload{ResourceType: 100, Path: "a.png"})
+	if err := unpublishHandler(withOptions(context.Background(), opts), job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatalf("file '%s' not deleted[%v]", filePath, err)
+	}
+}
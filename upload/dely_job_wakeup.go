@@ -0,0 +1,60 @@
+package upload
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// 后台任务休眠到队列中最早的任务到期, 休眠时间限制在[min_interval, interval]之间并加入随机抖动
+// 添加的任务早于休眠截止时间时由队列存储唤醒, redis通过pub/sub跨节点唤醒
+
+// nextWait 距离下一个任务到期的时间
+func (s *StorageDelayJob) nextWait(ctx context.Context) time.Duration {
+	wait := s.sweepInterval()
+	// 处理中的任务租约到期后需要重新领取
+	next, err := s.queue.NextDue(ctx)
+	if err != nil {
+		s.opts.Logger.Errorf("fetch delay job '%s' next due fail[%s]", s.queue.Name(), err.Error())
+	}
+	if !next.IsZero() {
+		if due := next.Sub(s.opts.now()); due < wait {
+			wait = due
+		}
+	}
+	if minWait := s.minInterval(); wait < minWait {
+		wait = minWait
+	}
+	if jitter := s.jitter(); jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return wait
+}
+
+// sleep 休眠到下一个任务到期, 被唤醒或ctx取消时提前返回
+// 返回nil表示休眠结束, 否则为立即扫描的请求
+func (s *StorageDelayJob) sleep(ctx context.Context, wakeup <-chan struct{}) chan struct{} {
+	wait := s.nextWait(ctx)
+	if err := s.queue.SetDeadline(ctx, s.opts.now().Add(wait), wait+s.sweepInterval()); err != nil {
+		s.opts.Logger.Warnf("set delay job '%s' wakeup deadline fail[%s]", s.queue.Name(), err.Error())
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-wakeup:
+		s.opts.Logger.Debugf("delay job '%s' woken up", s.queue.Name())
+	case reply := <-s.sweepReq:
+		return reply
+	}
+	return nil
+}
+
+func (s *StorageDelayJob) minInterval() time.Duration {
+	return s.opts.settings().DelayJob.MinInterval
+}
+
+func (s *StorageDelayJob) jitter() time.Duration {
+	return s.opts.settings().DelayJob.Jitter
+}
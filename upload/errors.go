@@ -0,0 +1,139 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// 上传存储返回的错误类型, 使用 errors.Is 判断
+var (
+	// ErrNotFound 文件或分片上传不存在
+	ErrNotFound = errors.New("not found")
+	// ErrTooLarge 超过资源类型的大小限制
+	ErrTooLarge = errors.New("too large")
+	// ErrUnsupportedType 资源类型或文件类型不支持
+	ErrUnsupportedType = errors.New("unsupported type")
+	// ErrChecksumMismatch 文件内容与客户端提供的md5不一致
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrIncomplete 分片不全或者文件大小与计划不一致
+	ErrIncomplete = errors.New("incomplete")
+	// ErrExpired 暂存文件或签名已过期
+	ErrExpired = errors.New("expired")
+	// ErrInvalidArgument 其他不合法的请求参数
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrQuotaExceeded 超过租户或资源类型的配额
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrUpstream 请求远程地址失败或者返回错误
+	ErrUpstream = errors.New("upstream error")
+)
+
+// Error 上传存储的错误, 使用 errors.As 获取
+// Message 可以返回给调用方, Err 为原始错误只用于日志
+type Error struct {
+	// Kind 错误类型, 为空时是内部错误
+	Kind error
+	// Op 出错的操作
+	Op      string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s fail[%s]", msg, e.Err.Error())
+	}
+	if e.Op != "" {
+		msg = e.Op + ": " + msg
+	}
+	return msg
+}
+
+// Is errors.Is(err, ErrNotFound) 等按错误类型判断
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError 创建指定类型的错误
+func newError(kind error, op string, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Op: op, Message: fmt.Sprintf(format, args...)}
+}
+
+// internalError 内部错误, 返回给调用方时隐藏详情
+func internalError(op string, err error, format string, args ...interface{}) *Error {
+	return &Error{Op: op, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// upstreamError 远程地址的错误, 返回给调用方时隐藏原始错误
+func upstreamError(op string, err error, format string, args ...interface{}) *Error {
+	return &Error{Kind: ErrUpstream, Op: op, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+type errorMapping struct {
+	kind       error
+	httpStatus int
+	// message 没有可以返回的错误信息时使用, 为空时使用kind的错误信息
+	message string
+}
+
+// errorMappings grpc状态码见 pbadapter
+var errorMappings = []errorMapping{
+	{ErrNotFound, http.StatusNotFound, ""},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge, ""},
+	{ErrUnsupportedType, http.StatusUnsupportedMediaType, ""},
+	{ErrChecksumMismatch, http.StatusBadRequest, ""},
+	{ErrIncomplete, http.StatusConflict, ""},
+	{ErrExpired, http.StatusGone, ""},
+	{ErrInvalidArgument, http.StatusBadRequest, ""},
+	{ErrQuotaExceeded, http.StatusInsufficientStorage, ""},
+	{context.Canceled, http.StatusRequestTimeout, "canceled"},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, "deadline exceeded"},
+	// 在ctx之后, 取消或超时导致的远程请求失败按取消或超时处理
+	{ErrUpstream, http.StatusBadGateway, ""},
+}
+
+func errorMappingOf(err error) (errorMapping, bool) {
+	for _, mapping := range errorMappings {
+		if errors.Is(err, mapping.kind) {
+			return mapping, true
+		}
+	}
+	return errorMapping{}, false
+}
+
+// HTTPStatus 错误对应的http状态码, 未知错误为500
+func HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	if mapping, ok := errorMappingOf(err); ok {
+		return mapping.httpStatus
+	}
+	return http.StatusInternalServerError
+}
+
+// PublicMessage 可以返回给调用方的错误信息, 内部错误只返回 internal server error
+// 只返回同一类型的Error.Message或者固定的信息, 完整的错误信息使用 err.Error() 记录日志
+func PublicMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	mapping, ok := errorMappingOf(err)
+	if !ok {
+		return "internal server error"
+	}
+	var e *Error
+	if errors.As(err, &e) && e.Kind == mapping.kind && e.Message != "" {
+		return e.Message
+	}
+	if mapping.message != "" {
+		return mapping.message
+	}
+	return mapping.kind.Error()
+}
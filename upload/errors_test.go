@@ -0,0 +1,54 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestErrorKind(t *testing.T) {
+	err := fmt.Errorf("done fail[%w]", newError(ErrIncomplete, "multipart.done", "upload '%s' chunks not enough", "u1"))
+	if !errors.Is(err, ErrIncomplete) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected kind %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Op != "multipart.done" {
+		t.Fatalf("unexpected error %+v", e)
+	}
+	if HTTPStatus(err) != http.StatusConflict {
+		t.Fatalf("unexpected mapping %d", HTTPStatus(err))
+	}
+	if PublicMessage(err) != "upload 'u1' chunks not enough" {
+		t.Fatalf("unexpected message '%s'", PublicMessage(err))
+	}
+}
+
+func TestInternalError(t *testing.T) {
+	cause := errors.New("disk full")
+	err := internalError("multipart.done", cause, "merge chunk '%s'", "a.zip")
+	if !errors.Is(err, cause) {
+		t.Fatal("cause lost")
+	}
+	if err.Error() != "multipart.done: merge chunk 'a.zip' fail[disk full]" {
+		t.Fatalf("unexpected detail '%s'", err.Error())
+	}
+	// 内部错误的详情只用于日志
+	if HTTPStatus(err) != http.StatusInternalServerError || PublicMessage(err) != "internal server error" {
+		t.Fatalf("unexpected mapping %d '%s'", HTTPStatus(err), PublicMessage(err))
+	}
+	// 原因是ctx取消时按取消处理
+	canceled := internalError("storage.upload", context.Canceled, "save file")
+	if HTTPStatus(canceled) != http.StatusRequestTimeout || PublicMessage(canceled) != "canceled" {
+		t.Fatalf("unexpected mapping %d '%s'", HTTPStatus(canceled), PublicMessage(canceled))
+	}
+	// 没有信息时返回固定的信息, 不返回包含路径的 err.Error()
+	fetch := fmt.Errorf("fetch '/data/a.png': %w", context.DeadlineExceeded)
+	if PublicMessage(fetch) != "deadline exceeded" || PublicMessage(&Error{Kind: ErrNotFound, Op: "storage.get"}) != "not found" {
+		t.Fatalf("unexpected message '%s'", PublicMessage(fetch))
+	}
+	if HTTPStatus(nil) != http.StatusOK || PublicMessage(nil) != "" {
+		t.Fatal("nil error mapped")
+	}
+}
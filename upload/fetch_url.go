@@ -0,0 +1,226 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 按后缀校验文件内容类型, 未列出的后缀不校验
+var suffixContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".zip":  "application/zip",
+}
+
+// cgnatNet 运营商级NAT共享地址, net.IP.IsPrivate 不包含
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// urlFetcher 下载远程文件
+type urlFetcher struct {
+	// 允许访问和跳转的host, 为空时只允许访问原始host
+	allowHosts []string
+	// 是否允许访问内网地址
+	allowPrivate bool
+	maxRedirects int
+	timeout      time.Duration
+}
+
+func newURLFetcher(opts *Options) *urlFetcher {
+	settings := opts.settings().Fetch
+	return &urlFetcher{
+		allowHosts:   settings.AllowHosts,
+		allowPrivate: settings.AllowPrivate,
+		maxRedirects: int(settings.MaxRedirects),
+		timeout:      settings.Timeout,
+	}
+}
+
+func (f *urlFetcher) hostAllowed(origin, host string) bool {
+	host = strings.ToLower(host)
+	if len(f.allowHosts) == 0 {
+		return host == strings.ToLower(origin)
+	}
+	for _, allowHost := range f.allowHosts {
+		if host == allowHost {
+			return true
+		}
+	}
+	return false
+}
+
+// 建立连接时校验解析后的ip, 防止通过域名访问内网
+func (f *urlFetcher) dialControl(network, address string, c syscall.RawConn) error {
+	if f.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return newError(ErrInvalidArgument, "storage.fetch_url", "invalid ip '%s'", host)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || cgnatNet.Contains(ip) {
+		return newError(ErrInvalidArgument, "storage.fetch_url", "private ip '%s' not allowed", host)
+	}
+	return nil
+}
+
+func (f *urlFetcher) client(origin string) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: f.dialControl}
+	return &http.Client{
+		Timeout: f.timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= f.maxRedirects {
+				return newError(ErrInvalidArgument, "storage.fetch_url", "stopped after %d redirects", f.maxRedirects)
+			}
+			if !f.hostAllowed(origin, req.URL.Hostname()) {
+				return newError(ErrInvalidArgument, "storage.fetch_url", "redirect to host '%s' not allowed", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+}
+
+// UploadFromURL 下载远程文件到上传路径
+// 与Upload一样需要调用UploadAndRename, 否则一段时间后文件将会被删除
+// resourceType只用于本次下载, 不修改Storage的资源类型
+func (s *Storage) UploadFromURL(ctx context.Context, rawURL string, resourceType ResourceType) (string, error) {
+	def, ok := s.opts.ResourceTypes.Lookup(resourceType)
+	if !ok {
+		return "", newError(ErrUnsupportedType, "storage.fetch_url", "invalid resource_type '%d'", resourceType)
+	}
+	storage := *s
+	storage.resourceType = resourceType
+	storage.cdnPath = s.opts.cdnRoot(def)
+	return storage.uploadFromURL(ctx, rawURL)
+}
+
+func (s *Storage) uploadFromURL(ctx context.Context, rawURL string) (string, error) {
+	if err := s.uploadableValid(); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", newError(ErrInvalidArgument, "storage.fetch_url", "invalid url '%s'", rawURL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", newError(ErrInvalidArgument, "storage.fetch_url", "unsupport url scheme '%s'", u.Scheme)
+	}
+	fetcher := s.urlFetcher
+	if fetcher == nil {
+		fetcher = newURLFetcher(s.opts)
+	}
+	if !fetcher.hostAllowed(u.Hostname(), u.Hostname()) {
+		return "", newError(ErrInvalidArgument, "storage.fetch_url", "host '%s' not allowed", u.Hostname())
+	}
+	fileName := path.Base(u.Path)
+	if err := s.uploadSuffixValidByName(fileName); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := fetcher.client(u.Hostname()).Do(req)
+	if err != nil {
+		s.opts.Logger.Errorf("fetch url '%s' fail[%s]", rawURL, err.Error())
+		var e *Error
+		if errors.As(err, &e) && e.Kind == ErrInvalidArgument {
+			// 跳转或者连接的地址不允许访问
+			return "", newError(ErrInvalidArgument, "storage.fetch_url", "fetch url '%s' refused[%s]", rawURL, e.Message)
+		}
+		return "", upstreamError("storage.fetch_url", err, "fetch url '%s'", rawURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", newError(ErrNotFound, "storage.fetch_url", "fetch url '%s' fail[%s]", rawURL, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", newError(ErrUpstream, "storage.fetch_url", "fetch url '%s' fail[%s]", rawURL, resp.Status)
+	}
+	sizeLimit := s.uploadSizeLimit()
+	if resp.ContentLength > sizeLimit {
+		return "", newError(ErrTooLarge, "storage.fetch_url", "upload size exceed limit(%d, %d)", resp.ContentLength, sizeLimit)
+	}
+	// 与Upload一样只检查配额, 发布时按cdn文件大小占用, 长度未知时下载后按实际大小检查
+	if resp.ContentLength > 0 {
+		if err := s.quotaValid(ctx, "storage.fetch_url", resp.ContentLength); err != nil {
+			return "", err
+		}
+	}
+
+	uploadPath := s.uploadFullPathByName(fileName)
+	tmpFile, err := os.CreateTemp(filepath.Dir(uploadPath), filepath.Base(uploadPath)+".fetch_*")
+	if err != nil {
+		s.opts.Logger.Errorf("create file '%s' fail[%s]", uploadPath, err.Error())
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	written, err := s.saveFetched(tmpFile, resp.Body, fileName, sizeLimit)
+	if err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if written != resp.ContentLength {
+		if err := s.quotaValid(ctx, "storage.fetch_url", written); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmpFile.Name(), uploadPath); err != nil {
+		s.opts.Logger.Errorf("rename file '%s' to '%s' fail[%s]", tmpFile.Name(), uploadPath, err.Error())
+		return "", err
+	}
+	// 添加延迟任务删除临时文件
+	s.delayDelete(ctx, uploadPath)
+	return fmt.Sprintf("%s?v=%s&where=upload", s.fileName(fileName), s.version), nil
+}
+
+// 保存下载内容, 校验大小和内容类型, 返回写入的字节数
+func (s *Storage) saveFetched(dst io.Writer, body io.Reader, fileName string, sizeLimit int64) (int64, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	head = head[:n]
+	suffix := strings.ToLower(filepath.Ext(fileName))
+	if want, ok := suffixContentTypes[suffix]; ok {
+		if contentType := http.DetectContentType(head); !strings.HasPrefix(contentType, want) {
+			return 0, newError(ErrUnsupportedType, "storage.fetch_url", "file content type '%s' not match suffix '%s'", contentType, suffix)
+		}
+	}
+	if _, err := dst.Write(head); err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(dst, io.LimitReader(body, sizeLimit-int64(n)+1))
+	if err != nil {
+		return 0, err
+	}
+	if int64(n)+written > sizeLimit {
+		return 0, newError(ErrTooLarge, "storage.fetch_url", "upload size exceed limit(%d, %d)", int64(n)+written, sizeLimit)
+	}
+	return int64(n) + written, nil
+}
@@ -0,0 +1,189 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var pngContent = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+
+func newFetchTestStorage(t *testing.T, fetcher *urlFetcher) *Storage {
+	// 延迟任务写入失败只记录日志
+	storage, err := NewStorageWithOptions(RT_GAME_ICON, "", &Options{
+		UploadPath: t.TempDir(),
+		Redis:      redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond, MaxRetries: -1}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.urlFetcher = fetcher
+	return storage
+}
+
+func TestUploadFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/icon.png":
+			w.Write(pngContent)
+		case "/redirect.png":
+			http.Redirect(w, r, "http://example.invalid/icon.png", http.StatusFound)
+		case "/loop.png":
+			http.Redirect(w, r, "/icon.png", http.StatusFound)
+		case "/fake.png":
+			w.Write([]byte("<html>not an image</html>"))
+		case "/error.png":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "/chunked.png":
+			// 不返回Content-Length
+			w.(http.Flusher).Flush()
+			w.Write(pngContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := mustHostname(t, server.URL)
+
+	t.Run("ok", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, allowPrivate: true, timeout: time.Second})
+		uploadPath, err := storage.UploadFromURL(context.Background(), server.URL+"/icon.png", RT_GAME_ICON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(uploadPath, "&where=upload") {
+			t.Fatalf("unexpected upload path '%s'", uploadPath)
+		}
+		content, err := os.ReadFile(filepath.Join(storage.uploadPath, storage.parse(uploadPath)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, pngContent) {
+			t.Fatal("saved content not equal")
+		}
+	})
+
+	t.Run("private ip", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, timeout: time.Second})
+		if _, err := storage.UploadFromURL(context.Background(), server.URL+"/icon.png", RT_GAME_ICON); HTTPStatus(err) != http.StatusBadRequest {
+			t.Fatalf("want private ip refused, got %v", err)
+		}
+	})
+
+	t.Run("host not allowed", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{"example.com"}, allowPrivate: true, timeout: time.Second})
+		if _, err := storage.UploadFromURL(context.Background(), server.URL+"/icon.png", RT_GAME_ICON); HTTPStatus(err) != http.StatusBadRequest {
+			t.Fatalf("want host refused, got %v", err)
+		}
+	})
+
+	t.Run("redirect not allowed", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, allowPrivate: true, maxRedirects: 5, timeout: time.Second})
+		_, err := storage.UploadFromURL(context.Background(), server.URL+"/redirect.png", RT_GAME_ICON)
+		if !errors.Is(err, ErrInvalidArgument) || !strings.Contains(err.Error(), "redirect") {
+			t.Fatalf("want redirect refused, got %v", err)
+		}
+	})
+
+	t.Run("max redirects", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, allowPrivate: true, maxRedirects: 1, timeout: time.Second})
+		if _, err := storage.UploadFromURL(context.Background(), server.URL+"/loop.png", RT_GAME_ICON); !errors.Is(err, ErrInvalidArgument) ||
+			!strings.Contains(err.Error(), "stopped after 1 redirects") {
+			t.Fatalf("want redirect limited, got %v", err)
+		}
+	})
+
+	t.Run("upstream error", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, allowPrivate: true, timeout: time.Second})
+		if _, err := storage.UploadFromURL(context.Background(), server.URL+"/error.png", RT_GAME_ICON); HTTPStatus(err) != http.StatusBadGateway {
+			t.Fatalf("want bad gateway, got %v", err)
+		}
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+		_, err := storage.UploadFromURL(context.Background(), closed.URL+"/icon.png", RT_GAME_ICON)
+		if HTTPStatus(err) != http.StatusBadGateway || strings.Contains(PublicMessage(err), "refused") {
+			t.Fatalf("want bad gateway without detail, got %v '%s'", err, PublicMessage(err))
+		}
+	})
+
+	t.Run("resource type not changed", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, allowPrivate: true, timeout: time.Second})
+		if _, err := storage.UploadFromURL(context.Background(), server.URL+"/icon.png", RT_ACTIVITY_EVENT); err != nil {
+			t.Fatal(err)
+		}
+		if storage.resourceType != RT_GAME_ICON {
+			t.Fatalf("resource type changed to %d", storage.resourceType)
+		}
+	})
+
+	t.Run("content mismatch", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, allowPrivate: true, timeout: time.Second})
+		if _, err := storage.UploadFromURL(context.Background(), server.URL+"/fake.png", RT_GAME_ICON); err == nil {
+			t.Fatal("want content type refused")
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		storage, err := NewStorageWithOptions(RT_GAME_ICON, "", &Options{
+			UploadPath: t.TempDir(),
+			Config:     mapConfig{"quota.max_bytes": int64(len(pngContent) - 1)},
+			Usage:      NewMemoryUsageStore(nil),
+			Redis:      redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond, MaxRetries: -1}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.urlFetcher = &urlFetcher{allowHosts: []string{host}, allowPrivate: true, timeout: time.Second}
+		// 长度已知时下载前检查, 未知时按下载的大小检查
+		for _, name := range []string{"/icon.png", "/chunked.png"} {
+			if _, err := storage.UploadFromURL(context.Background(), server.URL+name, RT_GAME_ICON); !errors.Is(err, ErrQuotaExceeded) {
+				t.Fatalf("%s want quota exceeded, got %v", name, err)
+			}
+		}
+		filepath.Walk(storage.uploadPath, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				t.Fatalf("refused file '%s' saved", path)
+			}
+			return nil
+		})
+	})
+
+	t.Run("suffix", func(t *testing.T) {
+		storage := newFetchTestStorage(t, &urlFetcher{allowHosts: []string{host}, allowPrivate: true, timeout: time.Second})
+		if _, err := storage.UploadFromURL(context.Background(), server.URL+"/icon.exe", RT_GAME_ICON); err == nil {
+			t.Fatal("want suffix refused")
+		}
+	})
+}
+
+func TestDialControlPrivate(t *testing.T) {
+	fetcher := &urlFetcher{}
+	for _, address := range []string{"127.0.0.1:80", "10.0.0.1:80", "100.64.0.1:80", "100.127.255.255:80", "[::1]:80"} {
+		if err := fetcher.dialControl("tcp", address, nil); err == nil {
+			t.Fatalf("private address '%s' allowed", address)
+		}
+	}
+	for _, address := range []string{"100.63.255.255:80", "100.128.0.1:80", "8.8.8.8:443"} {
+		if err := fetcher.dialControl("tcp", address, nil); err != nil {
+			t.Fatalf("public address '%s' refused[%s]", address, err.Error())
+		}
+	}
+}
+
+func mustHostname(t *testing.T, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,47 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrMetadataNotFound 分片上传不存在或者已过期
+var ErrMetadataNotFound = errors.New("multipart metadata not found")
+
+// MultipartUpload 分片上传元数据
+type MultipartUpload struct {
+	UploadId string
+	Type     ResourceType
+	Filename string
+	// 分片数量, 以服务端计划为准
+	Chunks int32
+	// 分片计划, 旧版本Start没有计划时为nil
+	Plan *MultipartUploadPlan
+}
+
+// MetadataStore 分片上传元数据和已上传分片的存储
+// 默认使用redis, 也可以使用 NewMemoryMetadataStore 或 NewSQLMetadataStore
+type MetadataStore interface {
+	// SaveUpload 保存元数据, ttl后过期
+	SaveUpload(ctx context.Context, upload *MultipartUpload, ttl time.Duration) error
+	// GetUpload 不存在时返回 ErrMetadataNotFound
+	GetUpload(ctx context.Context, uploadId string) (*MultipartUpload, error)
+	// SaveChunk 保存分片, 相同序号覆盖, 过期时间从第一个分片开始计算
+	SaveChunk(ctx context.Context, chunk *MultipartUploadChunk, ttl time.Duration) error
+	// GetChunk 不存在时返回 ErrMetadataNotFound
+	GetChunk(ctx context.Context, uploadId string, chunk int32) (*MultipartUploadChunk, error)
+	// ListChunks 按分片序号排序, 没有分片时返回空
+	ListChunks(ctx context.Context, uploadId string) ([]*MultipartUploadChunk, error)
+	// DeleteUpload 删除元数据和所有分片
+	DeleteUpload(ctx context.Context, uploadId string) error
+	// ScanChunks 遍历所有未过期的分片, 孤儿文件清理使用
+	ScanChunks(ctx context.Context, fn func(chunk *MultipartUploadChunk) error) error
+}
+
+func sortChunks(chunks []*MultipartUploadChunk) {
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Chunk < chunks[j].Chunk
+	})
+}
@@ -0,0 +1,152 @@
+package upload
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryMetadataStore 只在当前进程中有效, 用于单节点部署和测试
+type memoryMetadataStore struct {
+	mu      sync.Mutex
+	clock   Clock
+	uploads map[string]*memoryUpload
+	chunks  map[string]*memoryChunks
+}
+
+type memoryUpload struct {
+	upload    MultipartUpload
+	expiresAt time.Time
+}
+
+type memoryChunks struct {
+	chunks    map[int32]MultipartUploadChunk
+	expiresAt time.Time
+}
+
+// NewMemoryMetadataStore clock为空时使用系统时间
+func NewMemoryMetadataStore(clock Clock) MetadataStore {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &memoryMetadataStore{
+		clock:   clock,
+		uploads: map[string]*memoryUpload{},
+		chunks:  map[string]*memoryChunks{},
+	}
+}
+
+// expire 删除过期数据, 调用前需要加锁
+func (s *memoryMetadataStore) expire() {
+	now := s.clock.Now()
+	for uploadId, upload := range s.uploads {
+		if !now.Before(upload.expiresAt) {
+			delete(s.uploads, uploadId)
+		}
+	}
+	for uploadId, chunks := range s.chunks {
+		if !now.Before(chunks.expiresAt) {
+			delete(s.chunks, uploadId)
+		}
+	}
+}
+
+func (s *memoryMetadataStore) SaveUpload(ctx context.Context, upload *MultipartUpload, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	record := &memoryUpload{upload: *upload, expiresAt: s.clock.Now().Add(ttl)}
+	if upload.Plan != nil {
+		plan := *upload.Plan
+		record.upload.Plan = &plan
+	}
+	s.uploads[upload.UploadId] = record
+	return nil
+}
+
+func (s *memoryMetadataStore) GetUpload(ctx context.Context, uploadId string) (*MultipartUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	record, ok := s.uploads[uploadId]
+	if !ok {
+		return nil, ErrMetadataNotFound
+	}
+	upload := record.upload
+	if upload.Plan != nil {
+		plan := *upload.Plan
+		upload.Plan = &plan
+	}
+	return &upload, nil
+}
+
+func (s *memoryMetadataStore) SaveChunk(ctx context.Context, chunk *MultipartUploadChunk, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	chunks, ok := s.chunks[chunk.UploadId]
+	if !ok {
+		chunks = &memoryChunks{chunks: map[int32]MultipartUploadChunk{}, expiresAt: s.clock.Now().Add(ttl)}
+		s.chunks[chunk.UploadId] = chunks
+	}
+	chunks.chunks[chunk.Chunk] = *chunk
+	return nil
+}
+
+func (s *memoryMetadataStore) GetChunk(ctx context.Context, uploadId string, chunk int32) (*MultipartUploadChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	chunks, ok := s.chunks[uploadId]
+	if !ok {
+		return nil, ErrMetadataNotFound
+	}
+	record, ok := chunks.chunks[chunk]
+	if !ok {
+		return nil, ErrMetadataNotFound
+	}
+	return &record, nil
+}
+
+func (s *memoryMetadataStore) ListChunks(ctx context.Context, uploadId string) ([]*MultipartUploadChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	var result []*MultipartUploadChunk
+	if chunks, ok := s.chunks[uploadId]; ok {
+		for _, chunk := range chunks.chunks {
+			chunk := chunk
+			result = append(result, &chunk)
+		}
+	}
+	sortChunks(result)
+	return result, nil
+}
+
+func (s *memoryMetadataStore) DeleteUpload(ctx context.Context, uploadId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, uploadId)
+	delete(s.chunks, uploadId)
+	return nil
+}
+
+// ScanChunks 先复制再回调, 回调中可以访问store
+func (s *memoryMetadataStore) ScanChunks(ctx context.Context, fn func(chunk *MultipartUploadChunk) error) error {
+	s.mu.Lock()
+	s.expire()
+	var result []*MultipartUploadChunk
+	for _, chunks := range s.chunks {
+		for _, chunk := range chunks.chunks {
+			chunk := chunk
+			result = append(result, &chunk)
+		}
+	}
+	s.mu.Unlock()
+	for _, chunk := range result {
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
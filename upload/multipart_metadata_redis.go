@@ -0,0 +1,177 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisMetadataStore 元数据、分片计划保存为字符串, 分片保存为hash, 使用redis过期时间
+// 三个key与升级前相同, 没有共同的hash tag, redis cluster中不在同一个slot, 每个key单独操作
+type redisMetadataStore struct {
+	cli redis.UniversalClient
+	ns  Namespace
+	// key的应用名, 为空时使用 REDIS_KEY_APP_DEFAULT
+	app string
+}
+
+// NewRedisMetadataStore 不区分租户, key与升级前相同, 应用名为 REDIS_KEY_APP_DEFAULT
+func NewRedisMetadataStore(cli redis.UniversalClient) MetadataStore {
+	return &redisMetadataStore{cli: cli}
+}
+
+// NewRedisMetadataStoreWithNamespace key加上租户和环境, 见 Namespace.RedisKey
+// 应用名为 REDIS_KEY_APP_DEFAULT, 配置了 app 时使用 NewRedisMetadataStoreWithOptions
+func NewRedisMetadataStoreWithNamespace(cli redis.UniversalClient, ns Namespace) MetadataStore {
+	return &redisMetadataStore{cli: cli, ns: ns}
+}
+
+// NewRedisMetadataStoreWithOptions 使用opts.Redis, opts.Namespace和配置的应用名
+func NewRedisMetadataStoreWithOptions(opts *Options) MetadataStore {
+	return &redisMetadataStore{cli: opts.Redis, ns: opts.Namespace, app: opts.redisApp()}
+}
+
+func (s *redisMetadataStore) key(format string, uploadId string) string {
+	return namespacedKey(s.ns, s.app, fmt.Sprintf(format, uploadId))
+}
+
+func (s *redisMetadataStore) SaveUpload(ctx context.Context, upload *MultipartUpload, ttl time.Duration) error {
+	startInfo, err := encodeMultipartRecord(&multipartStartRecord{
+		Version:  MULTIPART_RECORD_VERSION,
+		Type:     int32(upload.Type),
+		Filename: upload.Filename,
+		Chunks:   upload.Chunks,
+	})
+	if err != nil {
+		return err
+	}
+	// 先保存计划, 元数据存在时计划一定已经保存
+	if upload.Plan != nil {
+		planInfo, err := encodeMultipartRecord(newMultipartPlanRecord(upload.Plan))
+		if err != nil {
+			return err
+		}
+		if err := s.cli.Set(ctx, s.key(MULTIPART_STORAGE_PLAN, upload.UploadId), string(planInfo), ttl).Err(); err != nil {
+			return err
+		}
+	}
+	return s.cli.Set(ctx, s.key(MULTIPART_STORAGE_METADATA, upload.UploadId), string(startInfo), ttl).Err()
+}
+
+func (s *redisMetadataStore) GetUpload(ctx context.Context, uploadId string) (*MultipartUpload, error) {
+	startInfo, err := s.cli.Get(ctx, s.key(MULTIPART_STORAGE_METADATA, uploadId)).Bytes()
+	if err == redis.Nil || (err == nil && len(startInfo) == 0) {
+		return nil, ErrMetadataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record multipartStartRecord
+	if err := decodeMultipartRecord(startInfo, &record); err != nil {
+		return nil, fmt.Errorf("decode upload '%s' metadata '%s' fail[%s]", uploadId, string(startInfo), err.Error())
+	}
+	upload := &MultipartUpload{
+		UploadId: uploadId,
+		Type:     ResourceType(record.Type),
+		Filename: record.Filename,
+		Chunks:   record.Chunks,
+	}
+	// 旧版本Start没有计划
+	planInfo, err := s.cli.Get(ctx, s.key(MULTIPART_STORAGE_PLAN, uploadId)).Bytes()
+	if err == redis.Nil || (err == nil && len(planInfo) == 0) {
+		return upload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var plan multipartPlanRecord
+	if err := decodeMultipartRecord(planInfo, &plan); err != nil {
+		return nil, fmt.Errorf("decode upload '%s' plan '%s' fail[%s]", uploadId, string(planInfo), err.Error())
+	}
+	upload.Plan = plan.plan()
+	return upload, nil
+}
+
+func (s *redisMetadataStore) SaveChunk(ctx context.Context, chunk *MultipartUploadChunk, ttl time.Duration) error {
+	chunkInfo, err := encodeMultipartRecord(newMultipartChunkRecord(chunk))
+	if err != nil {
+		return err
+	}
+	key := s.key(MULTIPART_STORAGE_CHUNKS_HASH, chunk.UploadId)
+	if err := s.cli.HSet(ctx, key, fmt.Sprintf("%d", chunk.Chunk), string(chunkInfo)).Err(); err != nil {
+		return err
+	}
+	// 过期时间从第一个分片开始计算
+	if current, _ := s.cli.TTL(ctx, key).Result(); current == -1 {
+		return s.cli.Expire(ctx, key, ttl).Err()
+	}
+	return nil
+}
+
+func (s *redisMetadataStore) GetChunk(ctx context.Context, uploadId string, chunk int32) (*MultipartUploadChunk, error) {
+	chunkInfo, err := s.cli.HGet(ctx, s.key(MULTIPART_STORAGE_CHUNKS_HASH, uploadId), fmt.Sprintf("%d", chunk)).Bytes()
+	if err == redis.Nil || (err == nil && len(chunkInfo) == 0) {
+		return nil, ErrMetadataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record multipartChunkRecord
+	if err := decodeMultipartRecord(chunkInfo, &record); err != nil {
+		return nil, fmt.Errorf("decode upload '%s' chunk %d '%s' fail[%s]", uploadId, chunk, string(chunkInfo), err.Error())
+	}
+	return record.chunk(), nil
+}
+
+func (s *redisMetadataStore) ListChunks(ctx context.Context, uploadId string) ([]*MultipartUploadChunk, error) {
+	chunkInfoList, err := s.cli.HGetAll(ctx, s.key(MULTIPART_STORAGE_CHUNKS_HASH, uploadId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var chunks []*MultipartUploadChunk
+	for k, chunkInfo := range chunkInfoList {
+		if chunkInfo == "" {
+			continue
+		}
+		var record multipartChunkRecord
+		if err := decodeMultipartRecord([]byte(chunkInfo), &record); err != nil {
+			return nil, fmt.Errorf("decode upload '%s' chunk %s '%s' fail[%s]", uploadId, k, chunkInfo, err.Error())
+		}
+		chunks = append(chunks, record.chunk())
+	}
+	sortChunks(chunks)
+	return chunks, nil
+}
+
+// DeleteUpload 先删除元数据, 中断时剩余的key在过期后删除
+func (s *redisMetadataStore) DeleteUpload(ctx context.Context, uploadId string) error {
+	for _, format := range []string{MULTIPART_STORAGE_METADATA, MULTIPART_STORAGE_PLAN, MULTIPART_STORAGE_CHUNKS_HASH} {
+		if err := s.cli.Del(ctx, s.key(format, uploadId)).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanChunks 使用scan遍历, 不能解析的分片跳过
+func (s *redisMetadataStore) ScanChunks(ctx context.Context, fn func(chunk *MultipartUploadChunk) error) error {
+	iter := s.cli.Scan(ctx, 0, s.key(MULTIPART_STORAGE_CHUNKS_HASH, "*"), 500).Iterator()
+	for iter.Next(ctx) {
+		chunkInfoList, err := s.cli.HVals(ctx, iter.Val()).Result()
+		if err != nil {
+			return err
+		}
+		for _, chunkInfo := range chunkInfoList {
+			var record multipartChunkRecord
+			if err := decodeMultipartRecord([]byte(chunkInfo), &record); err != nil {
+				continue
+			}
+			if err := fn(record.chunk()); err != nil {
+				return err
+			}
+		}
+	}
+	return iter.Err()
+}
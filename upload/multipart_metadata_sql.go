@@ -0,0 +1,250 @@
+package upload
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLMetadataOptions .
+type SQLMetadataOptions struct {
+	// 表名前缀, 默认multipart_, 表名为 <prefix>uploads 和 <prefix>chunks
+	TablePrefix string
+	// 使用$1形式的参数占位符, postgres需要设置, 默认使用?
+	DollarPlaceholder bool
+	// 为空时使用系统时间
+	Clock Clock
+}
+
+// SQLMetadataStore 使用database/sql保存, 不依赖具体数据库的语法
+// 过期的记录查询时过滤, 由 DeleteExpired 或延迟任务删除
+type SQLMetadataStore struct {
+	db           *sql.DB
+	uploadsTable string
+	chunksTable  string
+	dollar       bool
+	clock        Clock
+}
+
+// NewSQLMetadataStore 表不存在时需要先调用 CreateTables
+func NewSQLMetadataStore(db *sql.DB, opts SQLMetadataOptions) *SQLMetadataStore {
+	if opts.TablePrefix == "" {
+		opts.TablePrefix = "multipart_"
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	return &SQLMetadataStore{
+		db:           db,
+		uploadsTable: opts.TablePrefix + "uploads",
+		chunksTable:  opts.TablePrefix + "chunks",
+		dollar:       opts.DollarPlaceholder,
+		clock:        opts.Clock,
+	}
+}
+
+// CreateTables 创建表, 已存在时不处理
+func (s *SQLMetadataStore) CreateTables(ctx context.Context) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.uploadsTable + ` (
+			upload_id VARCHAR(255) NOT NULL PRIMARY KEY,
+			resource_type INTEGER NOT NULL,
+			filename VARCHAR(1024) NOT NULL,
+			chunks INTEGER NOT NULL,
+			plan_size BIGINT NOT NULL,
+			plan_chunk_size BIGINT NOT NULL,
+			plan_chunks INTEGER NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + s.chunksTable + ` (
+			upload_id VARCHAR(255) NOT NULL,
+			chunk INTEGER NOT NULL,
+			content_md5 VARCHAR(64) NOT NULL,
+			validity VARCHAR(64) NOT NULL,
+			download_path VARCHAR(1024) NOT NULL,
+			expires_at BIGINT NOT NULL,
+			PRIMARY KEY (upload_id, chunk)
+		)`,
+	} {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebind 将?替换为$1, $2...
+func (s *SQLMetadataStore) rebind(query string) string {
+	if !s.dollar {
+		return query
+	}
+	var builder strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			builder.WriteString(fmt.Sprintf("$%d", n))
+			continue
+		}
+		builder.WriteRune(c)
+	}
+	return builder.String()
+}
+
+func (s *SQLMetadataStore) now() int64 {
+	return s.clock.Now().UnixMilli()
+}
+
+// upsert 先删除再插入, 不同数据库的upsert语法不同
+func (s *SQLMetadataStore) upsert(ctx context.Context, tx *sql.Tx, table string, where string, whereArgs []interface{},
+	columns string, args ...interface{}) error {
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE `+where), whereArgs...); err != nil {
+		return err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO `+table+` (`+columns+`) VALUES (`+placeholders+`)`), args...)
+	return err
+}
+
+func (s *SQLMetadataStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLMetadataStore) SaveUpload(ctx context.Context, upload *MultipartUpload, ttl time.Duration) error {
+	plan := &MultipartUploadPlan{}
+	if upload.Plan != nil {
+		plan = upload.Plan
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		return s.upsert(ctx, tx, s.uploadsTable, `upload_id = ?`, []interface{}{upload.UploadId},
+			`upload_id, resource_type, filename, chunks, plan_size, plan_chunk_size, plan_chunks, expires_at`,
+			upload.UploadId, int32(upload.Type), upload.Filename, upload.Chunks,
+			plan.Size, plan.ChunkSize, plan.Chunks, s.clock.Now().Add(ttl).UnixMilli())
+	})
+}
+
+func (s *SQLMetadataStore) GetUpload(ctx context.Context, uploadId string) (*MultipartUpload, error) {
+	var (
+		resourceType int32
+		plan         MultipartUploadPlan
+	)
+	upload := &MultipartUpload{UploadId: uploadId}
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT resource_type, filename, chunks, plan_size, plan_chunk_size, plan_chunks
+		FROM `+s.uploadsTable+` WHERE upload_id = ? AND expires_at > ?`), uploadId, s.now()).
+		Scan(&resourceType, &upload.Filename, &upload.Chunks, &plan.Size, &plan.ChunkSize, &plan.Chunks)
+	if err == sql.ErrNoRows {
+		return nil, ErrMetadataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload.Type = ResourceType(resourceType)
+	if plan.Chunks > 0 {
+		upload.Plan = &plan
+	}
+	return upload, nil
+}
+
+// SaveChunk 过期时间与已有的分片相同
+func (s *SQLMetadataStore) SaveChunk(ctx context.Context, chunk *MultipartUploadChunk, ttl time.Duration) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var expiresAt sql.NullInt64
+		if err := tx.QueryRowContext(ctx, s.rebind(`SELECT MIN(expires_at) FROM `+s.chunksTable+
+			` WHERE upload_id = ? AND expires_at > ?`), chunk.UploadId, s.now()).Scan(&expiresAt); err != nil {
+			return err
+		}
+		if !expiresAt.Valid {
+			expiresAt.Int64 = s.clock.Now().Add(ttl).UnixMilli()
+		}
+		return s.upsert(ctx, tx, s.chunksTable, `upload_id = ? AND chunk = ?`, []interface{}{chunk.UploadId, chunk.Chunk},
+			`upload_id, chunk, content_md5, validity, download_path, expires_at`,
+			chunk.UploadId, chunk.Chunk, chunk.ContentMd5, chunk.Validity, chunk.DownloadPath, expiresAt.Int64)
+	})
+}
+
+func (s *SQLMetadataStore) GetChunk(ctx context.Context, uploadId string, chunk int32) (*MultipartUploadChunk, error) {
+	record := &MultipartUploadChunk{UploadId: uploadId, Chunk: chunk}
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT content_md5, validity, download_path FROM `+s.chunksTable+
+		` WHERE upload_id = ? AND chunk = ? AND expires_at > ?`), uploadId, chunk, s.now()).
+		Scan(&record.ContentMd5, &record.Validity, &record.DownloadPath)
+	if err == sql.ErrNoRows {
+		return nil, ErrMetadataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *SQLMetadataStore) queryChunks(ctx context.Context, where string, args []interface{},
+	fn func(chunk *MultipartUploadChunk) error) error {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT upload_id, chunk, content_md5, validity, download_path FROM `+
+		s.chunksTable+` WHERE `+where+` ORDER BY upload_id, chunk`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chunk MultipartUploadChunk
+		if err := rows.Scan(&chunk.UploadId, &chunk.Chunk, &chunk.ContentMd5, &chunk.Validity, &chunk.DownloadPath); err != nil {
+			return err
+		}
+		if err := fn(&chunk); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLMetadataStore) ListChunks(ctx context.Context, uploadId string) ([]*MultipartUploadChunk, error) {
+	var chunks []*MultipartUploadChunk
+	err := s.queryChunks(ctx, `upload_id = ? AND expires_at > ?`, []interface{}{uploadId, s.now()},
+		func(chunk *MultipartUploadChunk) error {
+			chunks = append(chunks, chunk)
+			return nil
+		})
+	return chunks, err
+}
+
+func (s *SQLMetadataStore) DeleteUpload(ctx context.Context, uploadId string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{s.uploadsTable, s.chunksTable} {
+			if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE upload_id = ?`), uploadId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLMetadataStore) ScanChunks(ctx context.Context, fn func(chunk *MultipartUploadChunk) error) error {
+	return s.queryChunks(ctx, `expires_at > ?`, []interface{}{s.now()}, fn)
+}
+
+// DeleteExpired 删除过期的记录, 返回删除的上传数量
+func (s *SQLMetadataStore) DeleteExpired(ctx context.Context) (int64, error) {
+	var deleted int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		now := s.now()
+		result, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+s.uploadsTable+` WHERE expires_at <= ?`), now)
+		if err != nil {
+			return err
+		}
+		if deleted, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM `+s.chunksTable+` WHERE expires_at <= ?`), now)
+		return err
+	})
+	return deleted, err
+}
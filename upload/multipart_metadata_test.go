@@ -0,0 +1,141 @@
+package upload
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func testMetadataStore(t *testing.T, store MetadataStore, clock *testClock) {
+	ctx := context.Background()
+	start := clock.now
+	if _, err := store.GetUpload(ctx, "u1"); err != ErrMetadataNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+	upload := &MultipartUpload{UploadId: "u1", Type: RT_GAME_ICON, Filename: "a.zip", Chunks: 2,
+		Plan: &MultipartUploadPlan{Size: 15, ChunkSize: 10, Chunks: 2}}
+	if err := store.SaveUpload(ctx, upload, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetUpload(ctx, "u1")
+	if err != nil || got.Type != RT_GAME_ICON || got.Filename != "a.zip" || got.Chunks != 2 || got.Plan == nil || *got.Plan != *upload.Plan {
+		t.Fatalf("unexpected upload %+v[%v]", got, err)
+	}
+	// 旧版本没有计划
+	if err := store.SaveUpload(ctx, &MultipartUpload{UploadId: "u2", Type: RT_GAME_ICON, Chunks: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetUpload(ctx, "u2"); err != nil || got.Plan != nil {
+		t.Fatalf("unexpected upload %+v[%v]", got, err)
+	}
+
+	for _, chunk := range []int32{2, 1, 2} {
+		if err := store.SaveChunk(ctx, &MultipartUploadChunk{UploadId: "u1", Chunk: chunk, ContentMd5: "m", DownloadPath: "/icon/a.zip"}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		clock.now = clock.now.Add(10 * time.Second)
+	}
+	chunks, err := store.ListChunks(ctx, "u1")
+	if err != nil || len(chunks) != 2 || chunks[0].Chunk != 1 || chunks[1].Chunk != 2 {
+		t.Fatalf("unexpected chunks %+v[%v]", chunks, err)
+	}
+	if chunk, err := store.GetChunk(ctx, "u1", 2); err != nil || chunk.ContentMd5 != "m" || chunk.DownloadPath != "/icon/a.zip" {
+		t.Fatalf("unexpected chunk %+v[%v]", chunk, err)
+	}
+	if _, err := store.GetChunk(ctx, "u1", 3); err != ErrMetadataNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// 元数据和分片的过期时间都从第一次保存开始计算
+	clock.now = start.Add(time.Minute)
+	if _, err := store.GetUpload(ctx, "u1"); err != ErrMetadataNotFound {
+		t.Fatalf("upload not expired[%v]", err)
+	}
+	if chunks, _ := store.ListChunks(ctx, "u1"); len(chunks) != 0 {
+		t.Fatalf("chunks not expired %+v", chunks)
+	}
+
+	if err := store.SaveChunk(ctx, &MultipartUploadChunk{UploadId: "u3", Chunk: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var scanned []string
+	if err := store.ScanChunks(ctx, func(chunk *MultipartUploadChunk) error {
+		scanned = append(scanned, chunk.UploadId)
+		return nil
+	}); err != nil || len(scanned) != 1 || scanned[0] != "u3" {
+		t.Fatalf("unexpected scanned chunks %v[%v]", scanned, err)
+	}
+	if err := store.DeleteUpload(ctx, "u3"); err != nil {
+		t.Fatal(err)
+	}
+	if chunks, _ := store.ListChunks(ctx, "u3"); len(chunks) != 0 {
+		t.Fatalf("chunks not deleted %+v", chunks)
+	}
+}
+
+func TestMemoryMetadataStore(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	testMetadataStore(t, NewMemoryMetadataStore(clock), clock)
+}
+
+func TestSQLMetadataStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	clock := &testClock{now: time.Now()}
+	store := NewSQLMetadataStore(db, SQLMetadataOptions{Clock: clock})
+	if err := store.CreateTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testMetadataStore(t, store, clock)
+	if deleted, err := store.DeleteExpired(context.Background()); err != nil || deleted != 2 {
+		t.Fatalf("unexpected deleted %d[%v]", deleted, err)
+	}
+}
+
+func TestRedisMetadataStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer cli.Close()
+	hook := &txSlotHook{}
+	cli.AddHook(hook)
+	store := NewRedisMetadataStore(cli)
+	upload := &MultipartUpload{UploadId: "u1", Type: RT_GAME_ICON, Filename: "a.zip", Chunks: 2,
+		Plan: &MultipartUploadPlan{Size: 15, ChunkSize: 10, Chunks: 2}}
+	if err := store.SaveUpload(ctx, upload, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetUpload(ctx, "u1"); err != nil || got.Plan == nil || *got.Plan != *upload.Plan {
+		t.Fatalf("unexpected upload %+v[%v]", got, err)
+	}
+	if err := store.SaveChunk(ctx, &MultipartUploadChunk{UploadId: "u1", Chunk: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUpload(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("keys not deleted %v", keys)
+	}
+	// 三个key不在同一个slot, 不能在同一个事务或命令中
+	if len(hook.crossSlot) > 0 {
+		t.Fatalf("command across hash tags %v", hook.crossSlot)
+	}
+}
@@ -0,0 +1,58 @@
+package upload
+
+// MULTIPART_STORAGE_PLAN 分片上传计划, 由服务端在Start时确定
+const MULTIPART_STORAGE_PLAN = "multipart_storage:%s:plan"
+
+// MultipartUploadPlan 分片上传计划
+// 分片序号从1开始, 除最后一个分片外每个分片大小都等于ChunkSize
+type MultipartUploadPlan struct {
+	// 文件总大小
+	Size int64 `json:"size"`
+	// 每个分片大小
+	ChunkSize int64 `json:"chunk_size"`
+	// 分片数量
+	Chunks int32 `json:"chunks"`
+}
+
+// newMultipartUploadPlan 根据文件总大小和资源类型限制生成分片计划
+func newMultipartUploadPlan(opts *Options, resourceType ResourceType, size int64) (*MultipartUploadPlan, error) {
+	if size <= 0 {
+		return nil, newError(ErrInvalidArgument, "multipart.start", "invalid upload size %d", size)
+	}
+	maxSize := opts.multipartMaxSize(resourceType)
+	if size > maxSize {
+		return nil, newError(ErrTooLarge, "multipart.start", "upload size exceed limit(%d, %d)", size, maxSize)
+	}
+	chunkSize := opts.multipartChunkSize(resourceType)
+	if chunkSize <= 0 {
+		chunkSize = 5 << 20
+	}
+	maxChunks := opts.multipartMaxChunks()
+	if (size+chunkSize-1)/chunkSize > maxChunks {
+		// 分片数量过多时放大分片
+		chunkSize = (size + maxChunks - 1) / maxChunks
+	}
+	if maxSizePerChunk := opts.multipartMaxChunkSize(); chunkSize > maxSizePerChunk {
+		return nil, newError(ErrTooLarge, "multipart.start", "upload size %d need chunk size %d, max size %d bytes", size, chunkSize, maxSizePerChunk)
+	}
+	return &MultipartUploadPlan{
+		Size:      size,
+		ChunkSize: chunkSize,
+		Chunks:    int32((size + chunkSize - 1) / chunkSize),
+	}, nil
+}
+
+// chunkValid 校验分片序号和分片大小是否符合计划
+func (p *MultipartUploadPlan) chunkValid(chunk int32, size int64) error {
+	if chunk < 1 || chunk > p.Chunks {
+		return newError(ErrInvalidArgument, "multipart.upload", "invalid chunk %d, want 1-%d", chunk, p.Chunks)
+	}
+	want := p.ChunkSize
+	if chunk == p.Chunks {
+		want = p.Size - p.ChunkSize*int64(p.Chunks-1)
+	}
+	if size != want {
+		return newError(ErrInvalidArgument, "multipart.upload", "chunk %d size %d not match plan, want %d", chunk, size, want)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// 分片上传保存在redis中的记录
+// 记录中带有版本号v, 修改记录结构时增加版本号并在decode中兼容旧版本
+// 版本0为升级前直接保存的proto结构, 字段名与版本1相同
+
+// MULTIPART_RECORD_VERSION 当前写入的记录版本
+const MULTIPART_RECORD_VERSION = 1
+
+// multipartStartRecord 分片上传元数据
+type multipartStartRecord struct {
+	Version  int32  `json:"v,omitempty"`
+	Type     int32  `json:"type,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	// 分片数量, 以服务端计划为准
+	Chunks int32 `json:"chunks,omitempty"`
+}
+
+// multipartChunkRecord 已上传的分片
+type multipartChunkRecord struct {
+	Version      int32  `json:"v,omitempty"`
+	UploadId     string `json:"upload_id,omitempty"`
+	Chunk        int32  `json:"chunk,omitempty"`
+	ContentMd5   string `json:"content_md5,omitempty"`
+	Validity     string `json:"validity,omitempty"`
+	DownloadPath string `json:"download_path,omitempty"`
+}
+
+// multipartPlanRecord 分片计划
+type multipartPlanRecord struct {
+	Version   int32 `json:"v,omitempty"`
+	Size      int64 `json:"size"`
+	ChunkSize int64 `json:"chunk_size"`
+	Chunks    int32 `json:"chunks"`
+}
+
+func newMultipartChunkRecord(chunk *MultipartUploadChunk) *multipartChunkRecord {
+	return &multipartChunkRecord{
+		Version:      MULTIPART_RECORD_VERSION,
+		UploadId:     chunk.UploadId,
+		Chunk:        chunk.Chunk,
+		ContentMd5:   chunk.ContentMd5,
+		Validity:     chunk.Validity,
+		DownloadPath: chunk.DownloadPath,
+	}
+}
+
+func (r *multipartChunkRecord) chunk() *MultipartUploadChunk {
+	return &MultipartUploadChunk{
+		UploadId:     r.UploadId,
+		Chunk:        r.Chunk,
+		ContentMd5:   r.ContentMd5,
+		Validity:     r.Validity,
+		DownloadPath: r.DownloadPath,
+	}
+}
+
+func newMultipartPlanRecord(plan *MultipartUploadPlan) *multipartPlanRecord {
+	return &multipartPlanRecord{
+		Version:   MULTIPART_RECORD_VERSION,
+		Size:      plan.Size,
+		ChunkSize: plan.ChunkSize,
+		Chunks:    plan.Chunks,
+	}
+}
+
+func (r *multipartPlanRecord) plan() *MultipartUploadPlan {
+	return &MultipartUploadPlan{Size: r.Size, ChunkSize: r.ChunkSize, Chunks: r.Chunks}
+}
+
+func encodeMultipartRecord(record interface{}) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+// decodeMultipartRecord 不支持比当前更新的版本, 避免回滚后读取新版本记录时丢失字段
+func decodeMultipartRecord(data []byte, record interface{}) error {
+	var header struct {
+		Version int32 `json:"v"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	if header.Version < 0 || header.Version > MULTIPART_RECORD_VERSION {
+		return fmt.Errorf("unsupported multipart record version %d", header.Version)
+	}
+	return json.Unmarshal(data, record)
+}
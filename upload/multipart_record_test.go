@@ -0,0 +1,28 @@
+package upload
+
+import "testing"
+
+func TestDecodeMultipartRecord(t *testing.T) {
+	// 升级前保存的proto结构
+	var chunk multipartChunkRecord
+	if err := decodeMultipartRecord([]byte(`{"upload_id":"u","chunk":2,"content_md5":"m","download_path":"/tmp/a.zip?v=1"}`), &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if c := chunk.chunk(); c.UploadId != "u" || c.Chunk != 2 || c.ContentMd5 != "m" || c.DownloadPath != "/tmp/a.zip?v=1" {
+		t.Fatalf("unexpected chunk %+v", c)
+	}
+
+	data, err := encodeMultipartRecord(newMultipartChunkRecord(&MultipartUploadChunk{UploadId: "u", Chunk: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk = multipartChunkRecord{}
+	if err := decodeMultipartRecord(data, &chunk); err != nil || chunk.Version != MULTIPART_RECORD_VERSION || chunk.Chunk != 3 {
+		t.Fatalf("unexpected chunk %+v[%v]", chunk, err)
+	}
+
+	var start multipartStartRecord
+	if err := decodeMultipartRecord([]byte(`{"v":99,"type":1}`), &start); err == nil {
+		t.Fatal("expect unsupported version error")
+	}
+}
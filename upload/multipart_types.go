@@ -0,0 +1,43 @@
+package upload
+
+// 分片上传的请求和返回, 由调用方从各自的协议转换, grpc服务见 pbadapter
+
+// MultipartUploadStartRequest 分片上传准备
+type MultipartUploadStartRequest struct {
+	Type     ResourceType
+	Filename string
+}
+
+// MultipartUploadStartResult 分片上传准备结果
+type MultipartUploadStartResult struct {
+	UploadId string
+}
+
+// MultipartUploadChunkRequest 上传一个分片
+type MultipartUploadChunkRequest struct {
+	UploadId string
+	// 分片序号, 从1开始
+	Chunk int32
+	// 为空时不校验分片内容
+	ContentMd5 string
+	// 文件总大小, 为0时不校验
+	Size int64
+}
+
+// MultipartUploadChunk 已上传的分片
+type MultipartUploadChunk struct {
+	UploadId   string
+	Chunk      int32
+	ContentMd5 string
+	// 分片文件保留时间
+	Validity     string
+	DownloadPath string
+}
+
+// MultipartUploadDoneResult 分片合并结果
+type MultipartUploadDoneResult struct {
+	UploadId     string
+	DownloadPath string
+	// 合并后文件保留时间
+	Validity string
+}
@@ -1,35 +1,20 @@
 package upload
 
 import (
-	"api_mgr/configs"
-	merr "api_mgr/model/errors"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"os"
-	"path/filepath"
-	pb "protos_repo/file"
-	"sort"
-
-	errDef "git.yj.live/Golang/source/errors"
-
-	"git.yj.live/Golang/source/configmanager"
-	"git.yj.live/Golang/source/log"
-	"google.golang.org/grpc/codes"
 )
 
+// redis key不包含应用名, 由 namespacedKey 加上应用名和命名空间
 const (
 	// MULTIPART_STORAGE_METADATA 分片上传存储元数据
-	MULTIPART_STORAGE_METADATA = "platform:multipart_storage:%s:metadata"
-	// MULTIPART_STORAGE_CHUNKS 分片上传存储分块数据
-	MULTIPART_STORAGE_CHUNKS = "platform:multipart_storage:%s:chunks"
+	MULTIPART_STORAGE_METADATA = "multipart_storage:%s:metadata"
 	// MULTIPART_STORAGE_CHUNKS_HASH 分片上传存储分块数据，升级为保存到hash
-	MULTIPART_STORAGE_CHUNKS_HASH = "platform:multipart_storage:hash:%s:chunks"
+	MULTIPART_STORAGE_CHUNKS_HASH = "multipart_storage:hash:%s:chunks"
 )
 
 // MultipartStorage 分片上传存储
@@ -41,298 +26,264 @@ type MultipartStorage struct {
 	size int64
 }
 
-// NewMultipartStorage 分片上传
-func NewMultipartStorage(resourceType ResourceType, resourceId string) (*MultipartStorage, error) {
-	storage, err := NewStorage(resourceType, resourceId)
+// NewMultipartStorageWithOptions opts.Metadata和opts.Redis不能同时为空
+func NewMultipartStorageWithOptions(resourceType ResourceType, resourceId string, opts *Options) (*MultipartStorage, error) {
+	storage, err := NewStorageWithOptions(resourceType, resourceId, opts)
+	if err == nil && storage.opts.Metadata == nil {
+		err = fmt.Errorf("multipart upload metadata store not set")
+	}
 	if err != nil {
-		log.L().Errorf("new storage fail[%s]", err.Error())
-		return &MultipartStorage{}, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
+		if opts.Logger != nil {
+			opts.Logger.Errorf("new storage fail[%s]", err.Error())
+		}
+		return &MultipartStorage{}, internalError("multipart.new", err, "new storage")
 	}
 	return &MultipartStorage{Storage: storage}, nil
 }
 
 // Start 分片上传准备
-// 存储在redis中
-func (s *MultipartStorage) Start(in *pb.MultipartUploadStartReq) (*pb.MultipartUploadStartInfo, error) {
-	if err := s.setStart(in); err != nil {
-		return &pb.MultipartUploadStartInfo{}, err
+// 根据文件总大小生成分片计划, 客户端需要按照返回的分片大小和分片数量上传
+// 元数据保存在Options.Metadata中, 过期后由延迟任务删除
+func (s *MultipartStorage) Start(ctx context.Context, in *MultipartUploadStartRequest, size int64) (*MultipartUploadStartResult, *MultipartUploadPlan, error) {
+	if def, ok := s.opts.ResourceTypes.Lookup(in.Type); !ok || !def.Uploadable {
+		return &MultipartUploadStartResult{}, nil, newError(ErrUnsupportedType, "multipart.start",
+			"resource_type '%d' not uploadable", in.Type)
+	}
+	plan, err := newMultipartUploadPlan(s.opts, in.Type, size)
+	if err != nil {
+		return &MultipartUploadStartResult{}, nil, err
 	}
-	return &pb.MultipartUploadStartInfo{
+	s.resourceType = in.Type
+	if err := s.quotaValid(ctx, "multipart.start", size); err != nil {
+		return &MultipartUploadStartResult{}, nil, err
+	}
+	// 与元数据同时过期, 见下面的过期任务
+	if err := s.acquireMultipart(ctx, s.opts.now().Add(2*s.retention())); err != nil {
+		return &MultipartUploadStartResult{}, nil, err
+	}
+	// 分片数量以服务端计划为准
+	upload := &MultipartUpload{
 		UploadId: s.resourceId,
-	}, nil
+		Type:     in.Type,
+		Filename: in.Filename,
+		Chunks:   plan.Chunks,
+		Plan:     plan,
+	}
+	if err := s.opts.Metadata.SaveUpload(ctx, upload, s.retention()); err != nil {
+		s.opts.releaseMultipart(ctx, s.resourceId)
+		s.opts.Logger.Errorf("save multipart upload '%s' metadata fail[%s]", s.resourceId, err.Error())
+		return &MultipartUploadStartResult{}, nil, internalError("multipart.start", err, "save multipart upload '%s' metadata", s.resourceId)
+	}
+	s.opts.Logger.Infof("MultipartUpload start uploadId:%s, upload:%+v, plan:%+v, expireTime:%v",
+		s.resourceId, upload, plan, s.retention())
+	// redis中的元数据自动过期, 其他存储需要删除
+	// 分片的过期时间从第一个分片开始计算, 最晚在Start后两个周期过期
+	if job, err := NewDelayJob(DJ_EXPIRE_MULTIPART, s.resourceId, &ExpireMultipartPayload{UploadId: s.resourceId}); err == nil {
+		if err := s.delayJob.AddJob(ctx, job, s.opts.now().Add(2*s.retention())); err != nil {
+			s.opts.Logger.Errorf("add multipart upload '%s' expire job fail[%s]", s.resourceId, err.Error())
+		}
+	}
+	return &MultipartUploadStartResult{
+		UploadId: s.resourceId,
+	}, plan, nil
 }
 
 // Upload 分片上传
-func (s *MultipartStorage) Upload(in *pb.MultipartUploadReq, file *multipart.FileHeader) (*pb.MultipartUploadChunkInfo, error) {
-	_, err := s.getStartInfo(in.UploadId)
+func (s *MultipartStorage) Upload(ctx context.Context, in *MultipartUploadChunkRequest, file *multipart.FileHeader) (*MultipartUploadChunk, error) {
+	startInfo, err := s.getStartInfo(ctx, in.UploadId)
 	if err != nil {
-		return &pb.MultipartUploadChunkInfo{}, err
+		return &MultipartUploadChunk{}, err
+	}
+	if plan := startInfo.Plan; plan != nil {
+		if err := plan.chunkValid(in.Chunk, file.Size); err != nil {
+			return &MultipartUploadChunk{}, err
+		}
 	}
 	s.contentMD5 = in.ContentMd5
 	s.size = in.Size
 	// 上传文件
-	downloadPath, err := s.upload(file)
+	downloadPath, err := s.upload(ctx, file)
 	if err != nil {
-		return &pb.MultipartUploadChunkInfo{}, err
+		return &MultipartUploadChunk{}, err
 	}
-	chunkInfo := &pb.MultipartUploadChunkInfo{
+	chunkInfo := &MultipartUploadChunk{
 		UploadId:     in.UploadId,
 		Chunk:        in.Chunk,
 		ContentMd5:   in.ContentMd5,
-		Validity:     s.delayJob.delayDuration().String(),
+		Validity:     s.retention().String(),
 		DownloadPath: downloadPath,
 	}
-	if err := s.setChunk(chunkInfo); err != nil {
-		return &pb.MultipartUploadChunkInfo{}, err
+	if err := s.opts.Metadata.SaveChunk(ctx, chunkInfo, s.retention()); err != nil {
+		s.opts.Logger.Errorf("save multipart upload '%s' chunk %d fail[%s]", in.UploadId, in.Chunk, err.Error())
+		return &MultipartUploadChunk{}, internalError("multipart.upload", err, "save multipart upload '%s' chunk %d", in.UploadId, in.Chunk)
 	}
+	s.opts.Logger.Infof("MultipartUpload save chunk:%+v, expireTime:%v", chunkInfo, s.retention())
 	return chunkInfo, nil
 }
 
 // Done 分片文件上传结束
-func (s *MultipartStorage) Done(in *pb.MultipartUploadIDReq) (*pb.MultipartUploadDoneResp, error) {
-	startInfo, err := s.getStartInfo(in.UploadId)
+// ctx取消或合并失败时删除不完整的目标文件
+func (s *MultipartStorage) Done(ctx context.Context, uploadId string) (*MultipartUploadDoneResult, error) {
+	startInfo, err := s.getStartInfo(ctx, uploadId)
 	if err != nil {
-		return &pb.MultipartUploadDoneResp{}, err
+		return &MultipartUploadDoneResult{}, err
 	}
 	s.resourceType = ResourceType(startInfo.Type)
 	// 获取所有分片
-	chunks, err := s.getChunks(in.UploadId)
+	chunks, err := s.getChunks(ctx, uploadId)
 	if err != nil {
-		return &pb.MultipartUploadDoneResp{}, err
+		return &MultipartUploadDoneResult{}, err
 	}
 	if len(chunks) != int(startInfo.Chunks) {
-		return &pb.MultipartUploadDoneResp{}, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INVALID_REQUEST_ERR,
-			codes.InvalidArgument,
-			"upload '%s' chunks not enough, current %d, want %d", in.UploadId, len(chunks), startInfo.Chunks)
+		return &MultipartUploadDoneResult{}, newError(ErrIncomplete, "multipart.done", "upload '%s' chunks not enough, current %d, want %d", uploadId, len(chunks), startInfo.Chunks)
 	}
 	// 创建目标文件
 	filePath := s.uploadFullPathByName(startInfo.Filename)
 	dstFile, err := os.Create(filePath)
 	if err != nil {
-		log.L().Errorf("multipart upload create file '%s' fail[%s]", filePath, err.Error())
-		return &pb.MultipartUploadDoneResp{}, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
+		s.opts.Logger.Errorf("multipart upload create file '%s' fail[%s]", filePath, err.Error())
+		return &MultipartUploadDoneResult{}, internalError("multipart.done", err, "multipart upload create file '%s'", filePath)
+	}
+	merged, hash, err := s.merge(ctx, dstFile, chunks)
+	if closeErr := dstFile.Close(); err == nil && closeErr != nil {
+		s.opts.Logger.Errorf("multipart upload close file '%s' fail[%s]", filePath, closeErr.Error())
+		err = internalError("multipart.done", closeErr, "multipart upload close file '%s'", filePath)
+	}
+	if err == nil {
+		// 文件完整性校验
+		err = s.contentMD5Valid(hash)
+	}
+	if plan := startInfo.Plan; err == nil && plan != nil && plan.Size != merged {
+		err = newError(ErrIncomplete, "multipart.done", "upload '%s' merged size %d not equal plan size %d", uploadId, merged, plan.Size)
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return &MultipartUploadDoneResult{}, err
 	}
-	defer dstFile.Close()
+
+	// 添加延迟任务删除临时文件
+	s.delayDelete(ctx, filePath)
+	s.opts.releaseMultipart(ctx, uploadId)
+	return &MultipartUploadDoneResult{
+		UploadId:     uploadId,
+		DownloadPath: fmt.Sprintf("%s?v=%s&where=multi_upload", s.fileName(filePath), s.version),
+		Validity:     s.retention().String(),
+	}, nil
+}
+
+// merge 按顺序合并分片, 返回合并后的大小和分片md5的摘要
+func (s *MultipartStorage) merge(ctx context.Context, dstFile *os.File, chunks []*MultipartUploadChunk) (int64, string, error) {
 	hash := md5.New()
-	// 合并文件
+	var merged int64
 	for _, chunk := range chunks {
-		chunkFile, err := ioutil.ReadFile(filepath.Join(s.uploadPath, s.parse(chunk.DownloadPath)))
+		chunkPath, fullPath, err := s.uploadFullPath("multipart.done", chunk.DownloadPath)
 		if err != nil {
-			log.L().Errorf("open chunk file '%s' fail[%s]", chunk.DownloadPath, err.Error())
-			return &pb.MultipartUploadDoneResp{}, errDef.Errorf(merr.SYSTEM_CODE,
-				errDef.INTERNAL_SERVER_ERR,
-				codes.Internal,
-				"internal server error")
+			return merged, "", err
+		}
+		if !isExist(fullPath) {
+			// 分片上传到了其他节点, 从所属节点拉取
+			if err := s.fetchFromOwner(ctx, chunkPath); err != nil {
+				return merged, "", err
+			}
 		}
-		if _, err := dstFile.Write(chunkFile); err != nil {
-			log.L().Errorf("merge chunk '%s' fail[%s]", chunk.DownloadPath, err.Error())
-			return &pb.MultipartUploadDoneResp{}, errDef.Errorf(merr.SYSTEM_CODE,
-				errDef.INTERNAL_SERVER_ERR,
-				codes.Internal,
-				"internal server error")
+		chunkFile, err := os.Open(fullPath)
+		if err != nil {
+			s.opts.Logger.Errorf("open chunk file '%s' fail[%s]", chunk.DownloadPath, err.Error())
+			return merged, "", internalError("multipart.done", err, "open chunk file '%s'", chunk.DownloadPath)
+		}
+		n, err := copyContext(ctx, dstFile, chunkFile)
+		chunkFile.Close()
+		merged += n
+		if err != nil {
+			s.opts.Logger.Errorf("merge chunk '%s' fail[%s]", chunk.DownloadPath, err.Error())
+			return merged, "", internalError("multipart.done", err, "merge chunk '%s'", chunk.DownloadPath)
 		}
 		if _, err := hash.Write([]byte(chunk.ContentMd5)); err != nil {
-			log.L().Errorf("write chunkfile into md5 hash fail[%s]", err.Error())
-			return &pb.MultipartUploadDoneResp{}, errDef.Errorf(merr.SYSTEM_CODE,
-				errDef.INTERNAL_SERVER_ERR,
-				codes.Internal,
-				"internal server error")
+			s.opts.Logger.Errorf("write chunkfile into md5 hash fail[%s]", err.Error())
+			return merged, "", internalError("multipart.done", err, "write chunkfile into md5 hash")
 		}
 	}
-	// 文件完整性校验
-	if err := s.contentMD5Valid(hex.EncodeToString(hash.Sum(nil))); err != nil {
-		return &pb.MultipartUploadDoneResp{}, err
-	}
-
-	// 添加延迟任务删除临时文件
-	s.delayJob.Add(filePath)
-	return &pb.MultipartUploadDoneResp{
-		UploadId:     in.UploadId,
-		DownloadPath: fmt.Sprintf("%s?v=%s&where=multi_upload", s.fileName(filePath), s.version),
-		Validity:     s.delayJob.delayDuration().String(),
-	}, nil
+	return merged, hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // GetMultipartUploadChunk 获取分块详情
-func (s *MultipartStorage) GetMultipartUploadChunk(in *pb.MultipartUploadChunkReq) (*pb.MultipartUploadChunkInfo, error) {
-	// chunkInfo, err := configs.RedisCli.Get(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS, fmt.Sprintf("%s_%d", in.UploadId, in.Chunk))).Bytes()
-	chunkInfo, err := configs.RedisCli.HGet(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, in.UploadId), fmt.Sprintf("%d", in.Chunk)).Bytes()
-	if err != nil || len(chunkInfo) == 0 {
-		return &pb.MultipartUploadChunkInfo{}, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INVALID_REQUEST_ERR,
-			codes.InvalidArgument,
-			"upload '%s' chunk %d not found", in.UploadId, in.Chunk)
-	}
-	var multipartUploadChunkInfo pb.MultipartUploadChunkInfo
-	if err := json.Unmarshal(chunkInfo, &multipartUploadChunkInfo); err != nil {
-		log.L().Errorf("unmarshal upload '%s' chunk %d fail[%s]", in.UploadId, in.Chunk, string(chunkInfo))
-		return &pb.MultipartUploadChunkInfo{}, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
-	}
-	return &multipartUploadChunkInfo, nil
-}
-
-// GetMultipartUploadChunks 获取上传的分块
-func (s *MultipartStorage) GetMultipartUploadChunks(in *pb.MultipartUploadIDReq) (*pb.MultipartUploadChunks, error) {
-	chunkInfos, err := s.getChunks(in.UploadId)
-	if err != nil {
-		return &pb.MultipartUploadChunks{}, err
+func (s *MultipartStorage) GetMultipartUploadChunk(ctx context.Context, uploadId string, chunk int32) (*MultipartUploadChunk, error) {
+	chunkInfo, err := s.opts.Metadata.GetChunk(ctx, uploadId, chunk)
+	if err == ErrMetadataNotFound {
+		return &MultipartUploadChunk{}, newError(ErrNotFound, "multipart.get_chunk", "upload '%s' chunk %d not found", uploadId, chunk)
 	}
-	return &pb.MultipartUploadChunks{Data: chunkInfos}, nil
-}
-
-func (s *MultipartStorage) setStart(in *pb.MultipartUploadStartReq) error {
-	startInfo, err := json.Marshal(in)
 	if err != nil {
-		log.L().Errorf("marshal multipart upload repare req fail[%s]", err.Error())
-		return errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
-	}
-	// 元数据存储
-	if err := configs.RedisCli.Set(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_METADATA, s.resourceId),
-		string(startInfo), s.delayJob.delayDuration()).Err(); err != nil {
-		log.L().Errorf("redis set multipart upload metadata fail[%s]", err.Error())
-		return errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
-	}
-	log.L().Infof("MultipartUpload setStart set redis:%s, expireTime:%v, err:%v", string(startInfo), s.delayJob.delayDuration(), err)
-	return nil
+		s.opts.Logger.Errorf("get upload '%s' chunk %d fail[%s]", uploadId, chunk, err.Error())
+		return &MultipartUploadChunk{}, internalError("multipart.get_chunk", err, "get upload '%s' chunk %d", uploadId, chunk)
+	}
+	return chunkInfo, nil
 }
 
-func (s *MultipartStorage) getStartInfo(uploadId string) (*pb.MultipartUploadStartReq, error) {
-	startInfo, err := configs.RedisCli.Get(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_METADATA, uploadId)).Bytes()
-	log.L().Infof("MultipartUpload getStartInfo uploadId:%s, startInfo:%v,err:%v", uploadId, string(startInfo), err)
-	if err != nil || len(startInfo) == 0 {
-		return &pb.MultipartUploadStartReq{}, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INVALID_REQUEST_ERR,
-			codes.InvalidArgument,
-			"upload '%s' not found", uploadId)
-	}
-	var multiPartUploadStartInfo pb.MultipartUploadStartReq
-	if err := json.Unmarshal(startInfo, &multiPartUploadStartInfo); err != nil {
-		log.L().Errorf("multipart upload unmarshal repare request '%s' fail[%s]", string(startInfo), err.Error())
-		return &pb.MultipartUploadStartReq{}, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
-	}
-	log.L().Infof("MultipartUpload getStartInfo uploadId:%s, multiPartUploadStartInfo:%+v,err:%v", uploadId, multiPartUploadStartInfo, err)
-	return &multiPartUploadStartInfo, nil
+// GetMultipartUploadChunks 获取上传的分块
+func (s *MultipartStorage) GetMultipartUploadChunks(ctx context.Context, uploadId string) ([]*MultipartUploadChunk, error) {
+	return s.getChunks(ctx, uploadId)
 }
 
-func (s *MultipartStorage) setChunk(in *pb.MultipartUploadChunkInfo) error {
-	chunkInfo, err := json.Marshal(in)
-	if err != nil {
-		log.L().Errorf("multipart upload marshal upload fail[%s]", err.Error())
-		return errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
+// Abort 取消分片上传
+// 删除元数据和当前节点上的分片文件, 其他节点上的分片由延迟任务删除
+func (s *MultipartStorage) Abort(ctx context.Context, uploadId string) error {
+	if _, err := s.getStartInfo(ctx, uploadId); err != nil {
+		return err
 	}
-
-	// redis保存
-	// if err := configs.RedisCli.Set(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS, fmt.Sprintf("%s_%d", in.UploadId, in.Chunk)), string(chunkInfo), s.delayJob.delayDuration()).Err(); err != nil {
-	// 	log.L().Errorf("multipart upload set chunk info into redis fail[%s]", err.Error())
-	// 	return errDef.Errorf(merr.SYSTEM_CODE,
-	// 		errDef.INTERNAL_SERVER_ERR,
-	// 		codes.Internal,
-	// 		"internal server error")
-	// }
-
-	// redis-hash 保存
-	if err := configs.RedisCli.HSet(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, in.UploadId),
-		fmt.Sprintf("%d", in.Chunk), string(chunkInfo)).Err(); err != nil {
-		return errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
-	}
-
-	log.L().Infof("MultipartUpload setChunk chunkInfo:%v,expireTime:%v,redis_hash_key:%s,key:%d,err:%v",
-		in, s.delayJob.delayDuration(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, in.UploadId), in.Chunk, err)
-
-	ttl, _ := configs.RedisCli.TTL(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, in.UploadId)).Result()
-	if ttl == -1 {
-		err = configs.RedisCli.Expire(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, in.UploadId), s.delayJob.delayDuration()).Err()
-		if err != nil {
-			log.L().Errorf("multipart upload set chunk redis hash:%s expire error:%s",
-				fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, in.UploadId), s.delayJob.delayDuration())
+	chunks, _ := s.getChunks(ctx, uploadId)
+	for _, chunk := range chunks {
+		_, chunkPath, err := s.uploadFullPath("multipart.abort", chunk.DownloadPath)
+		if err != nil || !isExist(chunkPath) {
+			continue
 		}
+		if err := os.Remove(chunkPath); err != nil {
+			s.opts.Logger.Errorf("multipart upload abort remove chunk '%s' fail[%s]", chunkPath, err.Error())
+			continue
+		}
+		s.delayJob.Remove(ctx, chunkPath)
 	}
-
+	if err := s.opts.Metadata.DeleteUpload(ctx, uploadId); err != nil {
+		s.opts.Logger.Errorf("multipart upload abort '%s' delete metadata fail[%s]", uploadId, err.Error())
+		return internalError("multipart.abort", err, "multipart upload abort '%s' delete metadata", uploadId)
+	}
+	s.opts.releaseMultipart(ctx, uploadId)
+	s.opts.Logger.Infof("MultipartUpload abort uploadId:%s, chunks:%d", uploadId, len(chunks))
 	return nil
 }
-func (s *MultipartStorage) getChunks(uploadId string) ([]*pb.MultipartUploadChunkInfo, error) {
-	var chunkInfos []*pb.MultipartUploadChunkInfo
-	// 使用redis keys 扫描表导致超时，导致上传失败
-	// chunkKeys, err := configs.RedisCli.Keys(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS, fmt.Sprintf("%s_*", uploadId))).Result()
-	// log.L().Errorf("MultipartUpload getChunks uploadId:%s,redis_key:%s,chunkKeys:%+v, err:%v, end_time:%s ",
-	// 	uploadId, fmt.Sprintf(MULTIPART_STORAGE_CHUNKS, fmt.Sprintf("%s_*", uploadId)), chunkKeys, err, time.Now().Format("2006-01-02 15:04:05"))
-	// if err != nil || len(chunkKeys) == 0 {
-	// 	return chunkInfos, errDef.Errorf(merr.SYSTEM_CODE,
-	// 		errDef.INVALID_REQUEST_ERR,
-	// 		codes.InvalidArgument,
-	// 		"upload '%s' chunks not found", uploadId)
-	// }
-	//
-
-	// 获取分批的集合信息 redis hash
-	chunkInfoList, err := configs.RedisCli.HGetAll(context.Background(), fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, uploadId)).Result()
-	log.L().Infof("MultipartUpload getChunks uploadId:%s,redis_key:%s,result:%+v, err:%v",
-		uploadId, fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, uploadId), chunkInfoList, err)
 
-	if err != nil || len(chunkInfoList) == 0 {
-		return chunkInfos, errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INVALID_REQUEST_ERR,
-			codes.InvalidArgument,
-			"upload '%s' chunks redis hash not found", uploadId)
-	}
-	for k := range chunkInfoList {
-		if chunkInfoList[k] == "" {
-			log.L().Errorf("MultipartStorage getChunks empty.redis hash:%s, key:%s",
-				fmt.Sprintf(MULTIPART_STORAGE_CHUNKS_HASH, uploadId), k)
-			continue
-		}
-		var chunkInfo pb.MultipartUploadChunkInfo
-		if err := json.Unmarshal([]byte(chunkInfoList[k]), &chunkInfo); err != nil {
-			log.L().Errorf("unmarshal chunk info '%s' fail[%s]", string(chunkInfoList[k]), err.Error())
-			return chunkInfos, errDef.Errorf(merr.SYSTEM_CODE,
-				errDef.INTERNAL_SERVER_ERR,
-				codes.Internal,
-				"internal server error")
-		}
-		chunkInfos = append(chunkInfos, &chunkInfo)
+func (s *MultipartStorage) getStartInfo(ctx context.Context, uploadId string) (*MultipartUpload, error) {
+	startInfo, err := s.opts.Metadata.GetUpload(ctx, uploadId)
+	s.opts.Logger.Infof("MultipartUpload getStartInfo uploadId:%s, startInfo:%+v, err:%v", uploadId, startInfo, err)
+	if err == ErrMetadataNotFound {
+		return &MultipartUpload{}, newError(ErrNotFound, "multipart.get", "upload '%s' not found or expired", uploadId)
 	}
+	if err != nil {
+		s.opts.Logger.Errorf("multipart upload get '%s' metadata fail[%s]", uploadId, err.Error())
+		return &MultipartUpload{}, internalError("multipart.get", err, "multipart upload get '%s' metadata", uploadId)
+	}
+	return startInfo, nil
+}
 
-	sort.SliceStable(chunkInfos, func(i, j int) bool {
-		return chunkInfos[i].Chunk < chunkInfos[j].Chunk
-	})
+func (s *MultipartStorage) getChunks(ctx context.Context, uploadId string) ([]*MultipartUploadChunk, error) {
+	chunkInfos, err := s.opts.Metadata.ListChunks(ctx, uploadId)
+	s.opts.Logger.Infof("MultipartUpload getChunks uploadId:%s, chunks:%d, err:%v", uploadId, len(chunkInfos), err)
+	if err != nil {
+		s.opts.Logger.Errorf("multipart upload list '%s' chunks fail[%s]", uploadId, err.Error())
+		return nil, internalError("multipart.list_chunks", err, "multipart upload list '%s' chunks", uploadId)
+	}
+	if len(chunkInfos) == 0 {
+		return nil, newError(ErrNotFound, "multipart.list_chunks", "upload '%s' chunks not found", uploadId)
+	}
 	return chunkInfos, nil
 }
 
 // 文件完整性校验
-func (s *MultipartStorage) contentValid(file multipart.File) error {
-	if s.contentMD5 != "" && configmanager.GetBool("multipart_upload.check.content.enabled", false) {
+func (s *MultipartStorage) contentValid(ctx context.Context, file multipart.File) error {
+	if s.contentMD5 != "" && s.opts.settings().Multipart.CheckContent {
 		hash := md5.New()
-		if _, err := io.Copy(hash, file); err != nil {
-			log.L().Errorf("content valid check md5sum fail[%s]", err.Error())
-			return errDef.Errorf(merr.SYSTEM_CODE,
-				errDef.INTERNAL_SERVER_ERR,
-				codes.Internal,
-				"internal server error")
+		if _, err := copyContext(ctx, hash, file); err != nil {
+			s.opts.Logger.Errorf("content valid check md5sum fail[%s]", err.Error())
+			return internalError("multipart.upload", err, "content valid check md5sum")
 		}
 		md5sum := hex.EncodeToString(hash.Sum(nil))
 		if err := s.contentMD5Valid(md5sum); err != nil {
@@ -343,12 +294,9 @@ func (s *MultipartStorage) contentValid(file multipart.File) error {
 }
 
 func (s *MultipartStorage) contentMD5Valid(contentMD5 string) error {
-	if s.contentMD5 != "" && configmanager.GetBool("multipart_upload.check.content.enabled", false) {
+	if s.contentMD5 != "" && s.opts.settings().Multipart.CheckContent {
 		if s.contentMD5 != contentMD5 {
-			return errDef.Warnf(merr.SYSTEM_CODE,
-				errDef.INVALID_REQUEST_ERR,
-				codes.InvalidArgument,
-				"upload file content_md5 not equal input '%s', want '%s'", s.contentMD5, contentMD5)
+			return newError(ErrChecksumMismatch, "multipart.upload", "upload file content_md5 not equal input '%s', want '%s'", s.contentMD5, contentMD5)
 		}
 	}
 	return nil
@@ -356,13 +304,10 @@ func (s *MultipartStorage) contentMD5Valid(contentMD5 string) error {
 
 // 文件大小校验
 func (s *MultipartStorage) sizeValid(file *multipart.FileHeader) error {
-	if s.size != 0 && configmanager.GetBool("multipart_upload.check.size.enabled", false) {
-		maxSizePerChunk := configmanager.GetInt64("multipart_upload.check.size.max", 10<<20)
+	if s.size != 0 && s.opts.settings().Multipart.CheckSize {
+		maxSizePerChunk := s.opts.multipartMaxChunkSize()
 		if file.Size > maxSizePerChunk {
-			return errDef.Warnf(merr.SYSTEM_CODE,
-				errDef.INVALID_REQUEST_ERR,
-				codes.InvalidArgument,
-				"request file too large, max size %d bytes", maxSizePerChunk)
+			return newError(ErrTooLarge, "multipart.upload", "request file too large, max size %d bytes", maxSizePerChunk)
 		}
 		if err := s.fileSizeValid(file.Size); err != nil {
 			return err
@@ -372,53 +317,35 @@ func (s *MultipartStorage) sizeValid(file *multipart.FileHeader) error {
 }
 
 func (s *MultipartStorage) fileSizeValid(size int64) error {
-	if s.size != 0 && configmanager.GetBool("multipart_upload.check.size.enabled", false) {
+	if s.size != 0 && s.opts.settings().Multipart.CheckSize {
 		if s.size != size {
-			return errDef.Warnf(merr.SYSTEM_CODE,
-				errDef.INVALID_REQUEST_ERR,
-				codes.InvalidArgument,
-				"upload file size not equal input %d, want %d", s.size, size)
+			return newError(ErrIncomplete, "multipart.upload", "upload file size not equal input %d, want %d", s.size, size)
 		}
 	}
 	return nil
 }
 
 // 分片上传
-func (s *MultipartStorage) upload(file *multipart.FileHeader) (string, error) {
+func (s *MultipartStorage) upload(ctx context.Context, file *multipart.FileHeader) (string, error) {
 	if err := s.sizeValid(file); err != nil {
 		return "", err
 	}
 	filePath := s.uploadFullPathByName(file.Filename)
-	dstFile, err := os.Create(filePath)
-	if err != nil {
-		log.L().Errorf("multipart upload create file '%s' fail[%s]", filePath, err.Error())
-		return "", errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
-	}
-	defer dstFile.Close()
 	uploadFile, err := file.Open()
 	if err != nil {
-		log.L().Errorf("multipart upload open file '%s' fail[%s]", file.Filename, err.Error())
-		return "", errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
+		s.opts.Logger.Errorf("multipart upload open file '%s' fail[%s]", file.Filename, err.Error())
+		return "", internalError("multipart.upload", err, "multipart upload open file '%s'", file.Filename)
 	}
 	defer uploadFile.Close()
-	if err := s.contentValid(uploadFile); err != nil {
+	if err := s.contentValid(ctx, uploadFile); err != nil {
 		return "", err
 	}
-	log.L().Debugf("save resource '%s' to '%s'", s.resourceId, filePath)
-	if _, err := io.Copy(dstFile, uploadFile); err != nil {
-		log.L().Errorf("save upload file '%s' to '%s' fail[%s]", file.Filename, filePath, err.Error())
-		return "", errDef.Errorf(merr.SYSTEM_CODE,
-			errDef.INTERNAL_SERVER_ERR,
-			codes.Internal,
-			"internal server error")
+	s.opts.Logger.Debugf("save resource '%s' to '%s'", s.resourceId, filePath)
+	if _, err := writeFileContext(ctx, filePath, 0666, uploadFile); err != nil {
+		s.opts.Logger.Errorf("save upload file '%s' to '%s' fail[%s]", file.Filename, filePath, err.Error())
+		return "", internalError("multipart.upload", err, "save upload file '%s' to '%s'", file.Filename, filePath)
 	}
 	// 添加延迟任务删除临时文件
-	s.delayJob.Add(filePath)
+	s.delayDelete(ctx, filePath)
 	return fmt.Sprintf("%s?v=%s&where=multi_upload", s.fileName(filePath), s.version), nil
 }
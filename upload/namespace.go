@@ -0,0 +1,89 @@
+package upload
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// NAMESPACE_DEFAULT 命名空间中只设置了租户或环境时, 另一个使用的值
+const NAMESPACE_DEFAULT = "default"
+
+// REDIS_KEY_APP_DEFAULT redis key的第一段, 配置 app 为空时使用
+const REDIS_KEY_APP_DEFAULT = "platform"
+
+var namespaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Namespace 租户和环境, 共用redis或磁盘时隔离redis key和文件路径
+// 都为空时key和路径与升级前相同
+type Namespace struct {
+	Tenant string
+	Env    string
+}
+
+// IsZero 没有设置命名空间
+func (n Namespace) IsZero() bool {
+	return n.Tenant == "" && n.Env == ""
+}
+
+// Validate 租户和环境只能包含字母, 数字, _和-
+func (n Namespace) Validate() error {
+	for name, value := range map[string]string{"tenant": n.Tenant, "env": n.Env} {
+		if value != "" && !namespaceNamePattern.MatchString(value) {
+			return fmt.Errorf("invalid namespace %s '%s'", name, value)
+		}
+	}
+	return nil
+}
+
+// segments 环境在前, 同一环境的租户在同一个目录下
+func (n Namespace) segments() []string {
+	env, tenant := n.Env, n.Tenant
+	if env == "" {
+		env = NAMESPACE_DEFAULT
+	}
+	if tenant == "" {
+		tenant = NAMESPACE_DEFAULT
+	}
+	return []string{env, tenant}
+}
+
+// RedisKey 在key的第一段后插入环境和租户
+//
+//	platform:multipart_storage:x:metadata -> platform:prod:tenant1:multipart_storage:x:metadata
+func (n Namespace) RedisKey(key string) string {
+	if n.IsZero() {
+		return key
+	}
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) == 1 {
+		return strings.Join(append(n.segments(), key), ":")
+	}
+	return strings.Join(append(append([]string{parts[0]}, n.segments()...), parts[1]), ":")
+}
+
+// Path 在root下加入环境和租户目录, root为空时返回空
+func (n Namespace) Path(root string) string {
+	if n.IsZero() || root == "" {
+		return root
+	}
+	return filepath.Join(append([]string{root}, n.segments()...)...)
+}
+
+func (n Namespace) String() string {
+	if n.IsZero() {
+		return ""
+	}
+	return strings.Join(n.segments(), "/")
+}
+
+// namespacedKey 在key前加上应用名, 再按命名空间插入环境和租户
+//
+//	app=platform multipart_storage:x:metadata -> platform:prod:tenant1:multipart_storage:x:metadata
+func namespacedKey(ns Namespace, app, key string) string {
+	if app == "" {
+		app = REDIS_KEY_APP_DEFAULT
+	}
+	return ns.RedisKey(app + ":" + key)
+}
@@ -0,0 +1,52 @@
+package upload
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	var zero Namespace
+	if key := zero.RedisKey(MULTIPART_STORAGE_PLAN); key != MULTIPART_STORAGE_PLAN {
+		t.Fatalf("zero namespace changed key '%s'", key)
+	}
+	if path := zero.Path("/data/upload"); path != "/data/upload" {
+		t.Fatalf("zero namespace changed path '%s'", path)
+	}
+	ns := Namespace{Tenant: "t1"}
+	if key := ns.RedisKey("platform:multipart_storage:u1:plan"); key != "platform:default:t1:multipart_storage:u1:plan" {
+		t.Fatalf("unexpected key '%s'", key)
+	}
+	if key := ns.RedisKey("queue"); key != "default:t1:queue" {
+		t.Fatalf("unexpected key '%s'", key)
+	}
+	// 没有配置应用名时与升级前的key相同
+	for _, c := range []struct {
+		ns       Namespace
+		app, key string
+	}{
+		{zero, "", "platform:multipart_storage:u1:plan"},
+		{zero, "game", "game:multipart_storage:u1:plan"},
+		{ns, "", "platform:default:t1:multipart_storage:u1:plan"},
+	} {
+		if key := namespacedKey(c.ns, c.app, fmt.Sprintf(MULTIPART_STORAGE_PLAN, "u1")); key != c.key {
+			t.Fatalf("unexpected key '%s', want '%s'", key, c.key)
+		}
+	}
+	opts, _ := (&Options{Config: mapConfig{"app": "game"}}).withDefaults()
+	if key := delayQueueName(opts); key != "game:api_mgr:platform:storage:delay_job_queue" {
+		t.Fatalf("unexpected delay queue '%s'", key)
+	}
+	if path := ns.Path("/data/upload"); path != filepath.Join("/data/upload", "default", "t1") {
+		t.Fatalf("unexpected path '%s'", path)
+	}
+	for _, invalid := range []Namespace{{Tenant: "a:b"}, {Env: "../prod"}, {Tenant: "a*"}} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("namespace %+v should be invalid", invalid)
+		}
+	}
+	if err := (Namespace{Tenant: "t_1", Env: "prod-2"}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
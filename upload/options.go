@@ -0,0 +1,268 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Logger 日志接口
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Clock 时钟, 测试时可以替换
+type Clock interface {
+	Now() time.Time
+}
+
+// Config 读取配置, 读取的值缓存在 SettingsStore 中
+// 修改后调用 SettingsStore.Reload 或者由 SettingsStore.Watch 定时重新读取后才生效
+type Config interface {
+	GetString(key string, defaultValue string) string
+	GetInt64(key string, defaultValue int64) int64
+	GetBool(key string, defaultValue bool) bool
+}
+
+// Limits 上传限制, 为0的字段按资源类型读取配置
+type Limits struct {
+	// 普通上传文件大小
+	MaxSize int64
+	// 普通上传支持的文件后缀
+	AcceptSuffixes []string
+	// 分片上传文件总大小
+	MultipartMaxSize int64
+	// 分片大小
+	MultipartChunkSize int64
+	// 最多分片数量, 超过时放大分片
+	MultipartMaxChunks int64
+	// 单个分片最大大小
+	MultipartMaxChunkSize int64
+}
+
+// Options 上传存储的依赖
+// api_mgr使用 apimgr.DefaultOptions 从全局配置创建, 其他服务按需填写
+type Options struct {
+	// 上传目录, 上传的文件先保存在这里
+	UploadPath string
+	// cdn目录, 发布时从上传目录拷贝到这里
+	RootPath string
+	// 文档素材和代理人调控的cdn目录
+	DownloadPath string
+	// 当前节点, 作为资源ID的后缀和延迟任务队列所属节点
+	Hostname string
+	Limits   Limits
+	// redis延迟任务队列和默认的分片上传元数据存储使用
+	Redis redis.UniversalClient
+	// 分片上传元数据存储, 为空时使用Redis
+	Metadata MetadataStore
+	Config   Config
+	Logger   Logger
+	Clock    Clock
+	// 为空时按Config创建
+	DelayQueue DelayQueue
+	// 为空时按Options创建, 多个Storage可以共用
+	DelayJob *StorageDelayJob
+	// 资源类型, 为空时使用 DefaultResourceTypes
+	ResourceTypes *ResourceTypeRegistry
+	// 校验过的配置, 为空时按Config创建, 配置不合法时构造函数返回 *SettingsError
+	Settings *SettingsStore
+	// 租户的用量, 为空时使用Redis, 都为空时不统计用量也不限制配额
+	Usage UsageStore
+	// 租户和环境, 多个租户共用redis和磁盘时隔离key和目录, 为空时与升级前相同
+	// 目录使用 uploadRoot 等方法获取, 上面的路径字段保存的是未加命名空间的根目录
+	Namespace Namespace
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// mapConfig 没有指定Config时所有配置使用默认值
+type mapConfig map[string]interface{}
+
+func (c mapConfig) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c mapConfig) GetString(key string, defaultValue string) string {
+	if value, ok := c[key].(string); ok {
+		return value
+	}
+	return defaultValue
+}
+
+func (c mapConfig) GetInt64(key string, defaultValue int64) int64 {
+	if value, ok := c[key].(int64); ok {
+		return value
+	}
+	return defaultValue
+}
+
+func (c mapConfig) GetBool(key string, defaultValue bool) bool {
+	if value, ok := c[key].(bool); ok {
+		return value
+	}
+	return defaultValue
+}
+
+// withDefaults 返回补全默认值后的副本
+// 按Config读取的配置不合法时同时返回 *SettingsError, 副本中不合法的配置项使用默认值
+func (o *Options) withDefaults() (*Options, error) {
+	opts := *o
+	if opts.Hostname == "" {
+		opts.Hostname = "1"
+	}
+	if opts.Config == nil {
+		opts.Config = mapConfig{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger{}
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	if opts.ResourceTypes == nil {
+		opts.ResourceTypes = DefaultResourceTypes
+	}
+	var settingsErr error
+	if opts.Settings == nil {
+		opts.Settings, settingsErr = loadSettingsStore(opts.Config, opts.ResourceTypes)
+	}
+	// Options.Redis不为空且没有指定存储时使用Options.Namespace和配置的应用名创建
+	if opts.Metadata == nil && opts.Redis != nil {
+		opts.Metadata = NewRedisMetadataStoreWithOptions(&opts)
+	}
+	if opts.Usage == nil && opts.Redis != nil {
+		opts.Usage = NewRedisUsageStoreWithOptions(&opts)
+	}
+	return &opts, settingsErr
+}
+
+// redisApp redis key的应用名, 配置 app
+func (o *Options) redisApp() string {
+	if o.Config == nil {
+		return REDIS_KEY_APP_DEFAULT
+	}
+	return o.Config.GetString("app", REDIS_KEY_APP_DEFAULT)
+}
+
+// redisKey 按应用名和命名空间生成redis key
+func (o *Options) redisKey(key string) string {
+	return namespacedKey(o.Namespace, o.redisApp(), key)
+}
+
+func (o *Options) now() time.Time {
+	return o.Clock.Now()
+}
+
+// settings 当前配置
+func (o *Options) settings() *Settings {
+	return o.Settings.Current()
+}
+
+// uploadMaxSize 普通上传文件大小限制
+// 优先级 Limits > 资源类型的配置 > 资源类型定义 > 全局配置
+func (o *Options) uploadMaxSize(def ResourceTypeDef) int64 {
+	if o.Limits.MaxSize > 0 {
+		return o.Limits.MaxSize
+	}
+	return o.settings().uploadMaxSize(def)
+}
+
+// uploadAcceptSuffixes 支持的文件后缀
+func (o *Options) uploadAcceptSuffixes(def ResourceTypeDef) []string {
+	if len(o.Limits.AcceptSuffixes) > 0 {
+		return o.Limits.AcceptSuffixes
+	}
+	return o.settings().uploadAcceptSuffixes(def)
+}
+
+// multipartMaxSize 分片上传文件总大小限制
+func (o *Options) multipartMaxSize(resourceType ResourceType) int64 {
+	if o.Limits.MultipartMaxSize > 0 {
+		return o.Limits.MultipartMaxSize
+	}
+	return o.settings().multipartMaxSize(resourceType)
+}
+
+// multipartChunkSize 分片大小
+func (o *Options) multipartChunkSize(resourceType ResourceType) int64 {
+	if o.Limits.MultipartChunkSize > 0 {
+		return o.Limits.MultipartChunkSize
+	}
+	return o.settings().multipartChunkSize(resourceType)
+}
+
+func (o *Options) multipartMaxChunks() int64 {
+	if o.Limits.MultipartMaxChunks > 0 {
+		return o.Limits.MultipartMaxChunks
+	}
+	return o.settings().Multipart.MaxChunks
+}
+
+func (o *Options) multipartMaxChunkSize() int64 {
+	if o.Limits.MultipartMaxChunkSize > 0 {
+		return o.Limits.MultipartMaxChunkSize
+	}
+	return o.settings().Multipart.MaxChunkSize
+}
+
+// cdnFilePath 不同业务cdn存放的目录
+func (o *Options) cdnFilePath(resourceType ResourceType) (string, error) {
+	def, ok := o.ResourceTypes.Lookup(resourceType)
+	if !ok {
+		return "", errors.New("resourceType no exists")
+	}
+	return filepath.Join(o.cdnRoot(def), def.Dir), nil
+}
+
+// uploadRoot 当前租户的上传目录
+func (o *Options) uploadRoot() string {
+	return o.Namespace.Path(o.UploadPath)
+}
+
+// cdnRoot 资源类型发布的根目录, 自定义目录同样按租户隔离
+func (o *Options) cdnRoot(def ResourceTypeDef) string {
+	switch def.CdnRoot {
+	case CDN_ROOT_DEFAULT:
+		return o.Namespace.Path(o.RootPath)
+	case CDN_ROOT_DOWNLOAD:
+		return o.Namespace.Path(o.DownloadPath)
+	}
+	return o.Namespace.Path(def.CdnRoot)
+}
+
+type optionsKey struct{}
+
+// withOptions 延迟任务处理通过ctx获取Options
+func withOptions(ctx context.Context, opts *Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, opts)
+}
+
+// optionsFromContext 只有 StorageDelayJob 执行的任务有Options
+func optionsFromContext(ctx context.Context) (*Options, error) {
+	if opts, ok := ctx.Value(optionsKey{}).(*Options); ok {
+		return opts, nil
+	}
+	return nil, errors.New("options not found in context")
+}
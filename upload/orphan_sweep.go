@@ -0,0 +1,286 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 延迟任务添加失败(只记录日志)或者redis数据丢失后, 暂存文件不会再被删除
+// 定期扫描暂存目录, 删除超过保留时间且没有被延迟任务和分片上传引用的文件
+// 没有指定resourceId时发布只从延迟队列删除, 文件留在暂存目录作为发布后的文件
+// 这类文件名为生成的 uuid_hostname, 与丢失延迟任务的暂存文件无法区分, 都不删除
+//
+//	storage.orphan_sweep.interval  扫描间隔, 默认6h, 为0时不扫描
+//	storage.orphan_sweep.retention 保留时间, 默认24h, 不小于延迟删除时间加租约时间
+//	storage.orphan_sweep.dry_run   只报告不删除, 默认true
+
+// ORPHAN_SWEEP_REPORT_FILES 报告中最多列出的文件数量
+const ORPHAN_SWEEP_REPORT_FILES = 1000
+
+// OrphanSweepReport 扫描结果
+type OrphanSweepReport struct {
+	DryRun bool     `json:"dry_run"`
+	Dirs   []string `json:"dirs"`
+	// 扫描的文件数量
+	Scanned int64 `json:"scanned"`
+	// 未超过保留时间的文件数量
+	Recent int64 `json:"recent"`
+	// 被延迟任务或分片上传引用的文件数量
+	Referenced int64 `json:"referenced"`
+	// 文件名为生成的resourceId, 可能已经发布在暂存目录中的文件数量
+	Published int64 `json:"published"`
+	// 没有引用的文件数量和大小, 不是dry run时会被删除
+	Orphaned      int64 `json:"orphaned"`
+	OrphanedBytes int64 `json:"orphaned_bytes"`
+	Deleted       int64 `json:"deleted"`
+	Errors        int64 `json:"errors"`
+	// 没有引用的文件, 相对上传目录, 最多ORPHAN_SWEEP_REPORT_FILES个
+	Files     []string `json:"files"`
+	StartedAt int64    `json:"started_at"`
+	Duration  string   `json:"duration"`
+}
+
+// OrphanSweeper 暂存目录孤儿文件清理
+type OrphanSweeper struct {
+	job        *StorageDelayJob
+	uploadPath string
+	// 只报告不删除
+	DryRun bool
+	// 修改时间在保留时间内的文件不处理
+	Retention time.Duration
+}
+
+// NewOrphanSweeper 按配置创建
+func NewOrphanSweeper(job *StorageDelayJob) *OrphanSweeper {
+	return &OrphanSweeper{
+		job:        job,
+		uploadPath: job.opts.uploadRoot(),
+		DryRun:     job.opts.settings().OrphanSweep.DryRun,
+		Retention:  orphanRetention(job),
+	}
+}
+
+func orphanSweepInterval(opts *Options) time.Duration {
+	return opts.settings().OrphanSweep.Interval
+}
+
+// orphanRetention 保留时间过短时, 还在延迟任务中的文件可能因为读取队列和扫描目录之间的时间差被误删
+func orphanRetention(job *StorageDelayJob) time.Duration {
+	retention := job.opts.settings().OrphanSweep.Retention
+	maxDelay := job.delayDuration()
+	for _, def := range job.opts.ResourceTypes.All() {
+		if def.Retention > maxDelay {
+			maxDelay = def.Retention
+		}
+	}
+	if minRetention := maxDelay + job.leaseDuration(); retention < minRetention {
+		retention = minRetention
+	}
+	return retention
+}
+
+// sweepOrphans 后台任务中定期执行
+func (s *StorageDelayJob) sweepOrphans(ctx context.Context) {
+	interval := orphanSweepInterval(s.opts)
+	if interval <= 0 || s.opts.now().Sub(s.orphanSweptAt) < interval {
+		return
+	}
+	s.orphanSweptAt = s.opts.now()
+	if _, err := NewOrphanSweeper(s).Sweep(ctx); err != nil {
+		s.opts.Logger.Errorf("delay job '%s' sweep orphan files fail[%s]", s.queue.Name(), err.Error())
+	}
+}
+
+// stagingDirs 各资源类型的暂存目录, 包括分片目录
+func (o *OrphanSweeper) stagingDirs() ([]string, error) {
+	root, err := filepath.Abs(o.uploadPath)
+	if err != nil {
+		return nil, err
+	}
+	// 上传目录同时是cdn目录时, 发布后的文件也在上传目录中
+	for _, cdnRoot := range cdnRoots(o.job.opts) {
+		if cdnRoot == "" {
+			continue
+		}
+		cdnRoot, err := filepath.Abs(cdnRoot)
+		if err != nil {
+			return nil, err
+		}
+		if isSubPath(root, cdnRoot) || isSubPath(cdnRoot, root) {
+			return nil, fmt.Errorf("upload path '%s' overlaps cdn path '%s'", root, cdnRoot)
+		}
+	}
+	var dirs []string
+	seen := map[string]bool{}
+	for _, def := range o.job.opts.ResourceTypes.All() {
+		dir := filepath.Join(root, def.Dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// isSubPath path是否为root或者在root下
+func isSubPath(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// orphanRefs 被引用的文件和目录
+type orphanRefs struct {
+	files map[string]bool
+	dirs  []string
+}
+
+func (r *orphanRefs) add(path string, dir bool) {
+	if path == "" {
+		return
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	if dir {
+		r.dirs = append(r.dirs, absPath)
+		return
+	}
+	r.files[absPath] = true
+}
+
+func (r *orphanRefs) contains(path string) bool {
+	if r.files[path] {
+		return true
+	}
+	for _, dir := range r.dirs {
+		if isSubPath(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// references 当前节点队列中的任务和进行中的分片上传引用的文件
+func (o *OrphanSweeper) references(ctx context.Context) (*orphanRefs, error) {
+	refs := &orphanRefs{files: map[string]bool{}}
+	entries, err := o.job.queue.List(ctx, &DelayJobFilter{Host: o.job.queue.Host()})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		refs.add(entry.Job.ID, false)
+		refs.add(entry.Job.path(), entry.Job.Type == DJ_DELETE_DIR)
+	}
+	if queue, ok := o.job.queue.(*boltDelayQueue); ok {
+		refs.add(queue.path, false)
+	}
+	if err := o.multipartReferences(ctx, refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// multipartReferences 进行中的分片上传已上传的分片
+func (o *OrphanSweeper) multipartReferences(ctx context.Context, refs *orphanRefs) error {
+	if o.job.opts.Metadata == nil {
+		return nil
+	}
+	return o.job.opts.Metadata.ScanChunks(ctx, func(chunk *MultipartUploadChunk) error {
+		u, err := url.Parse(chunk.DownloadPath)
+		if err != nil {
+			return nil
+		}
+		refs.add(filepath.Join(o.uploadPath, u.Path), false)
+		return nil
+	})
+}
+
+// publishedInPlace 生成的resourceId发布时文件不移动, 暂存目录中的文件就是发布后的文件
+func publishedInPlace(path string) bool {
+	return ownerHost(filepath.Base(path)) != ""
+}
+
+// Sweep 扫描一次暂存目录, 引用读取失败时不删除任何文件
+func (o *OrphanSweeper) Sweep(ctx context.Context) (*OrphanSweepReport, error) {
+	startedAt := o.job.opts.now()
+	report := &OrphanSweepReport{DryRun: o.DryRun, StartedAt: startedAt.Unix()}
+	dirs, err := o.stagingDirs()
+	if err != nil {
+		return nil, err
+	}
+	report.Dirs = dirs
+	refs, err := o.references(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root, _ := filepath.Abs(o.uploadPath)
+	cutoff := startedAt.Add(-o.Retention)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				report.Errors++
+				o.job.opts.Logger.Warnf("sweep orphan '%s' fail[%s]", path, err.Error())
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			report.Scanned++
+			info, err := d.Info()
+			if err != nil {
+				report.Errors++
+				return nil
+			}
+			if info.ModTime().After(cutoff) {
+				report.Recent++
+				return nil
+			}
+			if refs.contains(path) {
+				report.Referenced++
+				return nil
+			}
+			if publishedInPlace(path) {
+				report.Published++
+				return nil
+			}
+			report.Orphaned++
+			report.OrphanedBytes += info.Size()
+			if len(report.Files) < ORPHAN_SWEEP_REPORT_FILES {
+				relPath, _ := filepath.Rel(root, path)
+				report.Files = append(report.Files, relPath)
+			}
+			if o.DryRun {
+				return nil
+			}
+			if err := removeConfined(path, []string{root}); err != nil {
+				report.Errors++
+				o.job.opts.Logger.Errorf("remove orphan file '%s' fail[%s]", path, err.Error())
+				return nil
+			}
+			report.Deleted++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.Duration = o.job.opts.now().Sub(startedAt).String()
+	o.job.opts.Logger.Infof("sweep orphan files dry_run=%v scanned=%d recent=%d referenced=%d published=%d orphaned=%d(%d bytes) deleted=%d errors=%d in %s",
+		report.DryRun, report.Scanned, report.Recent, report.Referenced, report.Published, report.Orphaned, report.OrphanedBytes,
+		report.Deleted, report.Errors, report.Duration)
+	return report, nil
+}
@@ -0,0 +1,119 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOrphanSweeper(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	queue := openTestBoltDelayQueue(t, filepath.Join(t.TempDir(), "delay_job.db"))
+	defer queue.Close()
+	job, err := NewStorageDelayJobWithOptions(&Options{UploadPath: root, RootPath: t.TempDir(), DelayQueue: queue})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	files := map[string]time.Time{
+		"tmp/orphan.zip":     old,
+		"tmp/recent.zip":     time.Now(),
+		"icon/queued.png":    old,
+		"icon/dir/chunk.png": old,
+		"../outside.png":     old,
+	}
+	for name, modTime := range files {
+		path := filepath.Join(root, "icon", "..", name)
+		if err := os.MkdirAll(filepath.Dir(path), DIR_FILE_MODE); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, pngContent, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	job.AddJob(context.Background(), NewDeleteFileJob(filepath.Join(root, "icon/queued.png")), time.Now().Add(time.Hour))
+	dirJob, _ := NewDelayJob(DJ_DELETE_DIR, "", &DeleteDirPayload{Path: filepath.Join(root, "icon/dir")})
+	job.AddJob(context.Background(), dirJob, time.Now().Add(time.Hour))
+
+	sweeper := NewOrphanSweeper(job)
+	sweeper.Retention = 24 * time.Hour
+	report, err := sweeper.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Scanned != 4 || report.Recent != 1 || report.Referenced != 2 || report.Orphaned != 1 ||
+		len(report.Files) != 1 || report.Files[0] != filepath.Join("tmp", "orphan.zip") {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tmp/orphan.zip")); err != nil {
+		t.Fatalf("dry run deleted file[%v]", err)
+	}
+
+	sweeper.DryRun = false
+	if report, err = sweeper.Sweep(ctx); err != nil || report.Deleted != 1 {
+		t.Fatalf("unexpected report %+v[%v]", report, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tmp/orphan.zip")); !os.IsNotExist(err) {
+		t.Fatalf("orphan file not deleted[%v]", err)
+	}
+	for _, name := range []string{"tmp/recent.zip", "icon/queued.png", "icon/dir/chunk.png", "../outside.png"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Fatalf("file '%s' deleted[%v]", name, err)
+		}
+	}
+
+	// 上传目录同时是cdn目录时不扫描
+	job.opts.RootPath = root
+	if _, err := sweeper.Sweep(ctx); err == nil {
+		t.Fatal("expect overlap error")
+	}
+}
+
+func TestOrphanSweeperPublishedInPlace(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	queue := openTestBoltDelayQueue(t, filepath.Join(t.TempDir(), "delay_job.db"))
+	defer queue.Close()
+	job, err := NewStorageDelayJobWithOptions(&Options{UploadPath: root, RootPath: t.TempDir(), DelayQueue: queue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有指定resourceId, 发布后文件留在暂存目录
+	storage, err := NewStorageWithOptions(RT_GAME_ICON, "", &Options{UploadPath: root, RootPath: job.opts.RootPath, DelayJob: job})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadFullPath := storage.uploadFullPathByName("icon.png")
+	if err := os.WriteFile(uploadFullPath, pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage.delayDelete(ctx, uploadFullPath)
+	uploadPath := fmt.Sprintf("%s?v=%s&where=upload", storage.fileName("icon.png"), storage.version)
+	if _, err := storage.UploadAndRename(ctx, uploadPath); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := job.List(ctx, &DelayJobFilter{}); len(entries) != 0 {
+		t.Fatalf("published file still queued %+v", entries)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(uploadFullPath, old, old)
+
+	sweeper := NewOrphanSweeper(job)
+	sweeper.DryRun = false
+	report, err := sweeper.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Published != 1 || report.Orphaned != 0 || report.Deleted != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := os.Stat(uploadFullPath); err != nil {
+		t.Fatalf("published file '%s' deleted[%v]", uploadFullPath, err)
+	}
+}
@@ -0,0 +1,63 @@
+package pbadapter
+
+import (
+	merr "api_mgr/model/errors"
+	"api_mgr/upload"
+	"context"
+	"errors"
+
+	errDef "git.yj.live/Golang/source/errors"
+
+	"google.golang.org/grpc/codes"
+)
+
+type grpcMapping struct {
+	kind error
+	code codes.Code
+}
+
+// grpcMappings upload包错误类型对应的grpc状态码, http状态码见 upload.HTTPStatus
+var grpcMappings = []grpcMapping{
+	{upload.ErrNotFound, codes.NotFound},
+	{upload.ErrTooLarge, codes.InvalidArgument},
+	{upload.ErrUnsupportedType, codes.InvalidArgument},
+	{upload.ErrChecksumMismatch, codes.InvalidArgument},
+	{upload.ErrIncomplete, codes.FailedPrecondition},
+	{upload.ErrExpired, codes.FailedPrecondition},
+	{upload.ErrInvalidArgument, codes.InvalidArgument},
+	{upload.ErrQuotaExceeded, codes.ResourceExhausted},
+	{context.Canceled, codes.Canceled},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+	{upload.ErrUpstream, codes.Unavailable},
+}
+
+// GRPCCode 错误对应的grpc状态码, 未知错误为 codes.Internal
+func GRPCCode(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+	for _, mapping := range grpcMappings {
+		if errors.Is(err, mapping.kind) {
+			return mapping.code
+		}
+	}
+	return codes.Internal
+}
+
+// GRPCError 转换为grpc服务返回的错误, 请求错误使用Warnf, 内部错误使用Errorf
+func GRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := GRPCCode(err)
+	if code == codes.Internal {
+		return errDef.Errorf(merr.SYSTEM_CODE,
+			errDef.INTERNAL_SERVER_ERR,
+			code,
+			"%s", upload.PublicMessage(err))
+	}
+	return errDef.Warnf(merr.SYSTEM_CODE,
+		errDef.INVALID_REQUEST_ERR,
+		code,
+		"%s", upload.PublicMessage(err))
+}
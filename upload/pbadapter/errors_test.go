@@ -0,0 +1,34 @@
+package pbadapter
+
+import (
+	"api_mgr/upload"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestGRPCCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{nil, codes.OK},
+		{fmt.Errorf("done fail[%w]", &upload.Error{Kind: upload.ErrIncomplete, Message: "chunks not enough"}), codes.FailedPrecondition},
+		{&upload.Error{Kind: upload.ErrQuotaExceeded}, codes.ResourceExhausted},
+		// 原因是ctx取消时按取消处理
+		{&upload.Error{Op: "storage.upload", Err: context.Canceled}, codes.Canceled},
+		{&upload.Error{Kind: upload.ErrUpstream, Err: errors.New("connection refused")}, codes.Unavailable},
+		{&upload.Error{Kind: upload.ErrUpstream, Err: context.DeadlineExceeded}, codes.DeadlineExceeded},
+		{errors.New("disk full"), codes.Internal},
+	} {
+		if code := GRPCCode(c.err); code != c.code {
+			t.Fatalf("error %v code %v, want %v", c.err, code, c.code)
+		}
+	}
+	if GRPCError(nil) != nil {
+		t.Fatal("nil error mapped")
+	}
+}
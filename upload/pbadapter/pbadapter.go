@@ -0,0 +1,132 @@
+// Package pbadapter grpc服务使用, 在protos_repo/file和upload包的类型之间转换
+package pbadapter
+
+import (
+	"api_mgr/upload"
+	"api_mgr/upload/apimgr"
+	"context"
+	"mime/multipart"
+	pb "protos_repo/file"
+)
+
+// StartRequestFromPB .
+func StartRequestFromPB(in *pb.MultipartUploadStartReq) *upload.MultipartUploadStartRequest {
+	return &upload.MultipartUploadStartRequest{
+		Type:     upload.ResourceType(in.Type),
+		Filename: in.Filename,
+	}
+}
+
+// StartInfoToPB .
+func StartInfoToPB(in *upload.MultipartUploadStartResult) *pb.MultipartUploadStartInfo {
+	if in == nil {
+		return &pb.MultipartUploadStartInfo{}
+	}
+	return &pb.MultipartUploadStartInfo{UploadId: in.UploadId}
+}
+
+// ChunkRequestFromPB .
+func ChunkRequestFromPB(in *pb.MultipartUploadReq) *upload.MultipartUploadChunkRequest {
+	return &upload.MultipartUploadChunkRequest{
+		UploadId:   in.UploadId,
+		Chunk:      in.Chunk,
+		ContentMd5: in.ContentMd5,
+		Size:       in.Size,
+	}
+}
+
+// ChunkFromPB .
+func ChunkFromPB(in *pb.MultipartUploadChunkInfo) *upload.MultipartUploadChunk {
+	return &upload.MultipartUploadChunk{
+		UploadId:     in.UploadId,
+		Chunk:        in.Chunk,
+		ContentMd5:   in.ContentMd5,
+		Validity:     in.Validity,
+		DownloadPath: in.DownloadPath,
+	}
+}
+
+// ChunkToPB .
+func ChunkToPB(in *upload.MultipartUploadChunk) *pb.MultipartUploadChunkInfo {
+	if in == nil {
+		return &pb.MultipartUploadChunkInfo{}
+	}
+	return &pb.MultipartUploadChunkInfo{
+		UploadId:     in.UploadId,
+		Chunk:        in.Chunk,
+		ContentMd5:   in.ContentMd5,
+		Validity:     in.Validity,
+		DownloadPath: in.DownloadPath,
+	}
+}
+
+// ChunksToPB .
+func ChunksToPB(in []*upload.MultipartUploadChunk) *pb.MultipartUploadChunks {
+	chunks := &pb.MultipartUploadChunks{}
+	for _, chunk := range in {
+		chunks.Data = append(chunks.Data, ChunkToPB(chunk))
+	}
+	return chunks
+}
+
+// DoneToPB .
+func DoneToPB(in *upload.MultipartUploadDoneResult) *pb.MultipartUploadDoneResp {
+	if in == nil {
+		return &pb.MultipartUploadDoneResp{}
+	}
+	return &pb.MultipartUploadDoneResp{
+		UploadId:     in.UploadId,
+		DownloadPath: in.DownloadPath,
+		Validity:     in.Validity,
+	}
+}
+
+// MultipartStorage 使用pb类型的分片上传, 与升级前的接口相同
+// 返回的错误使用 GRPCError 转换, 请求错误返回具体原因, 内部错误只返回 internal server error
+type MultipartStorage struct {
+	*upload.MultipartStorage
+}
+
+// NewMultipartStorage .
+func NewMultipartStorage(resourceType upload.ResourceType, resourceId string) (*MultipartStorage, error) {
+	storage, err := apimgr.NewMultipartStorage(resourceType, resourceId)
+	return &MultipartStorage{MultipartStorage: storage}, GRPCError(err)
+}
+
+// Start 分片上传准备
+func (s *MultipartStorage) Start(ctx context.Context, in *pb.MultipartUploadStartReq, size int64) (*pb.MultipartUploadStartInfo, *upload.MultipartUploadPlan, error) {
+	result, plan, err := s.MultipartStorage.Start(ctx, StartRequestFromPB(in), size)
+	return StartInfoToPB(result), plan, GRPCError(err)
+}
+
+// Upload 分片上传
+func (s *MultipartStorage) Upload(ctx context.Context, in *pb.MultipartUploadReq, file *multipart.FileHeader) (*pb.MultipartUploadChunkInfo, error) {
+	chunk, err := s.MultipartStorage.Upload(ctx, ChunkRequestFromPB(in), file)
+	return ChunkToPB(chunk), GRPCError(err)
+}
+
+// Done 分片文件上传结束
+func (s *MultipartStorage) Done(ctx context.Context, in *pb.MultipartUploadIDReq) (*pb.MultipartUploadDoneResp, error) {
+	result, err := s.MultipartStorage.Done(ctx, in.UploadId)
+	return DoneToPB(result), GRPCError(err)
+}
+
+// GetMultipartUploadChunk 获取分块详情
+func (s *MultipartStorage) GetMultipartUploadChunk(ctx context.Context, in *pb.MultipartUploadChunkReq) (*pb.MultipartUploadChunkInfo, error) {
+	chunk, err := s.MultipartStorage.GetMultipartUploadChunk(ctx, in.UploadId, in.Chunk)
+	return ChunkToPB(chunk), GRPCError(err)
+}
+
+// GetMultipartUploadChunks 获取上传的分块
+func (s *MultipartStorage) GetMultipartUploadChunks(ctx context.Context, in *pb.MultipartUploadIDReq) (*pb.MultipartUploadChunks, error) {
+	chunks, err := s.MultipartStorage.GetMultipartUploadChunks(ctx, in.UploadId)
+	if err != nil {
+		return &pb.MultipartUploadChunks{}, GRPCError(err)
+	}
+	return ChunksToPB(chunks), nil
+}
+
+// Abort 取消分片上传
+func (s *MultipartStorage) Abort(ctx context.Context, in *pb.MultipartUploadIDReq) error {
+	return GRPCError(s.MultipartStorage.Abort(ctx, in.UploadId))
+}
@@ -0,0 +1,258 @@
+package upload
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 节点间文件传输
+// resourceId 由 uuid_hostname 组成, 暂存文件只存在于上传时所在节点的uploadPath下
+// 当前节点找不到暂存文件时, 根据resourceId找到所属节点并从该节点拉取
+
+const (
+	// PEER_FETCH_PATH 节点间拉取暂存文件的http路径
+	PEER_FETCH_PATH = "/storage/peer/fetch"
+
+	peerHeaderExpires   = "X-Peer-Expires"
+	peerHeaderSignature = "X-Peer-Signature"
+)
+
+// PeerServer 对其他节点提供暂存文件下载
+type PeerServer struct {
+	uploadPath string
+	opts       *Options
+}
+
+// NewPeerServerWithOptions 配置不合法时记录错误日志, 不合法的配置项使用默认值
+func NewPeerServerWithOptions(opts *Options) *PeerServer {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		opts.Logger.Errorf("load upload config fail, invalid items use default[%s]", err.Error())
+	}
+	return &PeerServer{uploadPath: opts.uploadRoot(), opts: opts}
+}
+
+// ServeHTTP 返回uploadPath下的暂存文件, 请求需要携带签名
+func (p *PeerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relPath := r.URL.Query().Get("path")
+	if err := peerVerify(p.opts, relPath, r.Header.Get(peerHeaderExpires), r.Header.Get(peerHeaderSignature)); err != nil {
+		p.opts.Logger.Warnf("peer fetch '%s' from '%s' refused[%s]", relPath, r.RemoteAddr, err.Error())
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	fullPath := filepath.Join(p.uploadPath, filepath.Clean("/"+relPath))
+	file, err := os.Open(fullPath)
+	if err != nil {
+		p.opts.Logger.Warnf("peer fetch open file '%s' fail[%s]", fullPath, err.Error())
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	p.opts.Logger.Debugf("peer fetch file '%s' by '%s'", fullPath, r.RemoteAddr)
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
+}
+
+// PeerClient 从其他节点拉取暂存文件
+type PeerClient struct {
+	client *http.Client
+	opts   *Options
+}
+
+// NewPeerClientWithOptions 配置不合法时记录错误日志, 不合法的配置项使用默认值
+func NewPeerClientWithOptions(opts *Options) *PeerClient {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		opts.Logger.Errorf("load upload config fail, invalid items use default[%s]", err.Error())
+	}
+	return &PeerClient{client: &http.Client{Timeout: opts.settings().Peer.Timeout}, opts: opts}
+}
+
+// Fetch 从host拉取暂存文件relPath并保存到dst, ctx取消时停止下载
+func (c *PeerClient) Fetch(ctx context.Context, host, relPath, dst string) error {
+	if peerSecret(c.opts) == "" {
+		return fmt.Errorf("peer fetch disabled, 'storage.peer.secret' not set")
+	}
+	expires := strconv.FormatInt(c.opts.now().Add(time.Minute).Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf(c.opts.settings().Peer.Address, host)+PEER_FETCH_PATH+"?path="+url.QueryEscape(relPath), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(peerHeaderExpires, expires)
+	req.Header.Set(peerHeaderSignature, peerSign(c.opts, relPath, expires))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("peer fetch '%s' from '%s' fail[%s]", relPath, host, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return newError(ErrNotFound, "peer.fetch", "peer fetch '%s' from '%s' fail[%s]", relPath, host, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer fetch '%s' from '%s' fail[%s]", relPath, host, resp.Status)
+	}
+	if dir := filepath.Dir(dst); !isExist(dir) {
+		if err := os.MkdirAll(dir, DIR_FILE_MODE); err != nil {
+			return err
+		}
+	}
+	// 先写临时文件, 完成后再重命名, 避免留下不完整的文件
+	tmpFile, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".peer_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("peer fetch '%s' from '%s' fail[%s]", relPath, host, err.Error())
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), dst)
+}
+
+// ownerHost 根据resourceId获取文件所属节点, 自定义resourceId返回空
+func ownerHost(resourceId string) string {
+	index := strings.Index(resourceId, "_")
+	if index < 0 {
+		return ""
+	}
+	if _, err := uuid.Parse(resourceId[:index]); err != nil {
+		return ""
+	}
+	return resourceId[index+1:]
+}
+
+// ownerHostsByPath 根据暂存文件路径获取文件所属节点, 可能的节点按顺序返回
+// 文件名为 uuid_hostname + 后缀, hostname可以包含'.', 没有后缀的文件无法区分
+// 最后一段'.'之后是后缀时去掉后的是所属节点, 否则整个是所属节点
+func ownerHostsByPath(uploadPath string) []string {
+	host := ownerHost(filepath.Base(uploadPath))
+	if host == "" {
+		return nil
+	}
+	if trimmed := strings.TrimSuffix(host, filepath.Ext(host)); trimmed != "" && trimmed != host {
+		return []string{trimmed, host}
+	}
+	return []string{host}
+}
+
+// fetchFromOwner 暂存文件不在当前节点时从所属节点拉取
+// relPath 为相对uploadPath的路径
+func (s *Storage) fetchFromOwner(ctx context.Context, relPath string) error {
+	hosts := ownerHostsByPath(relPath)
+	if len(hosts) == 0 {
+		return newError(ErrNotFound, "peer.fetch", "file '%s' owner host unknown", relPath)
+	}
+	for _, host := range hosts {
+		if host == s.opts.Hostname {
+			// 所属节点是当前节点, 文件已被延迟任务删除
+			return newError(ErrExpired, "peer.fetch", "file '%s' not found in owner host '%s'", relPath, host)
+		}
+	}
+	fullPath := filepath.Join(s.uploadPath, relPath)
+	if !isSubPath(fullPath, s.uploadPath) {
+		return newError(ErrInvalidArgument, "peer.fetch", "invalid upload path '%s'", relPath)
+	}
+	// 只从已知节点拉取, 文件名中的节点由调用方传入, 不能直接作为请求地址
+	known, err := s.delayJob.PeerHosts(ctx)
+	if err != nil {
+		return internalError("peer.fetch", err, "fetch peer hosts")
+	}
+	client := NewPeerClientWithOptions(s.opts)
+	for _, host := range hosts {
+		if !known[host] {
+			s.opts.Logger.Warnf("fetch file '%s' from unknown host '%s' refused", relPath, host)
+			err = newError(ErrNotFound, "peer.fetch", "file '%s' owner host '%s' unknown", relPath, host)
+			continue
+		}
+		s.opts.Logger.Infof("fetch file '%s' from host '%s'", relPath, host)
+		if err = client.Fetch(ctx, host, relPath, fullPath); err == nil {
+			break
+		}
+		s.opts.Logger.Errorf("fetch file '%s' from host '%s' fail[%s]", relPath, host, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	// 拉取的文件同样需要延迟删除
+	s.delayDelete(ctx, fullPath)
+	return nil
+}
+
+// PeerHosts 可以拉取暂存文件的节点
+// 配置了 storage.peer.hosts 时使用配置的节点, 否则使用redis存储中有心跳的节点
+func (s *StorageDelayJob) PeerHosts(ctx context.Context) (map[string]bool, error) {
+	known := map[string]bool{}
+	if configured := s.opts.settings().Peer.Hosts; len(configured) > 0 {
+		for _, host := range configured {
+			known[host] = true
+		}
+		return known, nil
+	}
+	queue, ok := s.queue.(*redisDelayQueue)
+	if !ok {
+		return known, nil
+	}
+	hosts, err := queue.hosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		known[host] = true
+	}
+	return known, nil
+}
+
+func peerSecret(opts *Options) string {
+	return opts.settings().Peer.Secret
+}
+
+func peerSign(opts *Options, relPath, expires string) string {
+	mac := hmac.New(sha256.New, []byte(peerSecret(opts)))
+	mac.Write([]byte(relPath + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func peerVerify(opts *Options, relPath, expires, signature string) error {
+	if peerSecret(opts) == "" {
+		return fmt.Errorf("peer fetch disabled")
+	}
+	if relPath == "" {
+		return fmt.Errorf("path empty")
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expires '%s'", expires)
+	}
+	if opts.now().Unix() > expiresAt {
+		return newError(ErrExpired, "peer.verify", "signature expired")
+	}
+	if !hmac.Equal([]byte(peerSign(opts, relPath, expires)), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
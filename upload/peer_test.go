@@ -0,0 +1,187 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOwnerHostsByPath(t *testing.T) {
+	id := "4f1c2f6e-6f4a-4d59-9a55-0d6f3f0b8a11"
+	for path, want := range map[string][]string{
+		"icon/" + id + "_node1.png":        {"node1", "node1.png"},
+		"icon/" + id + "_node.example.png": {"node.example", "node.example.png"},
+		"icon/" + id + "_node.example":     {"node", "node.example"},
+		"icon/" + id + "_node1":            {"node1"},
+		"icon/custom_node1.png":            nil,
+		"icon/a.png":                       nil,
+	} {
+		if hosts := ownerHostsByPath(path); !reflect.DeepEqual(hosts, want) {
+			t.Fatalf("path '%s' owner hosts %v, want %v", path, hosts, want)
+		}
+	}
+}
+
+func newPeerTestServer(t *testing.T, clock Clock) (*httptest.Server, string) {
+	uploadPath := filepath.Join(t.TempDir(), "upload")
+	if err := os.MkdirAll(filepath.Join(uploadPath, "icon"), DIR_FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadPath, "icon/a.png"), pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// uploadPath之外的文件
+	if err := os.WriteFile(filepath.Join(filepath.Dir(uploadPath), "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewPeerServerWithOptions(&Options{
+		UploadPath: uploadPath,
+		Config:     mapConfig{"storage.peer.secret": "secret"},
+		Clock:      clock,
+	}))
+	t.Cleanup(server.Close)
+	return server, mustHost(t, server.URL)
+}
+
+func newPeerTestClient(clock Clock, secret string) *PeerClient {
+	return NewPeerClientWithOptions(&Options{
+		Config: mapConfig{"storage.peer.secret": secret, "storage.peer.address": "http://%s"},
+		Clock:  clock,
+	})
+}
+
+func TestPeerFetch(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	_, host := newPeerTestServer(t, clock)
+	ctx := context.Background()
+
+	t.Run("ok", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "icon/a.png")
+		if err := newPeerTestClient(clock, "secret").Fetch(ctx, host, "icon/a.png", dst); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := os.ReadFile(dst); err != nil || string(content) != string(pngContent) {
+			t.Fatalf("unexpected fetched content[%v]", err)
+		}
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		err := newPeerTestClient(clock, "other").Fetch(ctx, host, "icon/a.png", filepath.Join(t.TempDir(), "a.png"))
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("want forbidden, got %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		past := &testClock{now: clock.now.Add(-2 * time.Minute)}
+		err := newPeerTestClient(past, "secret").Fetch(ctx, host, "icon/a.png", filepath.Join(t.TempDir(), "a.png"))
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("want forbidden, got %v", err)
+		}
+	})
+
+	t.Run("path traversal", func(t *testing.T) {
+		err := newPeerTestClient(clock, "secret").Fetch(ctx, host, "../secret.txt", filepath.Join(t.TempDir(), "secret.txt"))
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("want not found, got %v", err)
+		}
+	})
+}
+
+func TestPeerServerSignature(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	server, _ := newPeerTestServer(t, clock)
+	opts, _ := (&Options{Config: mapConfig{"storage.peer.secret": "secret"}}).withDefaults()
+	expires := strconv.FormatInt(clock.now.Add(time.Minute).Unix(), 10)
+	for name, header := range map[string]map[string]string{
+		"missing":     {},
+		"bad":         {peerHeaderExpires: expires, peerHeaderSignature: "00"},
+		"other path":  {peerHeaderExpires: expires, peerHeaderSignature: peerSign(opts, "icon/b.png", expires)},
+		"bad expires": {peerHeaderExpires: "soon", peerHeaderSignature: peerSign(opts, "icon/a.png", "soon")},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+PEER_FETCH_PATH+"?path="+url.QueryEscape("icon/a.png"), nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s signature got %s", name, resp.Status)
+		}
+	}
+}
+
+func mustHost(t *testing.T, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func TestFetchFromOwnerKnownHosts(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	peerPath := t.TempDir()
+	var requests int
+	peer := NewPeerServerWithOptions(&Options{UploadPath: peerPath, Config: mapConfig{"storage.peer.secret": "secret"}, Clock: clock})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		peer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	// 所属节点为测试服务地址
+	host := mustHost(t, server.URL)
+	relPath := "/icon/4f1c2f6e-6f4a-4d59-9a55-0d6f3f0b8a11_" + host + ".png"
+	if err := os.MkdirAll(filepath.Join(peerPath, "icon"), DIR_FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(peerPath, relPath), pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newStorage := func(config mapConfig) *Storage {
+		queue := openTestBoltDelayQueue(t, filepath.Join(t.TempDir(), "delay_job.db"))
+		t.Cleanup(func() { queue.Close() })
+		config["storage.peer.secret"] = "secret"
+		config["storage.peer.address"] = "http://%s"
+		storage, err := NewStorageWithOptions(RT_GAME_ICON, "", &Options{
+			UploadPath: t.TempDir(),
+			Hostname:   "local",
+			Config:     config,
+			Clock:      clock,
+			DelayQueue: queue,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}
+	ctx := context.Background()
+
+	// 没有心跳也没有配置的节点不发起请求
+	if err := newStorage(mapConfig{}).fetchFromOwner(ctx, relPath); !errors.Is(err, ErrNotFound) || requests != 0 {
+		t.Fatalf("unknown host want not found without request, got %v[%d]", err, requests)
+	}
+	storage := newStorage(mapConfig{"storage.peer.hosts": "other, " + host})
+	if err := storage.fetchFromOwner(ctx, "/../"+relPath); !errors.Is(err, ErrInvalidArgument) || requests != 0 {
+		t.Fatalf("path traversal want invalid argument without request, got %v[%d]", err, requests)
+	}
+	if err := storage.fetchFromOwner(ctx, relPath); err != nil || requests != 1 {
+		t.Fatalf("fetch from known host fail %v[%d]", err, requests)
+	}
+	if content, err := os.ReadFile(filepath.Join(storage.uploadPath, relPath)); err != nil || string(content) != string(pngContent) {
+		t.Fatalf("unexpected fetched content[%v]", err)
+	}
+}
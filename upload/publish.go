@@ -0,0 +1,95 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+)
+
+// PUBLISH_PATH 发布已上传文件的http路径, 与 client.DefaultPaths.Publish 相同
+const PUBLISH_PATH = "/upload/publish"
+
+// PublishRequest 发布普通上传或分片上传完成的文件
+type PublishRequest struct {
+	Type ResourceType `json:"type"`
+	// 为空时使用上传时生成的文件名
+	ResourceId string `json:"resource_id"`
+	// Upload或者分片上传Done返回的路径
+	DownloadPath string `json:"download_path"`
+	// 是否解压后发布, 解压后删除压缩包
+	Unzip bool `json:"unzip"`
+	// 解压到资源类型目录下的子目录
+	UnzipPath string `json:"unzip_path"`
+}
+
+// PublishResult 发布后的路径, 解压时为解压的目录
+type PublishResult struct {
+	Path string `json:"path"`
+}
+
+// PublishServer 发布接口, 鉴权由挂载的服务负责
+//
+//	POST /upload/publish {"type": 13, "download_path": "", "unzip": true}
+type PublishServer struct {
+	opts *Options
+}
+
+// NewPublishServerWithOptions opts.DelayJob为空时按opts创建, 所有请求共用
+func NewPublishServerWithOptions(opts *Options) (*PublishServer, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if opts.DelayJob == nil {
+		delayJob, err := NewStorageDelayJobWithOptions(opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.DelayJob = delayJob
+	}
+	return &PublishServer{opts: opts}, nil
+}
+
+// ServeHTTP .
+func (p *PublishServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PublishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	result, err := p.publish(r, &req)
+	if err != nil {
+		p.opts.Logger.Errorf("publish '%s' fail[%s]", req.DownloadPath, err.Error())
+		http.Error(w, PublicMessage(err), HTTPStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (p *PublishServer) publish(r *http.Request, req *PublishRequest) (*PublishResult, error) {
+	if req.DownloadPath == "" {
+		return nil, newError(ErrInvalidArgument, "storage.publish", "download_path required")
+	}
+	storage, err := NewStorageWithOptions(req.Type, req.ResourceId, p.opts)
+	if err != nil {
+		return nil, err
+	}
+	if !req.Unzip {
+		path, err := storage.UploadAndRename(r.Context(), req.DownloadPath)
+		if err != nil {
+			return nil, err
+		}
+		return &PublishResult{Path: path}, nil
+	}
+	// 解压路径只能在资源类型目录下
+	unzipPath := filepath.Clean("/" + req.UnzipPath)
+	if err := storage.UnzipAndDeleteWithPath(r.Context(), req.DownloadPath, unzipPath); err != nil {
+		return nil, err
+	}
+	return &PublishResult{Path: filepath.ToSlash(filepath.Join(storage.typeDef().Dir, unzipPath))}, nil
+}
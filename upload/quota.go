@@ -0,0 +1,275 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// QuotaLimit 资源类型和租户的限制, 0表示不限制
+type QuotaLimit struct {
+	Type   int64
+	Tenant int64
+}
+
+// check 用量增加delta后是否超过限制, delta不大于0时不检查
+func (l QuotaLimit) check(op string, what string, resourceType ResourceType, typeUsed, tenantUsed, delta int64) error {
+	if delta <= 0 {
+		return nil
+	}
+	if l.Type > 0 && typeUsed+delta > l.Type {
+		return newError(ErrQuotaExceeded, op, "resource_type %d %s quota %d exceeded, used %d, add %d",
+			resourceType, what, l.Type, typeUsed, delta)
+	}
+	if l.Tenant > 0 && tenantUsed+delta > l.Tenant {
+		return newError(ErrQuotaExceeded, op, "tenant %s quota %d exceeded, used %d, add %d",
+			what, l.Tenant, tenantUsed, delta)
+	}
+	return nil
+}
+
+func (l QuotaLimit) isZero() bool {
+	return l.Type <= 0 && l.Tenant <= 0
+}
+
+// UsageStore 当前租户按资源类型的用量
+// 发布文件大小在发布和删除cdn文件时更新
+// 分片上传在Start时记录, Done或Abort时释放, 没有结束的分片上传过期后自动释放
+type UsageStore interface {
+	// AddBytes 修改发布文件大小, delta大于0且超过limit时不修改并返回 ErrQuotaExceeded
+	AddBytes(ctx context.Context, resourceType ResourceType, delta int64, limit QuotaLimit) error
+	// ResetBytes 重新统计后覆盖所有资源类型的发布文件大小
+	ResetBytes(ctx context.Context, bytes map[ResourceType]int64) error
+	// AcquireMultipart 记录进行中的分片上传, expiresAt后自动释放
+	// 超过limit时返回 ErrQuotaExceeded, 已记录的uploadId只更新过期时间
+	AcquireMultipart(ctx context.Context, resourceType ResourceType, uploadId string, expiresAt time.Time, limit QuotaLimit) error
+	// ReleaseMultipart 分片上传结束, 没有记录时忽略
+	ReleaseMultipart(ctx context.Context, uploadId string) error
+	// Usage 当前用量
+	Usage(ctx context.Context) (*UsageCounters, error)
+}
+
+// UsageCounters 按资源类型的用量
+type UsageCounters struct {
+	Bytes            map[ResourceType]int64
+	MultipartUploads map[ResourceType]int64
+}
+
+func sumUsage(usage map[ResourceType]int64) int64 {
+	var total int64
+	for _, n := range usage {
+		total += n
+	}
+	return total
+}
+
+// ResourceTypeUsage 资源类型的用量和限制, 限制为0表示不限制
+type ResourceTypeUsage struct {
+	ResourceType        ResourceType `json:"resource_type"`
+	Name                string       `json:"name"`
+	Bytes               int64        `json:"bytes"`
+	MaxBytes            int64        `json:"max_bytes"`
+	MultipartUploads    int64        `json:"multipart_uploads"`
+	MaxMultipartUploads int64        `json:"max_multipart_uploads"`
+}
+
+// UsageReport 当前租户的用量, Types只包含有用量或者有限制的资源类型
+type UsageReport struct {
+	Namespace           string               `json:"namespace,omitempty"`
+	Bytes               int64                `json:"bytes"`
+	MaxBytes            int64                `json:"max_bytes"`
+	MultipartUploads    int64                `json:"multipart_uploads"`
+	MaxMultipartUploads int64                `json:"max_multipart_uploads"`
+	Types               []*ResourceTypeUsage `json:"types"`
+}
+
+// GetUsageWithOptions opts.Usage为空时返回错误
+func GetUsageWithOptions(ctx context.Context, opts *Options) (*UsageReport, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Usage == nil {
+		return nil, errors.New("usage store not set")
+	}
+	counters, err := opts.Usage.Usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings := opts.settings()
+	report := &UsageReport{
+		Namespace:           opts.Namespace.String(),
+		Bytes:               sumUsage(counters.Bytes),
+		MaxBytes:            settings.Quota.MaxBytes,
+		MultipartUploads:    sumUsage(counters.MultipartUploads),
+		MaxMultipartUploads: settings.Quota.MaxMultipartUploads,
+		Types:               []*ResourceTypeUsage{},
+	}
+	for _, def := range opts.ResourceTypes.All() {
+		usage := &ResourceTypeUsage{
+			ResourceType:        def.ID,
+			Name:                def.Name,
+			Bytes:               counters.Bytes[def.ID],
+			MaxBytes:            settings.bytesQuota(def.ID).Type,
+			MultipartUploads:    counters.MultipartUploads[def.ID],
+			MaxMultipartUploads: settings.multipartQuota(def.ID).Type,
+		}
+		if usage.Bytes != 0 || usage.MaxBytes > 0 || usage.MultipartUploads > 0 || usage.MaxMultipartUploads > 0 {
+			report.Types = append(report.Types, usage)
+		}
+	}
+	return report, nil
+}
+
+// RecalculateUsageWithOptions 按cdn目录重新统计发布文件大小
+// 开启用量统计前已经发布的文件不在用量中, 需要执行一次, 统计期间发布的文件可能不准确
+func RecalculateUsageWithOptions(ctx context.Context, opts *Options) (*UsageReport, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Usage == nil {
+		return nil, errors.New("usage store not set")
+	}
+	bytes := map[ResourceType]int64{}
+	// 多个资源类型使用同一个目录时只统计到第一个
+	counted := map[string]bool{}
+	for _, def := range opts.ResourceTypes.All() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dir, err := opts.cdnFilePath(def.ID)
+		if err != nil || counted[dir] {
+			continue
+		}
+		counted[dir] = true
+		if size := pathSize(dir); size > 0 {
+			bytes[def.ID] = size
+		}
+	}
+	if err := opts.Usage.ResetBytes(ctx, bytes); err != nil {
+		return nil, err
+	}
+	opts.Logger.Infof("recalculate usage of namespace '%s' bytes %d", opts.Namespace, sumUsage(bytes))
+	return GetUsageWithOptions(ctx, opts)
+}
+
+// pathSize 文件大小或目录下所有文件的大小, 不存在时为0
+func pathSize(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	if !info.IsDir() {
+		return info.Size()
+	}
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// publishedType path所在cdn目录的资源类型, 目录嵌套时使用最深的一个
+func (o *Options) publishedType(path string) (ResourceType, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, false
+	}
+	var (
+		matched    ResourceType
+		matchedDir string
+	)
+	for _, def := range o.ResourceTypes.All() {
+		dir, err := o.cdnFilePath(def.ID)
+		if err != nil {
+			continue
+		}
+		if dir, err = filepath.Abs(dir); err != nil {
+			continue
+		}
+		if isSubPath(path, dir) && len(dir) > len(matchedDir) {
+			matched, matchedDir = def.ID, dir
+		}
+	}
+	return matched, matchedDir != ""
+}
+
+// releaseBytes 删除或者发布失败后减少用量, 失败时只记录日志
+func (o *Options) releaseBytes(ctx context.Context, resourceType ResourceType, size int64) {
+	if o.Usage == nil || size == 0 {
+		return
+	}
+	if err := o.Usage.AddBytes(ctx, resourceType, -size, QuotaLimit{}); err != nil {
+		o.Logger.Errorf("release resource_type '%d' usage %d bytes fail[%s]", resourceType, size, err.Error())
+	}
+}
+
+// removePublished 删除文件或目录, 在资源类型的cdn目录下时减少用量
+func removePublished(ctx context.Context, opts *Options, path string, roots []string) error {
+	resourceType, ok := opts.publishedType(path)
+	if !ok || opts.Usage == nil {
+		return removeConfined(path, roots)
+	}
+	size := pathSize(path)
+	if err := removeConfined(path, roots); err != nil {
+		return err
+	}
+	opts.releaseBytes(ctx, resourceType, size)
+	return nil
+}
+
+// quotaValid 检查增加size字节后是否超过配额, 不占用配额, 发布时占用
+func (s *Storage) quotaValid(ctx context.Context, op string, size int64) error {
+	limit := s.opts.settings().bytesQuota(s.resourceType)
+	if s.opts.Usage == nil || limit.isZero() {
+		return nil
+	}
+	counters, err := s.opts.Usage.Usage(ctx)
+	if err != nil {
+		s.opts.Logger.Errorf("get usage fail[%s]", err.Error())
+		return internalError(op, err, "get usage")
+	}
+	return limit.check(op, "bytes", s.resourceType, counters.Bytes[s.resourceType], sumUsage(counters.Bytes), size)
+}
+
+// reserveBytes 发布前占用配额, delta为发布后cdn文件大小的变化
+func (s *Storage) reserveBytes(ctx context.Context, op string, delta int64) error {
+	if s.opts.Usage == nil || delta == 0 {
+		return nil
+	}
+	err := s.opts.Usage.AddBytes(ctx, s.resourceType, delta, s.opts.settings().bytesQuota(s.resourceType))
+	if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+		s.opts.Logger.Errorf("reserve resource_type '%d' usage %d bytes fail[%s]", s.resourceType, delta, err.Error())
+		return internalError(op, err, "reserve usage")
+	}
+	return err
+}
+
+// acquireMultipart Start时占用分片上传数量
+func (s *MultipartStorage) acquireMultipart(ctx context.Context, expiresAt time.Time) error {
+	if s.opts.Usage == nil {
+		return nil
+	}
+	err := s.opts.Usage.AcquireMultipart(ctx, s.resourceType, s.resourceId, expiresAt, s.opts.settings().multipartQuota(s.resourceType))
+	if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+		s.opts.Logger.Errorf("acquire multipart upload '%s' usage fail[%s]", s.resourceId, err.Error())
+		return internalError("multipart.start", err, "acquire multipart upload usage")
+	}
+	return err
+}
+
+// releaseMultipart 分片上传结束, 失败时只记录日志, 过期后自动释放
+func (o *Options) releaseMultipart(ctx context.Context, uploadId string) {
+	if o.Usage == nil {
+		return
+	}
+	if err := o.Usage.ReleaseMultipart(ctx, uploadId); err != nil {
+		o.Logger.Errorf("release multipart upload '%s' usage fail[%s]", uploadId, err.Error())
+	}
+}
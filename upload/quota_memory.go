@@ -0,0 +1,109 @@
+package upload
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryUsageStore 只在当前进程中有效, 用于单节点部署和测试
+type memoryUsageStore struct {
+	mu        sync.Mutex
+	clock     Clock
+	bytes     map[ResourceType]int64
+	multipart map[string]*memoryMultipartUsage
+}
+
+type memoryMultipartUsage struct {
+	resourceType ResourceType
+	expiresAt    time.Time
+}
+
+// NewMemoryUsageStore clock为空时使用系统时间
+func NewMemoryUsageStore(clock Clock) UsageStore {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &memoryUsageStore{
+		clock:     clock,
+		bytes:     map[ResourceType]int64{},
+		multipart: map[string]*memoryMultipartUsage{},
+	}
+}
+
+// expire 删除过期的分片上传, 调用前需要加锁
+func (s *memoryUsageStore) expire() {
+	now := s.clock.Now()
+	for uploadId, usage := range s.multipart {
+		if !now.Before(usage.expiresAt) {
+			delete(s.multipart, uploadId)
+		}
+	}
+}
+
+func (s *memoryUsageStore) AddBytes(ctx context.Context, resourceType ResourceType, delta int64, limit QuotaLimit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := limit.check("quota.bytes", "bytes", resourceType, s.bytes[resourceType], sumUsage(s.bytes), delta); err != nil {
+		return err
+	}
+	s.bytes[resourceType] += delta
+	if s.bytes[resourceType] <= 0 {
+		delete(s.bytes, resourceType)
+	}
+	return nil
+}
+
+func (s *memoryUsageStore) ResetBytes(ctx context.Context, bytes map[ResourceType]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes = make(map[ResourceType]int64, len(bytes))
+	for resourceType, size := range bytes {
+		s.bytes[resourceType] = size
+	}
+	return nil
+}
+
+func (s *memoryUsageStore) AcquireMultipart(ctx context.Context, resourceType ResourceType, uploadId string, expiresAt time.Time, limit QuotaLimit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	if _, ok := s.multipart[uploadId]; !ok {
+		counts := s.multipartCounts()
+		if err := limit.check("quota.multipart", "multipart uploads", resourceType, counts[resourceType], int64(len(s.multipart)), 1); err != nil {
+			return err
+		}
+	}
+	s.multipart[uploadId] = &memoryMultipartUsage{resourceType: resourceType, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *memoryUsageStore) ReleaseMultipart(ctx context.Context, uploadId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.multipart, uploadId)
+	return nil
+}
+
+func (s *memoryUsageStore) Usage(ctx context.Context) (*UsageCounters, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	counters := &UsageCounters{
+		Bytes:            make(map[ResourceType]int64, len(s.bytes)),
+		MultipartUploads: s.multipartCounts(),
+	}
+	for resourceType, size := range s.bytes {
+		counters.Bytes[resourceType] = size
+	}
+	return counters, nil
+}
+
+// multipartCounts 调用前需要加锁
+func (s *memoryUsageStore) multipartCounts() map[ResourceType]int64 {
+	counts := map[ResourceType]int64{}
+	for _, usage := range s.multipart {
+		counts[usage.resourceType]++
+	}
+	return counts
+}
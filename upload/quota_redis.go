@@ -0,0 +1,185 @@
+package upload
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 用量key为 {<USAGE_KEY加上应用名和命名空间>}:<后缀>
+// 同一租户的用量key使用同一个hash tag, redis cluster中脚本和事务不会跨slot
+const (
+	// USAGE_KEY 用量key前缀, 由 namespacedKey 加上应用名和命名空间
+	USAGE_KEY = "storage_usage"
+	// USAGE_BYTES 发布文件大小, hash, field为资源类型
+	USAGE_BYTES = "bytes"
+	// USAGE_MULTIPART 进行中的分片上传, zset, score为过期时间
+	USAGE_MULTIPART = "multipart"
+	// USAGE_MULTIPART_TYPES 进行中的分片上传的资源类型, hash, field为uploadId
+	USAGE_MULTIPART_TYPES = "multipart:types"
+)
+
+// addBytesScript 增加后不超过限制时修改, 返回 {是否修改, 资源类型用量, 租户用量}
+// KEYS[1] 发布文件大小
+// ARGV[1] 资源类型 ARGV[2] 增加的大小 ARGV[3] 资源类型限制 ARGV[4] 租户限制
+var addBytesScript = redis.NewScript(`
+local delta = tonumber(ARGV[2])
+if delta > 0 then
+	local typeUsed = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+	local tenantUsed = 0
+	for _, used in ipairs(redis.call('HVALS', KEYS[1])) do
+		tenantUsed = tenantUsed + tonumber(used)
+	end
+	if (tonumber(ARGV[3]) > 0 and typeUsed + delta > tonumber(ARGV[3])) or
+		(tonumber(ARGV[4]) > 0 and tenantUsed + delta > tonumber(ARGV[4])) then
+		return {0, typeUsed, tenantUsed}
+	end
+end
+if redis.call('HINCRBY', KEYS[1], ARGV[1], delta) <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return {1, 0, 0}
+`)
+
+// acquireMultipartScript 删除过期的分片上传, 不超过限制时记录, 返回 {是否记录, 资源类型数量, 租户数量}
+// KEYS[1] 进行中的分片上传 KEYS[2] 分片上传的资源类型
+// ARGV[1] 当前时间 ARGV[2] 过期时间 ARGV[3] uploadId ARGV[4] 资源类型 ARGV[5] 资源类型限制 ARGV[6] 租户限制
+var acquireMultipartScript = redis.NewScript(`
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('HDEL', KEYS[2], member)
+end
+if not redis.call('ZSCORE', KEYS[1], ARGV[3]) then
+	local types = redis.call('HVALS', KEYS[2])
+	local typeUsed = 0
+	for _, t in ipairs(types) do
+		if t == ARGV[4] then
+			typeUsed = typeUsed + 1
+		end
+	end
+	if (tonumber(ARGV[5]) > 0 and typeUsed >= tonumber(ARGV[5])) or
+		(tonumber(ARGV[6]) > 0 and #types >= tonumber(ARGV[6])) then
+		return {0, typeUsed, #types}
+	end
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('HSET', KEYS[2], ARGV[3], ARGV[4])
+return {1, 0, 0}
+`)
+
+// redisUsageStore 多个节点共用, 检查和修改在lua脚本中完成
+type redisUsageStore struct {
+	cli   redis.UniversalClient
+	ns    Namespace
+	clock Clock
+	// key的应用名, 为空时使用 REDIS_KEY_APP_DEFAULT
+	app string
+}
+
+// NewRedisUsageStore key加上租户和环境, 见 Namespace.RedisKey
+// 应用名为 REDIS_KEY_APP_DEFAULT, 配置了 app 时使用 NewRedisUsageStoreWithOptions
+func NewRedisUsageStore(cli redis.UniversalClient, ns Namespace, clock Clock) UsageStore {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &redisUsageStore{cli: cli, ns: ns, clock: clock}
+}
+
+// NewRedisUsageStoreWithOptions 使用opts.Redis, opts.Namespace, opts.Clock和配置的应用名
+func NewRedisUsageStoreWithOptions(opts *Options) UsageStore {
+	store := NewRedisUsageStore(opts.Redis, opts.Namespace, opts.Clock).(*redisUsageStore)
+	store.app = opts.redisApp()
+	return store
+}
+
+func (s *redisUsageStore) key(suffix string) string {
+	return "{" + namespacedKey(s.ns, s.app, USAGE_KEY) + "}:" + suffix
+}
+
+func (s *redisUsageStore) AddBytes(ctx context.Context, resourceType ResourceType, delta int64, limit QuotaLimit) error {
+	result, err := addBytesScript.Run(ctx, s.cli, []string{s.key(USAGE_BYTES)},
+		int64(resourceType), delta, limit.Type, limit.Tenant).Int64Slice()
+	if err != nil {
+		return err
+	}
+	if result[0] == 0 {
+		return limit.check("quota.bytes", "bytes", resourceType, result[1], result[2], delta)
+	}
+	return nil
+}
+
+func (s *redisUsageStore) ResetBytes(ctx context.Context, bytes map[ResourceType]int64) error {
+	key := s.key(USAGE_BYTES)
+	pipe := s.cli.TxPipeline()
+	pipe.Del(ctx, key)
+	for resourceType, size := range bytes {
+		pipe.HSet(ctx, key, strconv.Itoa(int(resourceType)), size)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisUsageStore) AcquireMultipart(ctx context.Context, resourceType ResourceType, uploadId string, expiresAt time.Time, limit QuotaLimit) error {
+	result, err := acquireMultipartScript.Run(ctx, s.cli,
+		[]string{s.key(USAGE_MULTIPART), s.key(USAGE_MULTIPART_TYPES)},
+		s.clock.Now().Unix(), expiresAt.Unix(), uploadId, int64(resourceType), limit.Type, limit.Tenant).Int64Slice()
+	if err != nil {
+		return err
+	}
+	if result[0] == 0 {
+		return limit.check("quota.multipart", "multipart uploads", resourceType, result[1], result[2], 1)
+	}
+	return nil
+}
+
+func (s *redisUsageStore) ReleaseMultipart(ctx context.Context, uploadId string) error {
+	pipe := s.cli.TxPipeline()
+	pipe.ZRem(ctx, s.key(USAGE_MULTIPART), uploadId)
+	pipe.HDel(ctx, s.key(USAGE_MULTIPART_TYPES), uploadId)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Usage 过期的分片上传不计入, 在下次Acquire时删除
+func (s *redisUsageStore) Usage(ctx context.Context) (*UsageCounters, error) {
+	counters := &UsageCounters{
+		Bytes:            map[ResourceType]int64{},
+		MultipartUploads: map[ResourceType]int64{},
+	}
+	bytes, err := s.cli.HGetAll(ctx, s.key(USAGE_BYTES)).Result()
+	if err != nil {
+		return nil, err
+	}
+	for field, value := range bytes {
+		resourceType, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+			counters.Bytes[ResourceType(resourceType)] = size
+		}
+	}
+	uploadIds, err := s.cli.ZRangeByScore(ctx, s.key(USAGE_MULTIPART), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(s.clock.Now().Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil || len(uploadIds) == 0 {
+		return counters, err
+	}
+	types, err := s.cli.HMGet(ctx, s.key(USAGE_MULTIPART_TYPES), uploadIds...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range types {
+		field, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if resourceType, err := strconv.Atoi(field); err == nil {
+			counters.MultipartUploads[ResourceType(resourceType)]++
+		}
+	}
+	return counters, nil
+}
@@ -0,0 +1,119 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func testUsageStore(t *testing.T, store UsageStore, clock *testClock) {
+	ctx := context.Background()
+	limit := QuotaLimit{Type: 100, Tenant: 150}
+	if err := store.AddBytes(ctx, RT_GAME_ICON, 80, limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddBytes(ctx, RT_GAME_ICON, 30, limit); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expect type quota exceeded[%v]", err)
+	}
+	if err := store.AddBytes(ctx, RT_GAME_HALL, 80, limit); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expect tenant quota exceeded[%v]", err)
+	}
+	// 减少用量不检查限制
+	if err := store.AddBytes(ctx, RT_GAME_ICON, -50, QuotaLimit{Type: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := clock.now.Add(time.Minute)
+	limit = QuotaLimit{Type: 1}
+	if err := store.AcquireMultipart(ctx, RT_GAME_ICON, "u1", expiresAt, limit); err != nil {
+		t.Fatal(err)
+	}
+	// 同一个uploadId重复记录不占用新的数量
+	if err := store.AcquireMultipart(ctx, RT_GAME_ICON, "u1", expiresAt, limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AcquireMultipart(ctx, RT_GAME_ICON, "u2", expiresAt, limit); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expect multipart quota exceeded[%v]", err)
+	}
+	clock.now = expiresAt
+	if err := store.AcquireMultipart(ctx, RT_GAME_ICON, "u2", clock.now.Add(time.Minute), limit); err != nil {
+		t.Fatalf("expired upload not released[%v]", err)
+	}
+	usage, err := store.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes[RT_GAME_ICON] != 30 || usage.MultipartUploads[RT_GAME_ICON] != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestMemoryUsageStore(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	testUsageStore(t, NewMemoryUsageStore(clock), clock)
+}
+
+func TestRedisUsageStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer cli.Close()
+	hook := &txSlotHook{}
+	cli.AddHook(hook)
+	clock := &testClock{now: time.Unix(1000, 0)}
+	store := NewRedisUsageStore(cli, Namespace{Tenant: "t1"}, clock)
+	testUsageStore(t, store, clock)
+	if err := store.ReleaseMultipart(context.Background(), "u2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.crossSlot) > 0 {
+		t.Fatalf("transaction across hash tags %v", hook.crossSlot)
+	}
+	// 同一租户的用量key使用同一个hash tag
+	for _, key := range mr.Keys() {
+		if keyHashTag(key) != "{platform:default:t1:storage_usage}" {
+			t.Fatalf("key '%s' without tenant hash tag", key)
+		}
+	}
+}
+
+func TestQuotaSettings(t *testing.T) {
+	settings, err := LoadSettings(mapConfig{
+		"quota.max_bytes":                 int64(1 << 30),
+		"quota.12.max_multipart_uploads":  int64(3),
+		"quota.12.max_multipart_uploadss": int64(3),
+	}, NewDefaultResourceTypeRegistry())
+	if err == nil {
+		t.Fatal("typo key not reported")
+	}
+	if limit := settings.bytesQuota(RT_GAME_HALL); limit != (QuotaLimit{Tenant: 1 << 30}) {
+		t.Fatalf("unexpected bytes quota %+v", limit)
+	}
+	if limit := settings.multipartQuota(RT_GAME_HALL); limit != (QuotaLimit{Type: 3}) {
+		t.Fatalf("unexpected multipart quota %+v", limit)
+	}
+}
+
+func TestRedisStoresApp(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer cli.Close()
+	opts := &Options{Redis: cli, Namespace: Namespace{Tenant: "t1"}, Config: mapConfig{"app": "game"}}
+	if err := NewRedisUsageStoreWithOptions(opts).AddBytes(ctx, RT_GAME_ICON, 1, QuotaLimit{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRedisMetadataStoreWithOptions(opts).SaveChunk(ctx, &MultipartUploadChunk{UploadId: "u1", Chunk: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// 与 Options.redisKey 使用同一个应用名
+	for _, key := range mr.Keys() {
+		if !strings.HasPrefix(strings.TrimPrefix(key, "{"), "game:") {
+			t.Fatalf("key '%s' without configured app", key)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceType 资源类型
+// 内置类型使用下面的常量, 其他类型通过 ResourceTypeRegistry 注册
+type ResourceType int32
+
+// const .
+const (
+	RT_UNKNOWN              ResourceType = 0
+	RT_GAME_ICON            ResourceType = 1  // 1 游戏icon
+	RT_GAMEITEM_ICON        ResourceType = 2  // 2 游戏详情icon
+	RT_LOADING              ResourceType = 3  // 3 loading
+	RT_ACTIVITY_EVENT       ResourceType = 4  // 4 活动事件管理
+	RT_DOCUMENTS_AGENCY     ResourceType = 5  // 5 文档素材
+	RT_OFFICE_ICON          ResourceType = 6  // 6 官网ICON
+	RT_RECOMMEND_ICON       ResourceType = 7  // 7 推荐列表ICOn
+	RT_AGENT_CONTROL        ResourceType = 8  // 8 代理人调控
+	RT_CURRENCY             ResourceType = 9  // 9 货币
+	RT_GAME_BRAND           ResourceType = 10 // 游戏品牌
+	RT_MULTIPART            ResourceType = 11 // 分片类型
+	RT_GAME_HALL            ResourceType = 12 // 游戏大厅
+	RT_GAME_SKIN            ResourceType = 13 // 游戏皮肤
+	RT_GMAE_SHARE           ResourceType = 14 // 游戏分享, 此处仅占位作用，不能上传
+	RT_GAME_BRAND_HALL_ICON ResourceType = 15 // 游戏大厅的icon
+)
+
+const (
+	// CDN_ROOT_DEFAULT 发布到Options.RootPath
+	CDN_ROOT_DEFAULT = ""
+	// CDN_ROOT_DOWNLOAD 发布到Options.DownloadPath
+	CDN_ROOT_DOWNLOAD = "download"
+)
+
+// ResourceTypeDef 资源类型定义
+type ResourceTypeDef struct {
+	ID ResourceType `json:"id"`
+	// Name 按名称查找和序列化使用
+	Name string `json:"name"`
+	// Dir 上传目录和cdn目录下的子目录, 如 /icon
+	Dir string `json:"dir"`
+	// CdnRoot 发布的根目录, CDN_ROOT_DEFAULT, CDN_ROOT_DOWNLOAD 或者绝对路径
+	CdnRoot string `json:"cdn_root,omitempty"`
+	// AcceptSuffixes 支持的文件后缀, 为空时使用 upload.accept_suffixes
+	AcceptSuffixes []string `json:"accept_suffixes,omitempty"`
+	// MaxSize 普通上传文件大小限制, 为0时使用 upload.max_size
+	MaxSize int64 `json:"max_size,omitempty"`
+	// Retention 暂存文件保留时间, 为0时使用 storage.delay_delete.duration
+	Retention time.Duration `json:"-"`
+	// Uploadable 为false时只能用于发布和删除, 不能上传
+	Uploadable bool `json:"uploadable"`
+}
+
+// resourceTypeDefJSON 配置中retention使用 10m 格式
+type resourceTypeDefJSON struct {
+	ResourceTypeDef
+	Retention string `json:"retention,omitempty"`
+}
+
+// ResourceTypeRegistry 资源类型注册表, 可以并发使用
+type ResourceTypeRegistry struct {
+	mu     sync.RWMutex
+	byID   map[ResourceType]ResourceTypeDef
+	byName map[string]ResourceTypeDef
+}
+
+// NewResourceTypeRegistry 创建空的注册表, 需要内置类型时使用 NewDefaultResourceTypeRegistry
+func NewResourceTypeRegistry() *ResourceTypeRegistry {
+	return &ResourceTypeRegistry{
+		byID:   map[ResourceType]ResourceTypeDef{},
+		byName: map[string]ResourceTypeDef{},
+	}
+}
+
+// NewDefaultResourceTypeRegistry 包含内置类型的注册表
+func NewDefaultResourceTypeRegistry() *ResourceTypeRegistry {
+	r := NewResourceTypeRegistry()
+	for _, def := range builtinResourceTypes {
+		if err := r.Register(def); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// DefaultResourceTypes Options.ResourceTypes 为空时使用
+var DefaultResourceTypes = NewDefaultResourceTypeRegistry()
+
+var builtinResourceTypes = []ResourceTypeDef{
+	{ID: RT_GAME_ICON, Name: "game_icon", Dir: "/icon", Uploadable: true},
+	{ID: RT_GAMEITEM_ICON, Name: "gameitem_icon", Dir: "/gameitemicon", Uploadable: true},
+	{ID: RT_LOADING, Name: "loading", Dir: "/loading", Uploadable: true},
+	{ID: RT_ACTIVITY_EVENT, Name: "activity_event", Dir: "/activity", Uploadable: true},
+	{ID: RT_DOCUMENTS_AGENCY, Name: "documents_agency", Dir: "/documents", CdnRoot: CDN_ROOT_DOWNLOAD, Uploadable: true},
+	{ID: RT_OFFICE_ICON, Name: "office_icon", Dir: "/office_icon", Uploadable: true},
+	{ID: RT_RECOMMEND_ICON, Name: "recommend_icon", Dir: "/recommendicon", Uploadable: true},
+	{ID: RT_AGENT_CONTROL, Name: "agent_control", Dir: "/agent_control", CdnRoot: CDN_ROOT_DOWNLOAD, Uploadable: true},
+	{ID: RT_CURRENCY, Name: "currency", Dir: "/currency", Uploadable: true},
+	{ID: RT_GAME_BRAND, Name: "game_brand", Dir: "/gamebrand", Uploadable: true},
+	{ID: RT_MULTIPART, Name: "multipart", Dir: "/tmp", Uploadable: true},
+	{ID: RT_GAME_HALL, Name: "game_hall", Dir: "/game_hall", Uploadable: true},
+	{ID: RT_GAME_SKIN, Name: "game_skin", Dir: "/game_skin", Uploadable: true},
+	{ID: RT_GMAE_SHARE, Name: "game_share", Dir: "/game_share"},
+	{ID: RT_GAME_BRAND_HALL_ICON, Name: "game_brand_hall_icon", Dir: "/brand_hall_icon", Uploadable: true},
+}
+
+// ResourceTypeName 内置类型的目录
+// Deprecated: 不包含运行时注册的类型, 使用 ResourceTypeRegistry.Lookup
+var ResourceTypeName = func() map[ResourceType]string {
+	names := map[ResourceType]string{RT_UNKNOWN: "UNKNOWN"}
+	for _, def := range builtinResourceTypes {
+		names[def.ID] = def.Dir
+	}
+	return names
+}()
+
+// Register 注册资源类型, ID或名称已存在时返回错误
+func (r *ResourceTypeRegistry) Register(def ResourceTypeDef) error {
+	def, err := normalizeResourceType(def)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkExists(def); err != nil {
+		return err
+	}
+	r.byID[def.ID] = def
+	r.byName[def.Name] = def
+	return nil
+}
+
+// RegisterJSON 从配置注册资源类型, 配置为ResourceTypeDef的数组, retention使用 10m 格式
+// 有一个类型不合法或者ID, 名称重复时都不注册
+func (r *ResourceTypeRegistry) RegisterJSON(data []byte) error {
+	var items []resourceTypeDefJSON
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("decode resource types fail[%s]", err.Error())
+	}
+	batch := NewResourceTypeRegistry()
+	defs := make([]ResourceTypeDef, 0, len(items))
+	for _, item := range items {
+		def := item.ResourceTypeDef
+		if item.Retention != "" {
+			retention, err := time.ParseDuration(item.Retention)
+			if err != nil {
+				return fmt.Errorf("invalid resource_type '%s' retention '%s'", def.Name, item.Retention)
+			}
+			def.Retention = retention
+		}
+		def, err := normalizeResourceType(def)
+		if err != nil {
+			return err
+		}
+		// 同一批中的ID和名称也不能重复
+		if err := batch.checkExists(def); err != nil {
+			return err
+		}
+		batch.byID[def.ID] = def
+		batch.byName[def.Name] = def
+		defs = append(defs, def)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, def := range defs {
+		if err := r.checkExists(def); err != nil {
+			return err
+		}
+	}
+	for _, def := range defs {
+		r.byID[def.ID] = def
+		r.byName[def.Name] = def
+	}
+	return nil
+}
+
+// normalizeResourceType 校验并补全目录
+func normalizeResourceType(def ResourceTypeDef) (ResourceTypeDef, error) {
+	if def.ID <= RT_UNKNOWN {
+		return def, fmt.Errorf("invalid resource_type id %d", def.ID)
+	}
+	if def.Name == "" || strings.ContainsAny(def.Name, " /") {
+		return def, fmt.Errorf("invalid resource_type %d name '%s'", def.ID, def.Name)
+	}
+	if _, err := strconv.Atoi(def.Name); err == nil {
+		return def, fmt.Errorf("resource_type %d name '%s' can not be a number", def.ID, def.Name)
+	}
+	if def.Dir == "" || def.Dir == "/" || strings.Contains(def.Dir, "..") {
+		return def, fmt.Errorf("invalid resource_type '%s' dir '%s'", def.Name, def.Dir)
+	}
+	if !strings.HasPrefix(def.Dir, "/") {
+		def.Dir = "/" + def.Dir
+	}
+	if def.MaxSize < 0 || def.Retention < 0 {
+		return def, fmt.Errorf("invalid resource_type '%s' limits", def.Name)
+	}
+	def.AcceptSuffixes = append([]string(nil), def.AcceptSuffixes...)
+	return def, nil
+}
+
+// checkExists 需要持有锁
+func (r *ResourceTypeRegistry) checkExists(def ResourceTypeDef) error {
+	if exist, ok := r.byID[def.ID]; ok {
+		return fmt.Errorf("resource_type %d already registered as '%s'", def.ID, exist.Name)
+	}
+	if exist, ok := r.byName[def.Name]; ok {
+		return fmt.Errorf("resource_type name '%s' already registered by %d", def.Name, exist.ID)
+	}
+	return nil
+}
+
+// Lookup 按ID查找
+func (r *ResourceTypeRegistry) Lookup(id ResourceType) (ResourceTypeDef, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	def, ok := r.byID[id]
+	return def, ok
+}
+
+// LookupByName 按名称查找
+func (r *ResourceTypeRegistry) LookupByName(name string) (ResourceTypeDef, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	def, ok := r.byName[name]
+	return def, ok
+}
+
+// Parse 按名称或者数字ID查找
+func (r *ResourceTypeRegistry) Parse(s string) (ResourceType, error) {
+	if def, ok := r.LookupByName(s); ok {
+		return def.ID, nil
+	}
+	if id, err := strconv.ParseInt(s, 10, 32); err == nil {
+		if _, ok := r.Lookup(ResourceType(id)); ok {
+			return ResourceType(id), nil
+		}
+	}
+	return RT_UNKNOWN, newError(ErrUnsupportedType, "resource_type.parse", "invalid resource_type '%s'", s)
+}
+
+// All 按ID排序
+func (r *ResourceTypeRegistry) All() []ResourceTypeDef {
+	r.mu.RLock()
+	defs := make([]ResourceTypeDef, 0, len(r.byID))
+	for _, def := range r.byID {
+		defs = append(defs, def)
+	}
+	r.mu.RUnlock()
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].ID < defs[j].ID
+	})
+	return defs
+}
+
+// Name 已注册时返回名称, 否则返回数字
+// ResourceType 序列化仍然使用数字, 需要名称的地方通过Options中的registry查找
+func (r *ResourceTypeRegistry) Name(t ResourceType) string {
+	if def, ok := r.Lookup(t); ok {
+		return def.Name
+	}
+	return strconv.Itoa(int(t))
+}
@@ -0,0 +1,71 @@
+package upload
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestResourceTypeRegistry(t *testing.T) {
+	r := NewDefaultResourceTypeRegistry()
+	if def, ok := r.LookupByName("documents_agency"); !ok || def.ID != RT_DOCUMENTS_AGENCY || def.CdnRoot != CDN_ROOT_DOWNLOAD {
+		t.Fatalf("unexpected builtin %+v", def)
+	}
+	if def, _ := r.Lookup(RT_GMAE_SHARE); def.Uploadable {
+		t.Fatal("placeholder type uploadable")
+	}
+	for _, def := range []ResourceTypeDef{
+		{ID: RT_GAME_ICON, Name: "icon2", Dir: "/icon2"},
+		{ID: 100, Name: "game_icon", Dir: "/icon2"},
+		{ID: 100, Name: "100", Dir: "/icon2"},
+		{ID: 100, Name: "icon2", Dir: "/../icon2"},
+	} {
+		if err := r.Register(def); err == nil {
+			t.Fatalf("register %+v should fail", def)
+		}
+	}
+	// 有一个不合法时都不注册
+	if err := r.RegisterJSON([]byte(`[{"id": 100, "name": "a", "dir": "a"}, {"id": 101, "name": "b", "dir": "b", "retention": "x"}]`)); err == nil {
+		t.Fatal("invalid retention registered")
+	}
+	if _, ok := r.Lookup(100); ok {
+		t.Fatal("partial registered")
+	}
+	for _, data := range []string{
+		`[{"id": 100, "name": "a", "dir": "a"}, {"id": 101, "name": "b", "dir": "../b"}]`,
+		`[{"id": 100, "name": "a", "dir": "a"}, {"id": 101, "name": "a", "dir": "b"}]`,
+		`[{"id": 100, "name": "a", "dir": "a"}, {"id": 100, "name": "b", "dir": "b"}]`,
+		`[{"id": 100, "name": "a", "dir": "a"}, {"id": 101, "name": "game_icon", "dir": "b"}]`,
+	} {
+		if err := r.RegisterJSON([]byte(data)); err == nil {
+			t.Fatalf("register %s should fail", data)
+		}
+		if _, ok := r.Lookup(100); ok {
+			t.Fatalf("register %s partial registered", data)
+		}
+	}
+	if err := r.RegisterJSON([]byte(`[{"id": 100, "name": "a", "dir": "a", "retention": "1h"}, {"id": 101, "name": "b", "dir": "/b"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if def, ok := r.LookupByName("a"); !ok || def.Dir != "/a" || def.Retention != time.Hour {
+		t.Fatalf("unexpected registered %+v", def)
+	}
+	if id, err := r.Parse("12"); err != nil || id != RT_GAME_HALL {
+		t.Fatalf("unexpected parse %d[%v]", id, err)
+	}
+}
+
+func TestResourceTypeJSON(t *testing.T) {
+	// 与升级前的数据兼容, 序列化为数字
+	data, err := json.Marshal(UnpublishPayload{ResourceType: RT_GAME_ICON, Path: "a.png"})
+	if err != nil || string(data) != `{"resource_type":1,"path":"a.png"}` {
+		t.Fatalf("unexpected json %s[%v]", data, err)
+	}
+	types := NewResourceTypeRegistry()
+	if err := types.Register(ResourceTypeDef{ID: RT_GAME_ICON, Name: "icon", Dir: "/icon"}); err != nil {
+		t.Fatal(err)
+	}
+	if types.Name(RT_GAME_ICON) != "icon" || types.Name(ResourceType(99)) != "99" {
+		t.Fatal("unexpected name")
+	}
+}
@@ -0,0 +1,639 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Settings 上传限制相关的配置, 由 LoadSettings 读取并校验
+// Options.Limits 中不为0的字段优先
+type Settings struct {
+	Upload    UploadSettings
+	Multipart MultipartSettings
+	Quota     QuotaSettings
+	// DelayDeleteDuration 暂存文件保留时间 storage.delay_delete.duration
+	DelayDeleteDuration time.Duration
+	DelayJob            DelayJobSettings
+	OrphanSweep         OrphanSweepSettings
+	Peer                PeerSettings
+	Fetch               FetchSettings
+	Webhook             WebhookSettings
+}
+
+// DelayJobSettings 延迟任务
+type DelayJobSettings struct {
+	// storage.delay_delete.backend redis|bolt
+	Backend string
+	// storage.delay_delete.bolt_path
+	BoltPath string
+	// storage.delay_delete.interval 没有唤醒时的扫描间隔
+	Interval time.Duration
+	// storage.delay_delete.min_interval 两次扫描的最小间隔
+	MinInterval time.Duration
+	// storage.delay_delete.jitter
+	Jitter time.Duration
+	// storage.delay_delete.batch_size 每次最多领取的任务数量
+	BatchSize int64
+	// storage.delay_delete.workers 并发执行数量
+	Workers int64
+	// storage.delay_delete.lease
+	Lease time.Duration
+	// storage.delay_delete.max_attempts
+	MaxAttempts int64
+	// storage.delay_delete.retry_backoff 第一次失败后的重试间隔, 之后每次翻倍
+	RetryBackoff time.Duration
+	// storage.delay_delete.host_timeout 超过这个时间没有心跳的节点视为下线
+	HostTimeout time.Duration
+	// storage.delay_delete.stale_host_policy report|reassign
+	StaleHostPolicy string
+	// storage.delay_delete.reassign_host 为空时转移到当前节点
+	ReassignHost string
+	// storage.delay_delete.allow_cdn_path 是否允许删除cdn目录下的文件
+	AllowCdnPath bool
+}
+
+// OrphanSweepSettings 孤儿文件清理
+type OrphanSweepSettings struct {
+	// storage.orphan_sweep.dry_run
+	DryRun bool
+	// storage.orphan_sweep.interval 0表示不清理
+	Interval time.Duration
+	// storage.orphan_sweep.retention
+	Retention time.Duration
+}
+
+// PeerSettings 节点间拉取暂存文件
+type PeerSettings struct {
+	// storage.peer.address 节点地址, %s替换为节点名
+	Address string
+	// storage.peer.timeout
+	Timeout time.Duration
+	// storage.peer.secret 为空时不提供也不拉取
+	Secret string
+	// storage.peer.hosts 允许拉取的节点, 为空时使用有心跳的节点
+	Hosts []string
+}
+
+// FetchSettings 从url上传
+type FetchSettings struct {
+	// upload.fetch.allow_hosts 为空时只允许访问原始host
+	AllowHosts []string
+	// upload.fetch.timeout
+	Timeout time.Duration
+	// upload.fetch.allow_private
+	AllowPrivate bool
+	// upload.fetch.max_redirects
+	MaxRedirects int64
+}
+
+// WebhookSettings 延迟任务回调
+type WebhookSettings struct {
+	// storage.webhook.allow_hosts 为空时不执行回调
+	AllowHosts []string
+	// storage.webhook.timeout
+	Timeout time.Duration
+	// storage.webhook.allow_private
+	AllowPrivate bool
+}
+
+// UploadSettings 普通上传
+type UploadSettings struct {
+	// upload.max_size
+	MaxSize int64
+	// upload.accept_suffixes
+	AcceptSuffixes []string
+	// upload.<resource_type>.max_size
+	TypeMaxSize map[ResourceType]int64
+	// upload.<resource_type>.accept_suffixes
+	TypeAcceptSuffixes map[ResourceType][]string
+}
+
+// MultipartSettings 分片上传
+type MultipartSettings struct {
+	// multipart_upload.max_size
+	MaxSize int64
+	// multipart_upload.chunk_size
+	ChunkSize int64
+	// multipart_upload.max_chunks
+	MaxChunks int64
+	// multipart_upload.check.size.max
+	MaxChunkSize int64
+	// multipart_upload.check.content.enabled
+	CheckContent bool
+	// multipart_upload.check.size.enabled
+	CheckSize bool
+	// multipart_upload.<resource_type>.max_size
+	TypeMaxSize map[ResourceType]int64
+	// multipart_upload.<resource_type>.chunk_size
+	TypeChunkSize map[ResourceType]int64
+}
+
+// QuotaSettings 每个租户的配额, 0表示不限制
+type QuotaSettings struct {
+	// quota.max_bytes 所有资源类型发布文件的总大小
+	MaxBytes int64
+	// quota.max_multipart_uploads 同时进行的分片上传数量
+	MaxMultipartUploads int64
+	// quota.<resource_type>.max_bytes
+	TypeMaxBytes map[ResourceType]int64
+	// quota.<resource_type>.max_multipart_uploads
+	TypeMaxMultipartUploads map[ResourceType]int64
+}
+
+// ConfigKeys Config可以列出所有配置项时, LoadSettings 检查拼写错误的配置项
+type ConfigKeys interface {
+	Keys() []string
+}
+
+// SettingsError 配置不合法, 包含所有错误的配置项
+type SettingsError struct {
+	Problems []string
+}
+
+func (e *SettingsError) Error() string {
+	return "invalid upload config: " + strings.Join(e.Problems, "; ")
+}
+
+// DefaultSettings 没有任何配置时的值
+func DefaultSettings() *Settings {
+	return &Settings{
+		Upload: UploadSettings{
+			MaxSize:            5 << 20,
+			AcceptSuffixes:     []string{".jpg", ".jpeg", ".png", ".zip", ".csv", ".json", ".atlas", ".xls", ".xlsx"},
+			TypeMaxSize:        map[ResourceType]int64{},
+			TypeAcceptSuffixes: map[ResourceType][]string{},
+		},
+		Multipart: MultipartSettings{
+			MaxSize:       2 << 30,
+			ChunkSize:     5 << 20,
+			MaxChunks:     10000,
+			MaxChunkSize:  10 << 20,
+			TypeMaxSize:   map[ResourceType]int64{},
+			TypeChunkSize: map[ResourceType]int64{},
+		},
+		Quota: QuotaSettings{
+			TypeMaxBytes:            map[ResourceType]int64{},
+			TypeMaxMultipartUploads: map[ResourceType]int64{},
+		},
+		DelayDeleteDuration: 10 * time.Minute,
+		DelayJob: DelayJobSettings{
+			Backend:         DELAY_QUEUE_BACKEND_REDIS,
+			BoltPath:        "delay_job.db",
+			Interval:        30 * time.Second,
+			MinInterval:     time.Second,
+			Jitter:          500 * time.Millisecond,
+			BatchSize:       500,
+			Workers:         8,
+			Lease:           5 * time.Minute,
+			MaxAttempts:     5,
+			RetryBackoff:    30 * time.Second,
+			HostTimeout:     24 * time.Hour,
+			StaleHostPolicy: STALE_HOST_POLICY_REPORT,
+		},
+		OrphanSweep: OrphanSweepSettings{
+			DryRun:    true,
+			Interval:  6 * time.Hour,
+			Retention: 24 * time.Hour,
+		},
+		Peer: PeerSettings{
+			Address: "http://%s:8080",
+			Timeout: 10 * time.Minute,
+		},
+		Fetch: FetchSettings{
+			Timeout:      time.Minute,
+			MaxRedirects: 5,
+		},
+		Webhook: WebhookSettings{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// knownSettingKeys upload., multipart_upload., quota.和storage.下除了资源类型配置以外的配置项
+var knownSettingKeys = map[string]bool{
+	"upload.max_size":                        true,
+	"upload.accept_suffixes":                 true,
+	"upload.resource_types":                  true,
+	"upload.config.reload_interval":          true,
+	"upload.fetch.allow_hosts":               true,
+	"upload.fetch.timeout":                   true,
+	"upload.fetch.allow_private":             true,
+	"upload.fetch.max_redirects":             true,
+	"multipart_upload.max_size":              true,
+	"multipart_upload.chunk_size":            true,
+	"multipart_upload.max_chunks":            true,
+	"multipart_upload.check.size.max":        true,
+	"multipart_upload.check.size.enabled":    true,
+	"multipart_upload.check.content.enabled": true,
+	"quota.max_bytes":                        true,
+	"quota.max_multipart_uploads":            true,
+	"storage.delay_delete.duration":          true,
+	"storage.delay_delete.backend":           true,
+	"storage.delay_delete.bolt_path":         true,
+	"storage.delay_delete.interval":          true,
+	"storage.delay_delete.min_interval":      true,
+	"storage.delay_delete.jitter":            true,
+	"storage.delay_delete.batch_size":        true,
+	"storage.delay_delete.workers":           true,
+	"storage.delay_delete.lease":             true,
+	"storage.delay_delete.max_attempts":      true,
+	"storage.delay_delete.retry_backoff":     true,
+	"storage.delay_delete.host_timeout":      true,
+	"storage.delay_delete.stale_host_policy": true,
+	"storage.delay_delete.reassign_host":     true,
+	"storage.delay_delete.allow_cdn_path":    true,
+	"storage.orphan_sweep.dry_run":           true,
+	"storage.orphan_sweep.interval":          true,
+	"storage.orphan_sweep.retention":         true,
+	"storage.peer.address":                   true,
+	"storage.peer.timeout":                   true,
+	"storage.peer.secret":                    true,
+	"storage.peer.hosts":                     true,
+	"storage.webhook.allow_hosts":            true,
+	"storage.webhook.timeout":                true,
+	"storage.webhook.allow_private":          true,
+}
+
+// settingPrefixes 检查拼写错误的配置项前缀
+var settingPrefixes = []string{"upload.", "multipart_upload.", "quota.", "storage."}
+
+var typeSettingKey = regexp.MustCompile(`^(upload|multipart_upload|quota)\.(\d+)\.(\w+)$`)
+
+// typeSettingNames 资源类型的配置项
+var typeSettingNames = map[string]bool{
+	"upload.max_size":             true,
+	"upload.accept_suffixes":      true,
+	"multipart_upload.max_size":   true,
+	"multipart_upload.chunk_size": true,
+	"quota.max_bytes":             true,
+	"quota.max_multipart_uploads": true,
+}
+
+// settingsLoader 读取配置并记录错误, 不合法的配置项使用默认值
+type settingsLoader struct {
+	cfg      Config
+	problems []string
+}
+
+func (l *settingsLoader) problem(format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+// int64 返回配置值和是否设置, 不是数字或者小于min时记录错误
+func (l *settingsLoader) int64(key string, defaultValue int64, min int64) (int64, bool) {
+	value := l.cfg.GetInt64(key, math.MinInt64)
+	if value == math.MinInt64 {
+		// 未设置或者不是数字
+		if raw := l.cfg.GetString(key, ""); raw != "" {
+			l.problem("'%s' is not a number: '%s'", key, raw)
+		}
+		return defaultValue, false
+	}
+	if value < min {
+		l.problem("'%s' must be at least %d, got %d", key, min, value)
+		return defaultValue, false
+	}
+	return value, true
+}
+
+func (l *settingsLoader) bool(key string, defaultValue bool) bool {
+	value := l.cfg.GetBool(key, false)
+	if value != l.cfg.GetBool(key, true) {
+		// 未设置或者不是bool
+		if raw := l.cfg.GetString(key, ""); raw != "" {
+			l.problem("'%s' is not a bool: '%s'", key, raw)
+		}
+		return defaultValue
+	}
+	return value
+}
+
+func (l *settingsLoader) duration(key string, defaultValue time.Duration) time.Duration {
+	raw := l.cfg.GetString(key, "")
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		l.problem("'%s' is not a positive duration: '%s'", key, raw)
+		return defaultValue
+	}
+	return value
+}
+
+// durationOrZero 允许为0的时间间隔
+func (l *settingsLoader) durationOrZero(key string, defaultValue time.Duration) time.Duration {
+	raw := l.cfg.GetString(key, "")
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value < 0 {
+		l.problem("'%s' is not a non-negative duration: '%s'", key, raw)
+		return defaultValue
+	}
+	return value
+}
+
+// oneOf 配置值只能是values中的一个
+func (l *settingsLoader) oneOf(key string, defaultValue string, values ...string) string {
+	value := l.cfg.GetString(key, defaultValue)
+	for _, v := range values {
+		if value == v {
+			return value
+		}
+	}
+	l.problem("'%s' must be one of %s, got '%s'", key, strings.Join(values, "|"), value)
+	return defaultValue
+}
+
+// list 逗号分隔的列表, 去掉空白和空项
+func (l *settingsLoader) list(key string) []string {
+	var values []string
+	for _, value := range strings.Split(l.cfg.GetString(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// suffixes 逗号分隔的后缀, 每个后缀需要以.开头
+func (l *settingsLoader) suffixes(key string, defaultValue []string) ([]string, bool) {
+	raw := l.cfg.GetString(key, "")
+	if raw == "" {
+		return defaultValue, false
+	}
+	var suffixes []string
+	for _, suffix := range strings.Split(raw, ",") {
+		suffix = strings.TrimSpace(suffix)
+		if len(suffix) < 2 || !strings.HasPrefix(suffix, ".") {
+			l.problem("'%s' has invalid suffix '%s'", key, suffix)
+			return defaultValue, false
+		}
+		suffixes = append(suffixes, suffix)
+	}
+	return suffixes, true
+}
+
+// unknownKeys 检查拼写错误的配置项和未注册的资源类型
+func (l *settingsLoader) unknownKeys(types *ResourceTypeRegistry) {
+	keysConfig, ok := l.cfg.(ConfigKeys)
+	if !ok {
+		return
+	}
+	keys := keysConfig.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !hasSettingPrefix(key) || knownSettingKeys[key] {
+			continue
+		}
+		match := typeSettingKey.FindStringSubmatch(key)
+		if match == nil || !typeSettingNames[match[1]+"."+match[3]] {
+			l.problem("unknown config key '%s'", key)
+			continue
+		}
+		id, _ := strconv.Atoi(match[2])
+		if _, ok := types.Lookup(ResourceType(id)); !ok {
+			l.problem("config key '%s' has unknown resource_type %d", key, id)
+		}
+	}
+}
+
+func hasSettingPrefix(key string) bool {
+	for _, prefix := range settingPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSettings 读取并校验配置
+// 返回的Settings总是可用, 不合法的配置项使用默认值, 同时返回 *SettingsError
+// 按资源类型的配置只包含读取时已注册的类型, 之后注册的类型需要 SettingsStore.Reload
+func LoadSettings(cfg Config, types *ResourceTypeRegistry) (*Settings, error) {
+	l := &settingsLoader{cfg: cfg}
+	settings := DefaultSettings()
+	settings.Upload.MaxSize, _ = l.int64("upload.max_size", settings.Upload.MaxSize, 1)
+	settings.Upload.AcceptSuffixes, _ = l.suffixes("upload.accept_suffixes", settings.Upload.AcceptSuffixes)
+
+	multipart := &settings.Multipart
+	multipart.MaxSize, _ = l.int64("multipart_upload.max_size", multipart.MaxSize, 1)
+	multipart.ChunkSize, _ = l.int64("multipart_upload.chunk_size", multipart.ChunkSize, 1)
+	multipart.MaxChunks, _ = l.int64("multipart_upload.max_chunks", multipart.MaxChunks, 1)
+	multipart.MaxChunkSize, _ = l.int64("multipart_upload.check.size.max", multipart.MaxChunkSize, 1)
+	multipart.CheckContent = l.bool("multipart_upload.check.content.enabled", false)
+	multipart.CheckSize = l.bool("multipart_upload.check.size.enabled", false)
+	if multipart.ChunkSize > multipart.MaxChunkSize {
+		l.problem("'multipart_upload.chunk_size' %d exceeds 'multipart_upload.check.size.max' %d",
+			multipart.ChunkSize, multipart.MaxChunkSize)
+	}
+
+	quota := &settings.Quota
+	quota.MaxBytes, _ = l.int64("quota.max_bytes", 0, 0)
+	quota.MaxMultipartUploads, _ = l.int64("quota.max_multipart_uploads", 0, 0)
+	for _, def := range types.All() {
+		if size, ok := l.int64(fmt.Sprintf("upload.%d.max_size", def.ID), 0, 1); ok {
+			settings.Upload.TypeMaxSize[def.ID] = size
+		}
+		if suffixes, ok := l.suffixes(fmt.Sprintf("upload.%d.accept_suffixes", def.ID), nil); ok {
+			settings.Upload.TypeAcceptSuffixes[def.ID] = suffixes
+		}
+		if size, ok := l.int64(fmt.Sprintf("multipart_upload.%d.max_size", def.ID), 0, 1); ok {
+			multipart.TypeMaxSize[def.ID] = size
+		}
+		if size, ok := l.int64(fmt.Sprintf("multipart_upload.%d.chunk_size", def.ID), 0, 1); ok {
+			if size > multipart.MaxChunkSize {
+				l.problem("'multipart_upload.%d.chunk_size' %d exceeds 'multipart_upload.check.size.max' %d",
+					def.ID, size, multipart.MaxChunkSize)
+			}
+			multipart.TypeChunkSize[def.ID] = size
+		}
+		if size, ok := l.int64(fmt.Sprintf("quota.%d.max_bytes", def.ID), 0, 0); ok {
+			quota.TypeMaxBytes[def.ID] = size
+		}
+		if count, ok := l.int64(fmt.Sprintf("quota.%d.max_multipart_uploads", def.ID), 0, 0); ok {
+			quota.TypeMaxMultipartUploads[def.ID] = count
+		}
+	}
+	settings.DelayDeleteDuration = l.duration("storage.delay_delete.duration", settings.DelayDeleteDuration)
+	l.delayJob(&settings.DelayJob)
+	l.orphanSweep(&settings.OrphanSweep)
+	l.peer(&settings.Peer)
+	l.fetch(&settings.Fetch)
+	l.webhook(&settings.Webhook)
+	l.unknownKeys(types)
+	if len(l.problems) > 0 {
+		return settings, &SettingsError{Problems: l.problems}
+	}
+	return settings, nil
+}
+
+func (l *settingsLoader) delayJob(job *DelayJobSettings) {
+	job.Backend = l.oneOf("storage.delay_delete.backend", job.Backend, DELAY_QUEUE_BACKEND_REDIS, DELAY_QUEUE_BACKEND_BOLT)
+	job.BoltPath = l.cfg.GetString("storage.delay_delete.bolt_path", job.BoltPath)
+	job.Interval = l.duration("storage.delay_delete.interval", job.Interval)
+	job.MinInterval = l.durationOrZero("storage.delay_delete.min_interval", job.MinInterval)
+	if job.MinInterval > job.Interval {
+		l.problem("'storage.delay_delete.min_interval' %s exceeds 'storage.delay_delete.interval' %s",
+			job.MinInterval, job.Interval)
+		job.MinInterval = job.Interval
+	}
+	job.Jitter = l.durationOrZero("storage.delay_delete.jitter", job.Jitter)
+	job.BatchSize, _ = l.int64("storage.delay_delete.batch_size", job.BatchSize, 1)
+	job.Workers, _ = l.int64("storage.delay_delete.workers", job.Workers, 1)
+	job.Lease = l.duration("storage.delay_delete.lease", job.Lease)
+	job.MaxAttempts, _ = l.int64("storage.delay_delete.max_attempts", job.MaxAttempts, 1)
+	job.RetryBackoff = l.duration("storage.delay_delete.retry_backoff", job.RetryBackoff)
+	job.HostTimeout = l.duration("storage.delay_delete.host_timeout", job.HostTimeout)
+	job.StaleHostPolicy = l.oneOf("storage.delay_delete.stale_host_policy", job.StaleHostPolicy,
+		STALE_HOST_POLICY_REPORT, STALE_HOST_POLICY_REASSIGN)
+	job.ReassignHost = l.cfg.GetString("storage.delay_delete.reassign_host", "")
+	job.AllowCdnPath = l.bool("storage.delay_delete.allow_cdn_path", false)
+}
+
+func (l *settingsLoader) orphanSweep(sweep *OrphanSweepSettings) {
+	sweep.DryRun = l.bool("storage.orphan_sweep.dry_run", sweep.DryRun)
+	sweep.Interval = l.durationOrZero("storage.orphan_sweep.interval", sweep.Interval)
+	sweep.Retention = l.duration("storage.orphan_sweep.retention", sweep.Retention)
+}
+
+func (l *settingsLoader) peer(peer *PeerSettings) {
+	peer.Address = l.cfg.GetString("storage.peer.address", peer.Address)
+	if strings.Count(peer.Address, "%s") != 1 || strings.Count(peer.Address, "%") != 1 {
+		l.problem("'storage.peer.address' must contain one '%%s' for host: '%s'", peer.Address)
+		peer.Address = DefaultSettings().Peer.Address
+	}
+	peer.Timeout = l.duration("storage.peer.timeout", peer.Timeout)
+	peer.Secret = l.cfg.GetString("storage.peer.secret", "")
+	peer.Hosts = l.list("storage.peer.hosts")
+}
+
+func (l *settingsLoader) fetch(fetch *FetchSettings) {
+	for _, host := range l.list("upload.fetch.allow_hosts") {
+		fetch.AllowHosts = append(fetch.AllowHosts, strings.ToLower(host))
+	}
+	fetch.Timeout = l.duration("upload.fetch.timeout", fetch.Timeout)
+	fetch.AllowPrivate = l.bool("upload.fetch.allow_private", false)
+	fetch.MaxRedirects, _ = l.int64("upload.fetch.max_redirects", fetch.MaxRedirects, 0)
+}
+
+func (l *settingsLoader) webhook(webhook *WebhookSettings) {
+	for _, host := range l.list("storage.webhook.allow_hosts") {
+		webhook.AllowHosts = append(webhook.AllowHosts, strings.ToLower(host))
+	}
+	webhook.Timeout = l.duration("storage.webhook.timeout", webhook.Timeout)
+	webhook.AllowPrivate = l.bool("storage.webhook.allow_private", false)
+}
+
+// uploadMaxSize 优先级 资源类型的配置 > 资源类型定义 > upload.max_size
+func (s *Settings) uploadMaxSize(def ResourceTypeDef) int64 {
+	if size, ok := s.Upload.TypeMaxSize[def.ID]; ok {
+		return size
+	}
+	if def.MaxSize > 0 {
+		return def.MaxSize
+	}
+	return s.Upload.MaxSize
+}
+
+func (s *Settings) uploadAcceptSuffixes(def ResourceTypeDef) []string {
+	if suffixes, ok := s.Upload.TypeAcceptSuffixes[def.ID]; ok {
+		return suffixes
+	}
+	if len(def.AcceptSuffixes) > 0 {
+		return def.AcceptSuffixes
+	}
+	return s.Upload.AcceptSuffixes
+}
+
+func (s *Settings) multipartMaxSize(resourceType ResourceType) int64 {
+	if size, ok := s.Multipart.TypeMaxSize[resourceType]; ok {
+		return size
+	}
+	return s.Multipart.MaxSize
+}
+
+func (s *Settings) multipartChunkSize(resourceType ResourceType) int64 {
+	if size, ok := s.Multipart.TypeChunkSize[resourceType]; ok {
+		return size
+	}
+	return s.Multipart.ChunkSize
+}
+
+// bytesQuota 发布文件大小的配额
+func (s *Settings) bytesQuota(resourceType ResourceType) QuotaLimit {
+	return QuotaLimit{Type: s.Quota.TypeMaxBytes[resourceType], Tenant: s.Quota.MaxBytes}
+}
+
+// multipartQuota 同时进行的分片上传数量的配额
+func (s *Settings) multipartQuota(resourceType ResourceType) QuotaLimit {
+	return QuotaLimit{Type: s.Quota.TypeMaxMultipartUploads[resourceType], Tenant: s.Quota.MaxMultipartUploads}
+}
+
+// SettingsStore 保存校验通过的配置, 可以并发读取
+// Reload 失败时继续使用之前的配置
+type SettingsStore struct {
+	cfg     Config
+	types   *ResourceTypeRegistry
+	current atomic.Value
+}
+
+// NewSettingsStore 启动时调用, 配置不合法时返回错误
+func NewSettingsStore(cfg Config, types *ResourceTypeRegistry) (*SettingsStore, error) {
+	if types == nil {
+		types = DefaultResourceTypes
+	}
+	s, err := loadSettingsStore(cfg, types)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadSettingsStore 配置不合法时也返回可用的SettingsStore, 不合法的配置项使用默认值, 同时返回 *SettingsError
+func loadSettingsStore(cfg Config, types *ResourceTypeRegistry) (*SettingsStore, error) {
+	s := &SettingsStore{cfg: cfg, types: types}
+	settings, err := LoadSettings(cfg, types)
+	s.current.Store(settings)
+	return s, err
+}
+
+// Current 当前配置, 不能修改返回值
+func (s *SettingsStore) Current() *Settings {
+	return s.current.Load().(*Settings)
+}
+
+// Reload 重新读取配置, 不合法时返回错误并保留之前的配置
+func (s *SettingsStore) Reload() error {
+	settings, err := LoadSettings(s.cfg, s.types)
+	if err != nil {
+		return err
+	}
+	s.current.Store(settings)
+	return nil
+}
+
+// Watch 每隔interval重新读取配置, ctx取消后返回
+func (s *SettingsStore) Watch(ctx context.Context, interval time.Duration, logger Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				logger.Errorf("reload upload config fail, keep previous config[%s]", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSettings(t *testing.T) {
+	settings, err := LoadSettings(mapConfig{
+		"upload.max_size":                     int64(100),
+		"upload.1.accept_suffixes":            ".png, .jpg",
+		"multipart_upload.4.chunk_size":       int64(1 << 20),
+		"multipart_upload.check.size.enabled": true,
+		"storage.delay_delete.duration":       "1h",
+		"storage.delay_delete.backend":        "bolt",
+		"storage.delay_delete.jitter":         "0s",
+		"storage.orphan_sweep.dry_run":        false,
+		"storage.peer.hosts":                  "node1, node2,",
+		"upload.fetch.allow_hosts":            "CDN.example.com",
+	}, DefaultResourceTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Upload.MaxSize != 100 || settings.DelayDeleteDuration != time.Hour || !settings.Multipart.CheckSize {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	if settings.DelayJob.Backend != DELAY_QUEUE_BACKEND_BOLT || settings.DelayJob.Jitter != 0 || settings.DelayJob.MaxAttempts != 5 ||
+		settings.OrphanSweep.DryRun || strings.Join(settings.Peer.Hosts, ",") != "node1,node2" ||
+		strings.Join(settings.Fetch.AllowHosts, ",") != "cdn.example.com" {
+		t.Fatalf("unexpected storage settings %+v", settings)
+	}
+	icon, _ := DefaultResourceTypes.Lookup(RT_GAME_ICON)
+	if suffixes := settings.uploadAcceptSuffixes(icon); strings.Join(suffixes, ",") != ".png,.jpg" {
+		t.Fatalf("unexpected suffixes %v", suffixes)
+	}
+	if settings.multipartChunkSize(RT_ACTIVITY_EVENT) != 1<<20 || settings.multipartChunkSize(RT_GAME_ICON) != 5<<20 {
+		t.Fatal("unexpected chunk size")
+	}
+}
+
+func TestLoadSettingsInvalid(t *testing.T) {
+	settings, err := LoadSettings(mapConfig{
+		"upload.max_size":                   "10MB",
+		"upload.acept_suffixes":             ".png",
+		"upload.99.max_size":                int64(1),
+		"multipart_upload.chunk_size":       int64(20 << 20),
+		"storage.delay_delete.duration":     "10",
+		"storage.delay_delete.duraton":      "1h",
+		"storage.delay_delete.backend":      "etcd",
+		"storage.delay_delete.workers":      int64(0),
+		"storage.peer.address":              "http://peer:8080",
+		"storage.delay_delete.interval":     "10s",
+		"storage.delay_delete.min_interval": "1m",
+	}, DefaultResourceTypes)
+	var settingsErr *SettingsError
+	if !errors.As(err, &settingsErr) || len(settingsErr.Problems) != 10 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, want := range []string{"'upload.max_size' is not a number", "unknown config key 'upload.acept_suffixes'",
+		"unknown resource_type 99", "exceeds 'multipart_upload.check.size.max'", "'storage.delay_delete.duration' is not a positive duration",
+		"unknown config key 'storage.delay_delete.duraton'", "'storage.delay_delete.backend' must be one of redis|bolt",
+		"'storage.delay_delete.workers' must be at least 1", "'storage.peer.address' must contain one '%s'",
+		"'storage.delay_delete.min_interval' 1m0s exceeds 'storage.delay_delete.interval' 10s"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error '%s' not contains '%s'", err.Error(), want)
+		}
+	}
+	// 不合法的配置项使用默认值
+	if settings.Upload.MaxSize != 5<<20 || settings.DelayDeleteDuration != 10*time.Minute ||
+		settings.DelayJob.Backend != DELAY_QUEUE_BACKEND_REDIS || settings.DelayJob.Workers != 8 || settings.Peer.Address != "http://%s:8080" ||
+		settings.DelayJob.MinInterval != 10*time.Second {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+}
+
+func TestSettingsStoreReload(t *testing.T) {
+	cfg := mapConfig{"upload.max_size": int64(100)}
+	if _, err := NewSettingsStore(mapConfig{"upload.max_size": int64(-1)}, nil); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	store, err := NewSettingsStore(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg["upload.max_size"] = int64(200)
+	if err := store.Reload(); err != nil || store.Current().Upload.MaxSize != 200 {
+		t.Fatalf("reload fail[%v]", err)
+	}
+	// 不合法时保留之前的配置
+	cfg["upload.max_size"] = "abc"
+	if err := store.Reload(); err == nil || store.Current().Upload.MaxSize != 200 {
+		t.Fatalf("unexpected reload %d[%v]", store.Current().Upload.MaxSize, err)
+	}
+	opts, err := (&Options{Config: cfg, Settings: store}).withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	icon, _ := DefaultResourceTypes.Lookup(RT_GAME_ICON)
+	if opts.uploadMaxSize(icon) != 200 {
+		t.Fatal("options not using settings store")
+	}
+}
+
+func TestOptionsInvalidSettings(t *testing.T) {
+	cfg := mapConfig{"upload.max_size": "abc"}
+	opts, err := (&Options{Config: cfg}).withDefaults()
+	var settingsErr *SettingsError
+	if !errors.As(err, &settingsErr) || !strings.Contains(err.Error(), "'upload.max_size' is not a number") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := NewStorageWithOptions(RT_GAME_ICON, "", &Options{Config: cfg}); !errors.As(err, &settingsErr) {
+		t.Fatalf("storage created with invalid config[%v]", err)
+	}
+	// 创建后不再读取Config
+	cfg["upload.max_size"] = int64(100)
+	icon, _ := DefaultResourceTypes.Lookup(RT_GAME_ICON)
+	if size := opts.uploadMaxSize(icon); size != 5<<20 {
+		t.Fatalf("unexpected max size %d", size)
+	}
+}
@@ -1,12 +1,9 @@
 package upload
 
 import (
-    "api_mgr/configs"
-    "api_mgr/utils"
     "archive/zip"
-    "errors"
+    "context"
     "fmt"
-    "io"
     "io/fs"
     "io/ioutil"
     "mime/multipart"
@@ -16,57 +13,11 @@ import (
     "strings"
     "time"
 
-    "git.yj.live/Golang/source/configmanager"
-    "git.yj.live/Golang/source/log"
     "github.com/google/uuid"
 )
 
-// ResourceType 资源类型
-type ResourceType int32
-
-// const .
-const (
-    RT_UNKNOWN              ResourceType = 0
-    RT_GAME_ICON            ResourceType = 1  // 1 游戏icon
-    RT_GAMEITEM_ICON        ResourceType = 2  // 2 游戏详情icon
-    RT_LOADING              ResourceType = 3  // 3 loading
-    RT_ACTIVITY_EVENT       ResourceType = 4  // 4 活动事件管理
-    RT_DOCUMENTS_AGENCY     ResourceType = 5  // 5 文档素材
-    RT_OFFICE_ICON          ResourceType = 6  // 6 官网ICON
-    RT_RECOMMEND_ICON       ResourceType = 7  // 7 推荐列表ICOn
-    RT_AGENT_CONTROL        ResourceType = 8  // 8 代理人调控
-    RT_CURRENCY             ResourceType = 9  // 9 货币
-    RT_GAME_BRAND           ResourceType = 10 // 游戏品牌
-    RT_MULTIPART            ResourceType = 11 // 分片类型
-    RT_GAME_HALL            ResourceType = 12 // 游戏大厅
-    RT_GAME_SKIN            ResourceType = 13 // 游戏皮肤
-    RT_GMAE_SHARE           ResourceType = 14 // 游戏分享, 此处仅占位作用，不能上传
-    RT_GAME_BRAND_HALL_ICON ResourceType = 15 // 游戏大厅的icon
-    // DIR_FILE_MODE 目录权限
-    DIR_FILE_MODE fs.FileMode = 0755
-)
-
-// Enum value maps for resourceType
-var (
-    ResourceTypeName = map[ResourceType]string{
-        RT_UNKNOWN:              "UNKNOWN",
-        RT_GAME_ICON:            "/icon",
-        RT_GAMEITEM_ICON:        "/gameitemicon",
-        RT_LOADING:              "/loading",
-        RT_ACTIVITY_EVENT:       "/activity",
-        RT_DOCUMENTS_AGENCY:     "/documents",
-        RT_OFFICE_ICON:          "/office_icon",
-        RT_RECOMMEND_ICON:       "/recommendicon",
-        RT_AGENT_CONTROL:        "/agent_control",
-        RT_CURRENCY:             "/currency",
-        RT_GAME_BRAND:           "/gamebrand",
-        RT_MULTIPART:            "/tmp",
-        RT_GAME_HALL:            "/game_hall",
-        RT_GAME_SKIN:            "/game_skin",
-        RT_GMAE_SHARE:           "/game_share",
-        RT_GAME_BRAND_HALL_ICON: "/brand_hall_icon",
-    }
-)
+// DIR_FILE_MODE 目录权限
+const DIR_FILE_MODE fs.FileMode = 0755
 
 // Storage .
 type Storage struct {
@@ -82,70 +33,88 @@ type Storage struct {
     resourceId        string
     customeResourceId bool
     delayJob          *StorageDelayJob
+    // 为空时按配置创建
+    urlFetcher *urlFetcher
+    opts       *Options
 }
 
-// NewStorage .
-func NewStorage(resourceType ResourceType, resourceId string) (*Storage, error) {
-    if _, ok := ResourceTypeName[resourceType]; !ok || resourceType == RT_UNKNOWN {
-        return nil, fmt.Errorf("invalid resource_type '%d'", resourceType)
+// NewStorageWithOptions opts.DelayJob为空时按opts创建, 不为空时命名空间需要相同
+func NewStorageWithOptions(resourceType ResourceType, resourceId string, opts *Options) (*Storage, error) {
+    opts, err := opts.withDefaults()
+    if err != nil {
+        return nil, internalError("storage.new", err, "load upload config")
+    }
+    if err := opts.Namespace.Validate(); err != nil {
+        return nil, newError(ErrInvalidArgument, "storage.new", "%s", err.Error())
+    }
+    typeDef, ok := opts.ResourceTypes.Lookup(resourceType)
+    if !ok {
+        return nil, newError(ErrUnsupportedType, "storage.new", "invalid resource_type '%d'", resourceType)
+    }
+    delayJob := opts.DelayJob
+    // 延迟删除只允许删除所属租户目录下的文件, 不能共用其他租户的延迟任务
+    if delayJob != nil && delayJob.opts.Namespace != opts.Namespace {
+        return nil, newError(ErrInvalidArgument, "storage.new", "delay job namespace '%s' mismatch '%s'",
+            delayJob.opts.Namespace, opts.Namespace)
+    }
+    if delayJob == nil {
+        var err error
+        if delayJob, err = NewStorageDelayJobWithOptions(opts); err != nil {
+            return nil, err
+        }
     }
     storage := &Storage{
-        uploadPath:        configs.Config.Upload.UploadPath, // 图片上传的目录
-        cdnPath:           configs.Config.Upload.RootPath,   // 这个是cdn目录（图片上传成功复制到cdn目录：UploadPath =》RootPath）
+        uploadPath:        opts.uploadRoot(),     // 图片上传的目录
+        cdnPath:           opts.cdnRoot(typeDef), // 这个是cdn目录（图片上传成功复制到cdn目录：UploadPath =》RootPath）
         resourceType:      resourceType,
         resourceId:        resourceId,
-        version:           fmt.Sprintf("%d", time.Now().Unix()),
+        version:           fmt.Sprintf("%d", opts.now().Unix()),
         customeResourceId: resourceId != "",
-        delayJob:          NewStorageDelayJob(),
+        delayJob:          delayJob,
+        opts:              opts,
     }
     if resourceId == "" {
-        storage.resourceId = uuid.NewString() + "_" + configmanager.GetString("hostname", "1")
-    }
-    if resourceType == RT_DOCUMENTS_AGENCY || resourceType == RT_AGENT_CONTROL {
-        // 这两种上传目录特殊处理
-        storage.cdnPath = configs.Config.Upload.DownloadPath
+        storage.resourceId = uuid.NewString() + "_" + opts.Hostname
     }
     return storage, nil
 }
 
 // Upload 调用此方法需要调用UploadAndRename方法删除延迟任务，不然一段时间后文件将会被删除
 // 上传文件到上传路径
-func (s *Storage) Upload(file *multipart.FileHeader) (string, error) {
+// ctx取消时停止写入并删除不完整的文件
+func (s *Storage) Upload(ctx context.Context, file *multipart.FileHeader) (string, error) {
     if err := s.uploadValid(file); err != nil {
         return "", err
     }
-    uploadPath := s.uploadFullPathByName(file.Filename)
-    dstFile, err := os.Create(uploadPath)
-    if err != nil {
-        log.L().Errorf("create file '%s' fail[%s]", uploadPath, err.Error())
+    if err := s.quotaValid(ctx, "storage.upload", file.Size); err != nil {
         return "", err
     }
-    defer dstFile.Close()
+    uploadPath := s.uploadFullPathByName(file.Filename)
     uploadFile, err := file.Open()
     if err != nil {
-        log.L().Errorf("open file '%s' fail[%s]", file.Filename, err.Error())
+        s.opts.Logger.Errorf("open file '%s' fail[%s]", file.Filename, err.Error())
         return "", err
     }
     defer uploadFile.Close()
-    if _, err := io.Copy(dstFile, uploadFile); err != nil {
-        log.L().Errorf("save upload file '%s' to '%s' fail[%s]", file.Filename, uploadPath, err.Error())
+    if _, err := writeFileContext(ctx, uploadPath, 0666, uploadFile); err != nil {
+        s.opts.Logger.Errorf("save upload file '%s' to '%s' fail[%s]", file.Filename, uploadPath, err.Error())
         return "", err
     }
     // 添加延迟任务删除临时文件
-    s.delayJob.Add(uploadPath)
+    s.delayDelete(ctx, uploadPath)
     return fmt.Sprintf("%s?v=%s&where=upload", s.fileName(file.Filename), s.version), nil
 }
 
 // UploadAndRename 文件上传
 // 将文件从uploadpath拷贝到CDNpath
-func (s *Storage) UploadAndRename(uploadPath string) (string, error) {
-    uploadFullPath, err := s.UploadFullPathByPath(uploadPath)
+func (s *Storage) UploadAndRename(ctx context.Context, uploadPath string) (string, error) {
+    uploadFullPath, err := s.UploadFullPathByPath(ctx, uploadPath)
     if err != nil {
         return "", err
     }
     if uploadFullPath != "" {
         // 拷贝到自定义目录
-        if err := s.copy(uploadFullPath); err != nil {
+        if err := s.copy(ctx, uploadFullPath); err != nil {
             return "", err
         }
         return fmt.Sprintf("%s?v=%s", s.fileName(uploadFullPath), s.version), nil
@@ -154,92 +123,137 @@ func (s *Storage) UploadAndRename(uploadPath string) (string, error) {
 }
 
 // UnzipAndDelete 解压到指定目录并删除
-func (s *Storage) UnzipAndDelete(uploadPath string) error {
-    return s.UnzipAndDeleteWithPath(uploadPath, "")
+func (s *Storage) UnzipAndDelete(ctx context.Context, uploadPath string) error {
+    return s.UnzipAndDeleteWithPath(ctx, uploadPath, "")
 }
 
 // UnzipAndDeleteWithPath 解压到指定目录并删除
-func (s *Storage) UnzipAndDeleteWithPath(uploadPath string, unzipPath string) error {
-    uploadPath = s.parse(uploadPath)
-    unzipDir := filepath.Join(s.cdnPath, ResourceTypeName[s.resourceType])
+// ctx取消时停止解压, 正在写入的文件被删除, 已解压的文件和压缩包保留
+func (s *Storage) UnzipAndDeleteWithPath(ctx context.Context, uploadPath string, unzipPath string) error {
+    relPath, uploadPath, err := s.uploadFullPath("storage.unzip", uploadPath)
+    if err != nil {
+        return err
+    }
+    unzipDir := filepath.Join(s.cdnPath, s.typeDef().Dir)
     if unzipPath != "" {
-        unzipDir = filepath.Join(unzipDir, unzipPath)
+        // 解压目录只能在资源类型目录下
+        unzipDir = filepath.Join(unzipDir, filepath.Clean("/"+unzipPath))
     }
-    if !utils.IsExist(unzipDir) {
+    if !isExist(unzipDir) {
         if err := os.MkdirAll(unzipDir, 0755); err != nil {
-            return fmt.Errorf("create dir '%s' fail[%s]", unzipDir, err.Error())
+            return internalError("storage.unzip", err, "create dir '%s'", unzipDir)
         }
     }
-    uploadPath = filepath.Join(s.uploadPath, uploadPath)
-    if !utils.IsExist(uploadPath) {
-        return fmt.Errorf("file '%s' not found", uploadPath)
+    if !isExist(uploadPath) {
+        // 当前节点不存在, 从所属节点拉取
+        if err := s.fetchFromOwner(ctx, relPath); err != nil {
+            return newError(ErrNotFound, "storage.unzip", "file '%s' not found", uploadPath)
+        }
     }
 
     reader, err := zip.OpenReader(uploadPath)
     if err != nil {
-        log.L().Errorf("unzip file '%s' fail[%s]", uploadPath, err.Error())
+        s.opts.Logger.Errorf("unzip file '%s' fail[%s]", uploadPath, err.Error())
         return err
     }
     defer reader.Close()
+    // 按解压后覆盖前后的大小占用配额, 失败时按实际写入的大小修正
+    var targets []string
+    var delta, targetSize int64
+    for _, item := range reader.File {
+        // 写入前拒绝解压到解压目录之外的文件和符号链接
+        target := filepath.Join(unzipDir, item.Name)
+        if !isSubPath(target, unzipDir) {
+            return newError(ErrInvalidArgument, "storage.unzip", "zip entry '%s' outside unzip dir", item.Name)
+        }
+        if item.Mode()&os.ModeSymlink != 0 {
+            return newError(ErrInvalidArgument, "storage.unzip", "zip entry '%s' is symlink", item.Name)
+        }
+        if item.FileInfo().IsDir() {
+            continue
+        }
+        targets = append(targets, target)
+        size := pathSize(target)
+        targetSize += size
+        delta += int64(item.UncompressedSize64) - size
+    }
+    if err := s.reserveBytes(ctx, "storage.unzip", delta); err != nil {
+        return err
+    }
+    unzipped := false
+    defer func() {
+        if unzipped {
+            return
+        }
+        var written int64
+        for _, target := range targets {
+            written += pathSize(target)
+        }
+        s.opts.releaseBytes(ctx, s.resourceType, delta-(written-targetSize))
+    }()
     for _, item := range reader.File {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
         filePath := filepath.Join(unzipDir, item.Name)
         if item.FileInfo().IsDir() {
             if err := os.MkdirAll(filePath, 0755); err != nil {
-                log.L().Errorf("create dir '%s' fail[%s]", filePath, err.Error())
+                s.opts.Logger.Errorf("create dir '%s' fail[%s]", filePath, err.Error())
                 return err
             }
             continue
         } else {
-            if dir := filepath.Dir(filePath); !utils.IsExist(dir) {
+            if dir := filepath.Dir(filePath); !isExist(dir) {
                 if err := os.MkdirAll(dir, 0755); err != nil {
-                    log.L().Errorf("create dir '%s' fail[%s]", dir, err.Error())
+                    s.opts.Logger.Errorf("create dir '%s' fail[%s]", dir, err.Error())
                     return err
                 }
             }
         }
         rc, err := item.Open()
         if err != nil {
-            return fmt.Errorf("open file '%s' fail[%s]", item.Name, err.Error())
+            return internalError("storage.unzip", err, "open file '%s'", item.Name)
         }
-        dst, err := os.Create(filePath)
+        _, err = writeFileContext(ctx, filePath, 0666, rc)
+        rc.Close()
         if err != nil {
-            log.L().Errorf("create file '%s' fail[%s]", filePath, err.Error())
+            s.opts.Logger.Errorf("write file '%s' into '%s' fail[%s]", item.Name, filePath, err.Error())
             return err
         }
-        if _, err := io.Copy(dst, rc); err != nil {
-            log.L().Errorf("write file '%s' into '%s' fail[%s]", item.Name, filePath, err.Error())
-            return err
-        }
-        dst.Close()
-        rc.Close()
     }
+    unzipped = true
     if err := os.Remove(uploadPath); err != nil {
-        log.L().Errorf("remove file '%s' fail[%s]", uploadPath, err.Error())
+        s.opts.Logger.Errorf("remove file '%s' fail[%s]", uploadPath, err.Error())
         return err
     }
     return nil
 }
 
 // UploadFullPathByPath 上传全路径
-func (s *Storage) UploadFullPathByPath(uploadPath string) (string, error) {
-    uploadPath = s.parse(uploadPath)
+func (s *Storage) UploadFullPathByPath(ctx context.Context, uploadPath string) (string, error) {
+    relPath, fullPath, err := s.uploadFullPath("storage.path", uploadPath)
+    if err != nil {
+        return "", err
+    }
     if s.where == "" {
         return "", nil
     }
-    uploadPath = filepath.Join(s.uploadPath, uploadPath)
-    if !utils.IsExist(uploadPath) {
-        return "", fmt.Errorf("file '%s' not found", uploadPath)
+    if !isExist(fullPath) {
+        // 当前节点不存在, 从所属节点拉取
+        if err := s.fetchFromOwner(ctx, relPath); err != nil {
+            return "", newError(ErrNotFound, "storage.path", "file '%s' not found", fullPath)
+        }
     }
-    return uploadPath, nil
+    return fullPath, nil
 }
 
 // UploadFullPath 上传文件全路径
 func (s *Storage) uploadFullPathByName(fileName string) string {
     filePath := filepath.Join(s.uploadPath, s.fileName(fileName))
     fileDir := filepath.Dir(filePath)
-    if !utils.IsExist(fileDir) {
+    if !isExist(fileDir) {
         if err := os.MkdirAll(fileDir, 0755); err != nil {
-            log.L().Errorf("mkdir '%s' fail[%s]", fileDir, err.Error())
+            s.opts.Logger.Errorf("mkdir '%s' fail[%s]", fileDir, err.Error())
             return filePath
         }
     }
@@ -250,9 +264,9 @@ func (s *Storage) uploadFullPathByName(fileName string) string {
 func (s *Storage) cdnFullPath(uploadFullPath string) string {
     cdnFullPath := filepath.Join(s.cdnPath, s.fileName(uploadFullPath))
     fileDir := filepath.Dir(cdnFullPath)
-    if !utils.IsExist(fileDir) {
+    if !isExist(fileDir) {
         if err := os.MkdirAll(fileDir, 0755); err != nil {
-            log.L().Errorf("mkdir '%s' fail[%s]", fileDir, err.Error())
+            s.opts.Logger.Errorf("mkdir '%s' fail[%s]", fileDir, err.Error())
             return cdnFullPath
         }
     }
@@ -261,10 +275,22 @@ func (s *Storage) cdnFullPath(uploadFullPath string) string {
 
 // FileName /resourceType/resourceId.suffix
 func (s *Storage) fileName(fileName string) string {
-    return filepath.Join(ResourceTypeName[s.resourceType],
+    return filepath.Join(s.typeDef().Dir,
         fmt.Sprintf("%s%s", s.resourceId, filepath.Ext(fileName)))
 }
 
+// uploadFullPath 解析Upload返回的路径, 返回上传目录下的相对路径和全路径
+// 返回的路径以资源类型目录开头, 清理后不在上传目录下时返回 ErrInvalidArgument
+func (s *Storage) uploadFullPath(op, uploadPath string) (string, string, error) {
+    relPath := s.parse(uploadPath)
+    fullPath := filepath.Join(s.uploadPath, relPath)
+    if rel, err := filepath.Rel(s.uploadPath, fullPath); err != nil || rel == "." ||
+        rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", "", newError(ErrInvalidArgument, op, "invalid upload path '%s'", uploadPath)
+    }
+    return filepath.Clean(relPath), fullPath, nil
+}
+
 func (s *Storage) parse(uploadPath string) string {
     u, err := url.Parse(uploadPath)
     if err == nil {
@@ -275,13 +301,16 @@ func (s *Storage) parse(uploadPath string) string {
         }
         s.where = u.Query().Get("where")
     } else {
-        log.L().Errorf("parse upload_path fail[%s]", err.Error())
+        s.opts.Logger.Errorf("parse upload_path fail[%s]", err.Error())
     }
     return uploadPath
 }
 
 // 上传校验
 func (s *Storage) uploadValid(file *multipart.FileHeader) error {
+    if err := s.uploadableValid(); err != nil {
+        return err
+    }
     if err := s.uploadSizeValid(file); err != nil {
         return err
     }
@@ -292,9 +321,13 @@ func (s *Storage) uploadValid(file *multipart.FileHeader) error {
 }
 
 func (s *Storage) uploadSuffixValid(file *multipart.FileHeader) error {
+    return s.uploadSuffixValidByName(file.Filename)
+}
+
+func (s *Storage) uploadSuffixValidByName(fileName string) error {
     suffixes := s.uploadSuffixLimit()
     if len(suffixes) != 0 {
-        fileSuffix := filepath.Ext(file.Filename)
+        fileSuffix := filepath.Ext(fileName)
         exist := false
         for _, suffix := range suffixes {
             if strings.TrimSpace(suffix) == fileSuffix {
@@ -303,7 +336,7 @@ func (s *Storage) uploadSuffixValid(file *multipart.FileHeader) error {
             }
         }
         if !exist {
-            return fmt.Errorf("unsupport file suffix '%s' on resource_type '%d', support %v", fileSuffix, s.resourceType, suffixes)
+            return newError(ErrUnsupportedType, "storage.upload", "unsupport file suffix '%s' on resource_type '%d', support %v", fileSuffix, s.resourceType, suffixes)
         }
     }
     return nil
@@ -313,55 +346,86 @@ func (s *Storage) uploadSuffixValid(file *multipart.FileHeader) error {
 func (s *Storage) uploadSizeValid(file *multipart.FileHeader) error {
     sizeLimit := s.uploadSizeLimit()
     if file.Size > sizeLimit {
-        return fmt.Errorf("upload size exceed limit(%d, %d)", file.Size, sizeLimit)
+        return newError(ErrTooLarge, "storage.upload", "upload size exceed limit(%d, %d)", file.Size, sizeLimit)
+    }
+    return nil
+}
+
+// 占位的资源类型不能上传
+func (s *Storage) uploadableValid() error {
+    if def := s.typeDef(); !def.Uploadable {
+        return newError(ErrUnsupportedType, "storage.upload", "resource_type '%s' not uploadable", def.Name)
     }
     return nil
 }
 
 // 支持的文件后缀， 多个后缀以英文逗号分隔
 func (s *Storage) uploadSuffixLimit() []string {
-    return strings.Split(configmanager.GetString(fmt.Sprintf("upload.%d.accept_suffixes", s.resourceType),
-        configmanager.GetString("upload.accept_suffixes", ".jpg,.jpeg,.png,.zip,.csv,.json,.atlas,.xls,.xlsx")), ",")
+    return s.opts.uploadAcceptSuffixes(s.typeDef())
 }
 
 func (s *Storage) uploadSizeLimit() int64 {
-    return configmanager.GetInt64(fmt.Sprintf("upload.%d.max_size", s.resourceType),
-        configmanager.GetInt64("upload.max_size", 1024*1024*5))
+    return s.opts.uploadMaxSize(s.typeDef())
+}
+
+// typeDef 当前资源类型的定义, 未注册时为空
+func (s *Storage) typeDef() ResourceTypeDef {
+    def, _ := s.opts.ResourceTypes.Lookup(s.resourceType)
+    return def
+}
+
+// retention 暂存文件保留时间, 资源类型没有设置时使用 storage.delay_delete.duration
+func (s *Storage) retention() time.Duration {
+    if def := s.typeDef(); def.Retention > 0 {
+        return def.Retention
+    }
+    return s.delayJob.delayDuration()
+}
+
+// delayDelete 添加延迟任务, 保留时间后删除暂存文件
+func (s *Storage) delayDelete(ctx context.Context, filePath string) {
+    s.delayJob.AddWithDelay(ctx, filePath, s.retention())
 }
 
 // upload/ -> cdn/
 // copy 如果是本机重命名, 如果不是需要下载到指定文件
-func (s *Storage) copy(uploadFullPath string) error {
+func (s *Storage) copy(ctx context.Context, uploadFullPath string) error {
     // 保存目录更换为cdn目录
     cdnFullPath := s.cdnFullPath(uploadFullPath)
-    log.L().Debugf("move file '%s' to '%s' need rename '%v'", uploadFullPath, cdnFullPath, s.customeResourceId)
+    s.opts.Logger.Debugf("move file '%s' to '%s' need rename '%v'", uploadFullPath, cdnFullPath, s.customeResourceId)
     if s.customeResourceId && cdnFullPath != uploadFullPath {
-        log.L().Debugf("move file--22 '%s' to '%s' need rename '%v'", uploadFullPath, cdnFullPath, s.customeResourceId)
-        if utils.IsExist(uploadFullPath) {
-            if err := copy(uploadFullPath, cdnFullPath); err != nil {
-                log.L().Errorf("copy file '%s' to '%s' fail[%s]", uploadFullPath, cdnFullPath, err.Error())
+        if !isExist(uploadFullPath) {
+            // 下载到指定文件
+            s.opts.Logger.Warnf("file '%s' not found in current host", uploadFullPath)
+            relPath, err := filepath.Rel(s.uploadPath, uploadFullPath)
+            if err != nil {
+                return err
+            }
+            if err := s.fetchFromOwner(ctx, relPath); err != nil {
                 return err
             }
-        } else {
-            // 下载到指定文件
-            log.L().Warnf("file '%s' not found in current host", uploadFullPath)
+        }
+        // 按覆盖前后的大小占用配额
+        cdnSize := pathSize(cdnFullPath)
+        delta := pathSize(uploadFullPath) - cdnSize
+        if err := s.reserveBytes(ctx, "storage.publish", delta); err != nil {
+            return err
+        }
+        if err := copy(ctx, uploadFullPath, cdnFullPath); err != nil {
+            s.opts.Logger.Errorf("copy file '%s' to '%s' fail[%s]", uploadFullPath, cdnFullPath, err.Error())
+            // 目录拷贝失败时可能已写入部分文件, 按实际大小修正
+            s.opts.releaseBytes(ctx, s.resourceType, delta-(pathSize(cdnFullPath)-cdnSize))
+            return err
         }
     } else {
-        log.L().Debugf("move file--33 '%s' to '%s' need rename '%v'", uploadFullPath, cdnFullPath, s.customeResourceId)
         // 从延迟队列删除
-        if s.customeResourceId == false {
-            log.L().Debugf("move file--44 '%s' to '%s' need rename '%v'", uploadFullPath, cdnFullPath, s.customeResourceId)
-            s.delayJob.Remove(uploadFullPath)
-        } else {
-            log.L().Debugf("move file--55 '%s' to '%s' need rename '%v'", uploadFullPath, cdnFullPath, s.customeResourceId)
-            s.delayJob.Remove(uploadFullPath)
-        }
+        s.delayJob.Remove(ctx, uploadFullPath)
     }
     return nil
 }
 
 // 拷贝文件
-func copyDir(src, dest string) error {
+func copyDir(ctx context.Context, src, dest string) error {
     if !isExist(dest) {
         if err := os.MkdirAll(dest, DIR_FILE_MODE); err != nil {
             return err
@@ -372,18 +436,26 @@ func copyDir(src, dest string) error {
         return err
     }
     for _, fs := range dirs {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
         srcPath := filepath.Join(src, fs.Name())
         destPath := filepath.Join(dest, fs.Name())
         if fs.IsDir() {
-            copyDir(srcPath, destPath)
+            if err := copyDir(ctx, srcPath, destPath); err != nil {
+                return err
+            }
+            continue
+        }
+        if err := copyFile(ctx, srcPath, destPath); err != nil {
+            return err
         }
-        copyFile(srcPath, destPath)
     }
     return nil
 }
 
-// 拷贝文件
-func copyFile(src, dest string) error {
+// 拷贝文件, 失败或ctx取消时删除不完整的目标文件
+func copyFile(ctx context.Context, src, dest string) error {
     destDirPath := filepath.Dir(dest)
     if !isExist(destDirPath) {
         if err := os.MkdirAll(destDirPath, DIR_FILE_MODE); err != nil {
@@ -395,36 +467,29 @@ func copyFile(src, dest string) error {
         return err
     }
     defer sfile.Close()
-    dfile, err := os.OpenFile(dest, os.O_RDWR|os.O_TRUNC|os.O_CREATE, os.ModePerm)
-    if err != nil {
-        return err
-    }
-    defer dfile.Close()
-    if _, err := io.Copy(dfile, sfile); err != nil {
-        return err
-    }
-    return nil
+    _, err = writeFileContext(ctx, dest, os.ModePerm, sfile)
+    return err
 }
 
 // 拷贝文件或目录
-func copy(src, dest string) error {
+func copy(ctx context.Context, src, dest string) error {
     if !isExist(src) {
-        return fmt.Errorf("path '%s' not found", src)
+        return newError(ErrNotFound, "storage.copy", "path '%s' not found", src)
     }
     if err := isDir(src); err == nil {
         // 如果源文件是个目录,则目标文件必须是个目录
-        return copyDir(src, dest)
+        return copyDir(ctx, src, dest)
     }
-    return copyFile(src, dest)
+    return copyFile(ctx, src, dest)
 }
 
 func isDir(file string) error {
     s, err := os.Stat(file)
     if err != nil {
-        return fmt.Errorf("path '%s' not exist", file)
+        return newError(ErrNotFound, "storage.copy", "path '%s' not exist", file)
     }
     if !s.IsDir() {
-        return fmt.Errorf("path '%s' not a dir", file)
+        return newError(ErrInvalidArgument, "storage.copy", "path '%s' not a dir", file)
     }
     return nil
 }
@@ -438,10 +503,9 @@ func isExist(file string) bool {
     return true
 }
 
-// CdnFilePath 返回不同业务cdn存放的目录
-func CdnFilePath(resourceType ResourceType) (string, error) {
-    if _, ok := ResourceTypeName[resourceType]; ok {
-        return filepath.Join(configs.Config.Upload.RootPath, ResourceTypeName[resourceType]), nil
-    }
-    return "", errors.New("resourceType no exists")
+// CdnFilePathWithOptions 返回不同业务cdn存放的目录
+func CdnFilePathWithOptions(resourceType ResourceType, opts *Options) (string, error) {
+    // 只使用资源类型和目录, 不需要校验配置
+    opts, _ = opts.withDefaults()
+    return opts.cdnFilePath(resourceType)
 }
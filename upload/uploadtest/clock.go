@@ -0,0 +1,38 @@
+package uploadtest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 可控制的时钟, 实现 upload.Clock
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock .
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now .
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance 前进d
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set 设置当前时间
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
@@ -0,0 +1,86 @@
+package uploadtest
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// Config 实现 upload.Config, 未设置的配置使用默认值
+//
+//	h.Config["upload.max_size"] = 1024
+//	h.Config["storage.delay_delete.duration"] = "1h"
+type Config map[string]interface{}
+
+// Keys 实现 upload.ConfigKeys, LoadSettings 可以检查拼写错误
+func (c Config) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// GetString .
+func (c Config) GetString(key string, defaultValue string) string {
+	value, ok := c[key]
+	if !ok {
+		return defaultValue
+	}
+	return fmt.Sprint(value)
+}
+
+// GetInt64 .
+func (c Config) GetInt64(key string, defaultValue int64) int64 {
+	switch value := c[key].(type) {
+	case int:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case int64:
+		return value
+	case string:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+// GetBool .
+func (c Config) GetBool(key string, defaultValue bool) bool {
+	switch value := c[key].(type) {
+	case bool:
+		return value
+	case string:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+// Logger 输出到测试日志
+type Logger struct {
+	T testing.TB
+}
+
+// Debugf .
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.T.Logf("DEBUG "+format, args...)
+}
+
+// Infof .
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.T.Logf("INFO "+format, args...)
+}
+
+// Warnf .
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.T.Logf("WARN "+format, args...)
+}
+
+// Errorf .
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.T.Logf("ERROR "+format, args...)
+}
@@ -0,0 +1,76 @@
+package uploadtest
+
+import (
+	"archive/zip"
+	"bytes"
+	"mime/multipart"
+	"sort"
+	"testing"
+)
+
+// FileHeader 构造表单上传的文件
+func FileHeader(t testing.TB, filename string, content []byte) *multipart.FileHeader {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	form, err := multipart.NewReader(body, writer.Boundary()).ReadForm(int64(len(content)) + 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["file"][0]
+}
+
+// ZipFileHeader 构造zip文件, files为文件名和内容
+func ZipFileHeader(t testing.TB, filename string, files map[string][]byte) *multipart.FileHeader {
+	t.Helper()
+	return FileHeader(t, filename, ZipContent(t, files))
+}
+
+// ZipContent zip文件内容, 按文件名排序
+func ZipContent(t testing.TB, files map[string][]byte) []byte {
+	t.Helper()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	writer := zip.NewWriter(buf)
+	for _, name := range names {
+		w, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Chunks 按分片大小拆分内容
+func Chunks(content []byte, chunkSize int64) [][]byte {
+	var chunks [][]byte
+	for start := int64(0); start < int64(len(content)); start += chunkSize {
+		end := start + chunkSize
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		chunks = append(chunks, content[start:end])
+	}
+	return chunks
+}
@@ -0,0 +1,153 @@
+// Package uploadtest 上传存储的测试工具
+// 使用临时目录、进程内的redis和可控制的时钟创建 upload.Storage, 不依赖外部服务
+//
+//	h := uploadtest.New(t)
+//	storage := h.Storage(upload.RT_GAME_ICON)
+//	uploadPath, err := storage.Upload(ctx, uploadtest.FileHeader(t, "a.png", content))
+//	h.Advance(time.Hour)
+//	h.RunDelayJobs() // 过期的暂存文件被删除
+package uploadtest
+
+import (
+	"api_mgr/upload"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// Harness 测试环境, 测试结束时自动清理
+type Harness struct {
+	t testing.TB
+	// 临时目录, 下面有upload, cdn, download三个目录
+	Root  string
+	Redis *miniredis.Miniredis
+	Clock *Clock
+	// 可以在创建Storage前修改
+	Config   Config
+	Options  *upload.Options
+	DelayJob *upload.StorageDelayJob
+}
+
+// New 创建测试环境
+func New(t testing.TB) *Harness {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"upload", "cdn", "download"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { cli.Close() })
+	h := &Harness{
+		t:      t,
+		Root:   root,
+		Redis:  mr,
+		Clock:  NewClock(time.Now()),
+		Config: Config{},
+	}
+	h.Options = &upload.Options{
+		UploadPath:   filepath.Join(root, "upload"),
+		RootPath:     filepath.Join(root, "cdn"),
+		DownloadPath: filepath.Join(root, "download"),
+		Hostname:     "uploadtest",
+		Redis:        cli,
+		Config:       h.Config,
+		Logger:       &Logger{T: t},
+		Clock:        h.Clock,
+		// 每个测试使用单独的注册表, 注册的类型不影响其他测试
+		ResourceTypes: upload.NewDefaultResourceTypeRegistry(),
+	}
+	job, err := upload.NewStorageDelayJobWithOptions(h.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.DelayJob = job
+	h.Options.DelayJob = job
+	return h
+}
+
+// WithNamespace 共用目录, redis和时钟的另一个租户, 用于测试租户隔离
+func (h *Harness) WithNamespace(ns upload.Namespace) *Harness {
+	h.t.Helper()
+	opts := *h.Options
+	opts.Namespace = ns
+	opts.DelayJob = nil
+	opts.Metadata = upload.NewRedisMetadataStoreWithOptions(&opts)
+	tenant := *h
+	tenant.Options = &opts
+	job, err := upload.NewStorageDelayJobWithOptions(tenant.Options)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	tenant.DelayJob = job
+	tenant.Options.DelayJob = job
+	return &tenant
+}
+
+// Storage 创建普通上传存储, resourceId为空时自动生成
+func (h *Harness) Storage(resourceType upload.ResourceType, resourceId ...string) *upload.Storage {
+	h.t.Helper()
+	storage, err := upload.NewStorageWithOptions(resourceType, firstOrEmpty(resourceId), h.Options)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return storage
+}
+
+// MultipartStorage 创建分片上传存储
+func (h *Harness) MultipartStorage(resourceType upload.ResourceType, resourceId ...string) *upload.MultipartStorage {
+	h.t.Helper()
+	storage, err := upload.NewMultipartStorageWithOptions(resourceType, firstOrEmpty(resourceId), h.Options)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return storage
+}
+
+// Advance 时钟和redis过期时间同时前进
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+	h.Redis.FastForward(d)
+}
+
+// RunDelayJobs 执行当前时间已到期的延迟任务
+func (h *Harness) RunDelayJobs() {
+	h.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.DelayJob.Sweep(ctx); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// UploadPath 暂存目录下的路径, 参数为Upload等方法返回的路径
+func (h *Harness) UploadPath(path string) string {
+	return filepath.Join(h.Options.Namespace.Path(h.Options.UploadPath), trimQuery(path))
+}
+
+// CdnPath cdn目录下的路径
+func (h *Harness) CdnPath(elem ...string) string {
+	return filepath.Join(append([]string{h.Options.Namespace.Path(h.Options.RootPath)}, elem...)...)
+}
+
+func firstOrEmpty(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func trimQuery(path string) string {
+	if index := strings.Index(path, "?"); index >= 0 {
+		return path[:index]
+	}
+	return path
+}
@@ -0,0 +1,390 @@
+package uploadtest_test
+
+import (
+	"api_mgr/upload"
+	"api_mgr/upload/uploadtest"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pngContent = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1}, 64)...)
+
+func TestUploadExpire(t *testing.T) {
+	h := uploadtest.New(t)
+	h.Config["storage.delay_delete.duration"] = "10m"
+	uploadPath, err := h.Storage(upload.RT_GAME_ICON).Upload(context.Background(), uploadtest.FileHeader(t, "a.png", pngContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.RunDelayJobs()
+	if _, err := os.Stat(h.UploadPath(uploadPath)); err != nil {
+		t.Fatalf("file deleted before expiry[%v]", err)
+	}
+	h.Advance(11 * time.Minute)
+	h.RunDelayJobs()
+	if _, err := os.Stat(h.UploadPath(uploadPath)); !os.IsNotExist(err) {
+		t.Fatalf("file not deleted after expiry[%v]", err)
+	}
+}
+
+func TestUnzipAndDelete(t *testing.T) {
+	h := uploadtest.New(t)
+	storage := h.Storage(upload.RT_ACTIVITY_EVENT)
+	uploadPath, err := storage.Upload(context.Background(), uploadtest.ZipFileHeader(t, "a.zip", map[string][]byte{
+		"index.json":   []byte("{}"),
+		"img/icon.png": pngContent,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UnzipAndDelete(context.Background(), uploadPath); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(h.CdnPath("activity", "img", "icon.png"))
+	if err != nil || !bytes.Equal(content, pngContent) {
+		t.Fatalf("unexpected unzipped file[%v]", err)
+	}
+	if _, err := os.Stat(h.UploadPath(uploadPath)); !os.IsNotExist(err) {
+		t.Fatalf("zip file not deleted[%v]", err)
+	}
+}
+
+func TestUnzipUnsafeEntry(t *testing.T) {
+	h := uploadtest.New(t)
+	storage := h.Storage(upload.RT_ACTIVITY_EVENT)
+	for name, header := range map[string]*zip.FileHeader{
+		"zip slip": {Name: "../../evil.txt"},
+		"symlink":  symlinkHeader("link"),
+	} {
+		buf := &bytes.Buffer{}
+		writer := zip.NewWriter(buf)
+		w, err := writer.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("../../evil.txt"))
+		writer.Close()
+		uploadPath, err := storage.Upload(context.Background(), uploadtest.FileHeader(t, "a.zip", buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.UnzipAndDelete(context.Background(), uploadPath); !errors.Is(err, upload.ErrInvalidArgument) {
+			t.Fatalf("%s want invalid argument, got %v", name, err)
+		}
+		// 拒绝时不写入任何文件, 压缩包保留
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(h.CdnPath()), "evil.txt")); !os.IsNotExist(err) {
+			t.Fatalf("%s file written outside unzip dir[%v]", name, err)
+		}
+		if _, err := os.Lstat(h.CdnPath("activity", "link")); !os.IsNotExist(err) {
+			t.Fatalf("%s symlink written[%v]", name, err)
+		}
+		if _, err := os.Stat(h.UploadPath(uploadPath)); err != nil {
+			t.Fatalf("%s zip file deleted[%v]", name, err)
+		}
+	}
+}
+
+// symlinkHeader 符号链接, 内容为链接目标
+func symlinkHeader(name string) *zip.FileHeader {
+	header := &zip.FileHeader{Name: name}
+	header.SetMode(os.ModeSymlink | 0777)
+	return header
+}
+
+func TestMultipartUpload(t *testing.T) {
+	h := uploadtest.New(t)
+	h.Config["multipart_upload.chunk_size"] = 40
+	content := uploadtest.ZipContent(t, map[string][]byte{"a.png": pngContent, "b.png": pngContent})
+	storage := h.MultipartStorage(upload.RT_ACTIVITY_EVENT)
+	start, plan, err := storage.Start(context.Background(), &upload.MultipartUploadStartRequest{Type: upload.RT_ACTIVITY_EVENT, Filename: "a.zip"}, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, chunk := range uploadtest.Chunks(content, plan.ChunkSize) {
+		sum := md5.Sum(chunk)
+		if _, err := h.MultipartStorage(upload.RT_ACTIVITY_EVENT).Upload(context.Background(), &upload.MultipartUploadChunkRequest{
+			UploadId:   start.UploadId,
+			Chunk:      int32(i + 1),
+			ContentMd5: hex.EncodeToString(sum[:]),
+		}, uploadtest.FileHeader(t, "a.zip", chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done, err := h.MultipartStorage(upload.RT_ACTIVITY_EVENT, start.UploadId).Done(context.Background(), start.UploadId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := os.ReadFile(h.UploadPath(done.DownloadPath))
+	if err != nil || !bytes.Equal(merged, content) {
+		t.Fatalf("unexpected merged file[%v]", err)
+	}
+
+	// 元数据过期后不能再合并
+	h.Advance(time.Hour)
+	h.RunDelayJobs()
+	if _, err := h.MultipartStorage(upload.RT_ACTIVITY_EVENT, start.UploadId).Done(context.Background(), start.UploadId); !errors.Is(err, upload.ErrNotFound) {
+		t.Fatalf("expect expired upload error[%v]", err)
+	}
+}
+
+func TestUploadCanceled(t *testing.T) {
+	h := uploadtest.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.Storage(upload.RT_GAME_ICON).Upload(ctx, uploadtest.FileHeader(t, "a.png", pngContent)); err == nil {
+		t.Fatal("expect canceled error")
+	}
+	// 不完整的文件已删除
+	var files []string
+	filepath.WalkDir(h.Options.UploadPath, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 0 {
+		t.Fatalf("unexpected files %v", files)
+	}
+}
+
+func TestRegisteredResourceType(t *testing.T) {
+	h := uploadtest.New(t)
+	if err := h.Options.ResourceTypes.RegisterJSON([]byte(`[{"id": 100, "name": "avatar", "dir": "/avatar",
+		"cdn_root": "download", "accept_suffixes": [".png"], "max_size": 100, "retention": "1m", "uploadable": true}]`)); err != nil {
+		t.Fatal(err)
+	}
+	avatar, err := h.Options.ResourceTypes.Parse("avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := h.Storage(avatar, "a1")
+	if _, err := storage.Upload(context.Background(), uploadtest.FileHeader(t, "a.jpg", pngContent)); !errors.Is(err, upload.ErrUnsupportedType) {
+		t.Fatalf("expect unsupported suffix[%v]", err)
+	}
+	uploadPath, err := storage.Upload(context.Background(), uploadtest.FileHeader(t, "a.png", pngContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.UploadAndRename(context.Background(), uploadPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(h.Options.DownloadPath, "avatar", "a1.png")); err != nil {
+		t.Fatalf("file not published to download path[%v]", err)
+	}
+
+	// 解压到注册类型的目录, 不是cdn根目录
+	if err := h.Options.ResourceTypes.RegisterJSON([]byte(`[{"id": 101, "name": "bundle", "dir": "/bundle",
+		"accept_suffixes": [".zip"], "uploadable": true}]`)); err != nil {
+		t.Fatal(err)
+	}
+	bundle := h.Storage(101)
+	zipPath, err := bundle.Upload(context.Background(), uploadtest.ZipFileHeader(t, "b.zip", map[string][]byte{"index.json": []byte("{}")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.UnzipAndDelete(context.Background(), zipPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(h.CdnPath("bundle", "index.json")); err != nil {
+		t.Fatalf("archive not unzipped into type dir[%v]", err)
+	}
+	if _, err := os.Stat(h.CdnPath("index.json")); !os.IsNotExist(err) {
+		t.Fatalf("archive unzipped into cdn root[%v]", err)
+	}
+
+	// 占位类型不能上传
+	if _, err := h.Storage(upload.RT_GMAE_SHARE).Upload(context.Background(), uploadtest.FileHeader(t, "a.png", pngContent)); !errors.Is(err, upload.ErrUnsupportedType) {
+		t.Fatalf("expect not uploadable[%v]", err)
+	}
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	h := uploadtest.New(t)
+	h.Config["storage.delay_delete.duration"] = "10m"
+	tenants := []*uploadtest.Harness{
+		h.WithNamespace(upload.Namespace{Tenant: "t1", Env: "prod"}),
+		h.WithNamespace(upload.Namespace{Tenant: "t2", Env: "prod"}),
+	}
+	uploadPaths := make([]string, len(tenants))
+	for i, tenant := range tenants {
+		content := append(append([]byte{}, pngContent...), byte(i))
+		storage := tenant.Storage(upload.RT_GAME_ICON, "a1")
+		uploadPath, err := storage.Upload(context.Background(), uploadtest.FileHeader(t, "a.png", content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.UploadAndRename(context.Background(), uploadPath); err != nil {
+			t.Fatal(err)
+		}
+		if uploadPaths[i], err = storage.Upload(context.Background(), uploadtest.FileHeader(t, "b.png", content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, tenant := range tenants {
+		content, err := os.ReadFile(tenant.CdnPath("icon", "a1.png"))
+		if err != nil || content[len(content)-1] != byte(i) {
+			t.Fatalf("tenant %d published file overwritten[%v]", i, err)
+		}
+	}
+
+	// 分片上传元数据和延迟任务互不可见
+	if _, _, err := tenants[0].MultipartStorage(upload.RT_GAME_ICON, "u1").Start(context.Background(),
+		&upload.MultipartUploadStartRequest{Type: upload.RT_GAME_ICON, Filename: "a.png"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenants[1].Options.Metadata.GetUpload(context.Background(), "u1"); !errors.Is(err, upload.ErrMetadataNotFound) {
+		t.Fatalf("multipart upload visible to other tenant[%v]", err)
+	}
+	h.Advance(11 * time.Minute)
+	tenants[0].RunDelayJobs()
+	if _, err := os.Stat(tenants[0].UploadPath(uploadPaths[0])); !os.IsNotExist(err) {
+		t.Fatalf("tenant file not deleted[%v]", err)
+	}
+	if _, err := os.Stat(tenants[1].UploadPath(uploadPaths[1])); err != nil {
+		t.Fatalf("other tenant file deleted[%v]", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	h := uploadtest.New(t)
+	h.Config["quota.1.max_bytes"] = int64(len(pngContent) + 10)
+	h.Config["quota.max_multipart_uploads"] = int64(1)
+	ctx := context.Background()
+	storage := h.Storage(upload.RT_GAME_ICON, "a1")
+	uploadPath, err := storage.Upload(ctx, uploadtest.FileHeader(t, "a.png", pngContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.UploadAndRename(ctx, uploadPath); err != nil {
+		t.Fatal(err)
+	}
+	// 覆盖同一个文件只占用大小的差值
+	if _, err := storage.UploadAndRename(ctx, uploadPath); err != nil {
+		t.Fatalf("overwrite counted twice[%v]", err)
+	}
+	if _, err := h.Storage(upload.RT_GAME_ICON, "a2").Upload(ctx, uploadtest.FileHeader(t, "a.png", pngContent)); !errors.Is(err, upload.ErrQuotaExceeded) {
+		t.Fatalf("expect quota exceeded[%v]", err)
+	}
+	start := func(uploadId string) error {
+		_, _, err := h.MultipartStorage(upload.RT_GAME_HALL, uploadId).Start(ctx,
+			&upload.MultipartUploadStartRequest{Type: upload.RT_GAME_HALL, Filename: "a.zip"}, 1024)
+		return err
+	}
+	if err := start("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := start("u2"); !errors.Is(err, upload.ErrQuotaExceeded) {
+		t.Fatalf("expect multipart quota exceeded[%v]", err)
+	}
+	if err := h.MultipartStorage(upload.RT_GAME_HALL).Abort(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := start("u2"); err != nil {
+		t.Fatalf("aborted upload not released[%v]", err)
+	}
+
+	report, err := upload.GetUsageWithOptions(ctx, h.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Bytes != int64(len(pngContent)) || report.MultipartUploads != 1 || len(report.Types) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	// 删除cdn文件后释放
+	job, err := upload.NewDelayJob(upload.DJ_UNPUBLISH, "a1", &upload.UnpublishPayload{ResourceType: upload.RT_GAME_ICON, Path: "a1.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DelayJob.AddJob(ctx, job, h.Clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	h.RunDelayJobs()
+	if report, err = upload.GetUsageWithOptions(ctx, h.Options); err != nil || report.Bytes != 0 {
+		t.Fatalf("usage not released %+v[%v]", report, err)
+	}
+
+	// 重新统计已发布的文件
+	if err := os.WriteFile(h.CdnPath("icon", "old.png"), pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = upload.RecalculateUsageWithOptions(ctx, h.Options); err != nil || report.Bytes != int64(len(pngContent)) {
+		t.Fatalf("unexpected recalculated usage %+v[%v]", report, err)
+	}
+}
+
+func TestPublishServer(t *testing.T) {
+	h := uploadtest.New(t)
+	publisher, err := upload.NewPublishServerWithOptions(h.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(publisher)
+	defer server.Close()
+	publish := func(req *upload.PublishRequest) (*upload.PublishResult, int) {
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(server.URL+upload.PUBLISH_PATH, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result upload.PublishResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		return &result, resp.StatusCode
+	}
+	ctx := context.Background()
+
+	iconPath, err := h.Storage(upload.RT_GAME_ICON).Upload(ctx, uploadtest.FileHeader(t, "a.png", pngContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, status := publish(&upload.PublishRequest{Type: upload.RT_GAME_ICON, ResourceId: "logo", DownloadPath: iconPath}); status != http.StatusOK || !strings.HasPrefix(result.Path, "/icon/logo.png?v=") {
+		t.Fatalf("unexpected publish result %+v %d", result, status)
+	}
+	if content, err := os.ReadFile(h.CdnPath("icon", "logo.png")); err != nil || !bytes.Equal(content, pngContent) {
+		t.Fatalf("unexpected published file[%v]", err)
+	}
+
+	zipPath, err := h.Storage(upload.RT_ACTIVITY_EVENT).Upload(ctx, uploadtest.ZipFileHeader(t, "a.zip", map[string][]byte{"index.json": []byte("{}")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, status := publish(&upload.PublishRequest{Type: upload.RT_ACTIVITY_EVENT, DownloadPath: zipPath, Unzip: true, UnzipPath: "../v1"})
+	if status != http.StatusOK || result.Path != "/activity/v1" {
+		t.Fatalf("unexpected unzip result %+v %d", result, status)
+	}
+	if _, err := os.Stat(h.CdnPath("activity", "v1", "index.json")); err != nil {
+		t.Fatalf("unzipped file not found[%v]", err)
+	}
+
+	if _, status := publish(&upload.PublishRequest{Type: upload.RT_GAME_ICON}); status != http.StatusBadRequest {
+		t.Fatalf("missing download_path got %d", status)
+	}
+	// 上传目录之外的文件不能发布
+	secretPath := filepath.Join(filepath.Dir(h.UploadPath("")), "secret.png")
+	if err := os.WriteFile(secretPath, pngContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, downloadPath := range []string{"../secret.png?v=1&where=upload", "/icon/../../secret.png?v=1&where=upload"} {
+		if _, status := publish(&upload.PublishRequest{Type: upload.RT_GAME_ICON, ResourceId: "leak", DownloadPath: downloadPath}); status != http.StatusBadRequest {
+			t.Fatalf("download_path '%s' got %d", downloadPath, status)
+		}
+	}
+	if _, err := os.Stat(h.CdnPath("icon", "leak.png")); !os.IsNotExist(err) {
+		t.Fatalf("file outside upload path published[%v]", err)
+	}
+	if _, status := publish(&upload.PublishRequest{Type: upload.RT_ACTIVITY_EVENT, DownloadPath: zipPath, Unzip: true}); status != http.StatusNotFound {
+		t.Fatalf("unzip deleted file got %d", status)
+	}
+}